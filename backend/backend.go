@@ -57,10 +57,38 @@ type Conn interface {
 	// used for health checks.
 	Ping() error
 
+	// Transaction calls fn with a Conn whose writes are applied atomically:
+	// either all of them are applied if fn returns nil, or none of them are.
+	// Drivers that do not support transactions simply call fn with
+	// themselves.
+	Transaction(fn func(Conn) error) error
+
 	// RecordAnnounce is called once per announce, and is passed the delta in
 	// statistics for the client peer since its last announce.
 	RecordAnnounce(delta *models.AnnounceDelta) error
 
+	// RecordSnatch is called for every announce that completed a download on
+	// a private tracker, in addition to RecordAnnounce.
+	RecordSnatch(snatch *models.Snatch) error
+
+	// IncrementUserUpload and IncrementUserDownload add to the totals of the
+	// user with the provided passkey. Unlike RecordAnnounce, they are applied
+	// before the announce is answered, for backends that enforce ratios in
+	// real time.
+	IncrementUserUpload(passkey string, delta uint64) error
+	IncrementUserDownload(passkey string, delta uint64) error
+
+	// IsInfohashBlocked is consulted before every announce and scrape, and
+	// returns true if a torrent must be refused, e.g. for legal reasons.
+	IsInfohashBlocked(infohash string) (bool, error)
+
+	// PutUser creates or updates a user, such as when a passkey is
+	// provisioned through the tracker's API.
+	PutUser(user *models.User) error
+
+	// DeleteUser removes the user with the provided passkey.
+	DeleteUser(passkey string) error
+
 	// LoadTorrents fetches and returns the specified torrents.
 	LoadTorrents(ids []uint64) ([]*models.Torrent, error)
 
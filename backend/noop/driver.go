@@ -33,11 +33,46 @@ func (n *NoOp) Ping() error {
 	return nil
 }
 
+// Transaction calls fn directly, since there is nothing to roll back.
+func (n *NoOp) Transaction(fn func(backend.Conn) error) error {
+	return fn(n)
+}
+
 // RecordAnnounce returns nil.
 func (n *NoOp) RecordAnnounce(delta *models.AnnounceDelta) error {
 	return nil
 }
 
+// RecordSnatch returns nil.
+func (n *NoOp) RecordSnatch(snatch *models.Snatch) error {
+	return nil
+}
+
+// IncrementUserUpload returns nil.
+func (n *NoOp) IncrementUserUpload(passkey string, delta uint64) error {
+	return nil
+}
+
+// IncrementUserDownload returns nil.
+func (n *NoOp) IncrementUserDownload(passkey string, delta uint64) error {
+	return nil
+}
+
+// IsInfohashBlocked returns (false, nil).
+func (n *NoOp) IsInfohashBlocked(infohash string) (bool, error) {
+	return false, nil
+}
+
+// PutUser returns nil.
+func (n *NoOp) PutUser(user *models.User) error {
+	return nil
+}
+
+// DeleteUser returns nil.
+func (n *NoOp) DeleteUser(passkey string) error {
+	return nil
+}
+
 // LoadTorrents returns (nil, nil).
 func (n *NoOp) LoadTorrents(ids []uint64) ([]*models.Torrent, error) {
 	return nil, nil
@@ -0,0 +1,339 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package sharded implements a Chihaya backend storage driver that spreads
+// torrents across several other backends by infohash, so that the backend can
+// be scaled horizontally.
+//
+// The driver is configured with the following params:
+//
+//	"shards":   a comma-separated list of the drivers of each shard (required)
+//	"weights":  a comma-separated list of the relative share of torrents
+//	            given to each shard (optional, defaults to equal shares)
+//	"shardN.*": params passed to the Nth shard, counting from 0, with the
+//	            "shardN." prefix removed
+package sharded
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/chihaya/chihaya/backend"
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// ErrBadWeights is returned when the weights do not match the shards.
+var ErrBadWeights = errors.New("sharded: there must be one positive weight for each shard")
+
+type driver struct{}
+
+// Sharded is a backend driver for Chihaya that sends every call concerning a
+// torrent to one of its shards, chosen by hashing the infohash. Users do not
+// belong to any torrent, so they are kept by the first shard.
+type Sharded struct {
+	shards []backend.Conn
+
+	// slots maps a hash, modulo its length, to the index of a shard. Each
+	// shard occupies as many slots as its weight.
+	slots []int
+}
+
+// New returns a new Chihaya backend driver that spreads torrents across the
+// provided shards in proportion to their weights. If weights is nil, every
+// shard is given an equal share.
+func New(shards []backend.Conn, weights []int) (*Sharded, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("sharded: no shards")
+	}
+
+	if weights == nil {
+		weights = make([]int, len(shards))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	if len(weights) != len(shards) {
+		return nil, ErrBadWeights
+	}
+
+	s := &Sharded{shards: shards}
+	for i, weight := range weights {
+		if weight <= 0 {
+			return nil, ErrBadWeights
+		}
+		for j := 0; j < weight; j++ {
+			s.slots = append(s.slots, i)
+		}
+	}
+
+	return s, nil
+}
+
+// New opens each shard described by the params of cfg, and returns a Sharded
+// backend driver over them.
+func (d *driver) New(cfg *config.DriverConfig) (backend.Conn, error) {
+	names, exists := cfg.Params["shards"]
+	if !exists || names == "" {
+		return nil, config.ErrMissingRequiredParam
+	}
+
+	var weights []int
+	if weightList, exists := cfg.Params["weights"]; exists {
+		for _, w := range strings.Split(weightList, ",") {
+			weight, err := strconv.Atoi(strings.TrimSpace(w))
+			if err != nil {
+				return nil, ErrBadWeights
+			}
+			weights = append(weights, weight)
+		}
+	}
+
+	var shards []backend.Conn
+	for i, name := range strings.Split(names, ",") {
+		conn, err := backend.Open(shardConfig(cfg, i, strings.TrimSpace(name)))
+		if err != nil {
+			closeAll(shards)
+			return nil, err
+		}
+		shards = append(shards, conn)
+	}
+
+	s, err := New(shards, weights)
+	if err != nil {
+		closeAll(shards)
+		return nil, err
+	}
+	return s, nil
+}
+
+// shardConfig returns the configuration of the ith shard.
+func shardConfig(cfg *config.DriverConfig, i int, name string) *config.DriverConfig {
+	prefix := fmt.Sprintf("shard%d.", i)
+	params := make(map[string]string)
+	for key, value := range cfg.Params {
+		if strings.HasPrefix(key, prefix) {
+			params[strings.TrimPrefix(key, prefix)] = value
+		}
+	}
+
+	return &config.DriverConfig{Name: name, Params: params}
+}
+
+func closeAll(conns []backend.Conn) error {
+	var firstErr error
+	for _, conn := range conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// shardIndex returns the index of the shard that an infohash belongs to.
+func (s *Sharded) shardIndex(infohash string) int {
+	h := fnv.New32()
+	h.Write([]byte(infohash))
+	return s.slots[h.Sum32()%uint32(len(s.slots))]
+}
+
+// Close closes every shard, and returns the first error encountered.
+func (s *Sharded) Close() error {
+	return closeAll(s.shards)
+}
+
+// Ping pings every shard, and returns the first error encountered.
+func (s *Sharded) Ping() error {
+	for _, shard := range s.shards {
+		if err := shard.Ping(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transaction calls fn with a Conn that buffers writes, which are then applied
+// within a transaction of the shard they belong to. Writes spanning several
+// shards are only atomic within each shard.
+func (s *Sharded) Transaction(fn func(backend.Conn) error) error {
+	t := &tx{Sharded: s}
+	if err := fn(t); err != nil {
+		return err
+	}
+	return t.commit()
+}
+
+// RecordAnnounce records an announce on the shard of its torrent.
+func (s *Sharded) RecordAnnounce(delta *models.AnnounceDelta) error {
+	return s.shards[s.shardIndex(delta.Torrent.Infohash)].RecordAnnounce(delta)
+}
+
+// RecordSnatch records a snatch on the shard of its torrent.
+func (s *Sharded) RecordSnatch(snatch *models.Snatch) error {
+	return s.shards[s.shardIndex(snatch.Infohash)].RecordSnatch(snatch)
+}
+
+// IncrementUserUpload adds to the upload total of a user on the first shard.
+func (s *Sharded) IncrementUserUpload(passkey string, delta uint64) error {
+	return s.shards[0].IncrementUserUpload(passkey, delta)
+}
+
+// IncrementUserDownload adds to the download total of a user on the first
+// shard.
+func (s *Sharded) IncrementUserDownload(passkey string, delta uint64) error {
+	return s.shards[0].IncrementUserDownload(passkey, delta)
+}
+
+// IsInfohashBlocked asks the shard of the infohash whether it is blocked.
+func (s *Sharded) IsInfohashBlocked(infohash string) (bool, error) {
+	return s.shards[s.shardIndex(infohash)].IsInfohashBlocked(infohash)
+}
+
+// PutUser creates or updates a user on the first shard.
+func (s *Sharded) PutUser(user *models.User) error {
+	return s.shards[0].PutUser(user)
+}
+
+// DeleteUser removes a user from the first shard.
+func (s *Sharded) DeleteUser(passkey string) error {
+	return s.shards[0].DeleteUser(passkey)
+}
+
+// LoadTorrents fetches the specified torrents from every shard, since they are
+// identified by ID rather than by infohash.
+func (s *Sharded) LoadTorrents(ids []uint64) ([]*models.Torrent, error) {
+	var torrents []*models.Torrent
+	for _, shard := range s.shards {
+		loaded, err := shard.LoadTorrents(ids)
+		if err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, loaded...)
+	}
+	return torrents, nil
+}
+
+// LoadAllTorrents fetches the torrents of every shard.
+func (s *Sharded) LoadAllTorrents() ([]*models.Torrent, error) {
+	var torrents []*models.Torrent
+	for _, shard := range s.shards {
+		loaded, err := shard.LoadAllTorrents()
+		if err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, loaded...)
+	}
+	return torrents, nil
+}
+
+// LoadUsers fetches the specified users from the first shard.
+func (s *Sharded) LoadUsers(ids []uint64) ([]*models.User, error) {
+	return s.shards[0].LoadUsers(ids)
+}
+
+// LoadAllUsers fetches users from the first shard.
+func (s *Sharded) LoadAllUsers(ids []uint64) ([]*models.User, error) {
+	return s.shards[0].LoadAllUsers(ids)
+}
+
+// tx buffers the writes made within a transaction along with the shard each
+// belongs to. Reads are passed through to the shards directly.
+type tx struct {
+	*Sharded
+	writes []write
+}
+
+type write struct {
+	shard int
+	apply func(backend.Conn) error
+}
+
+// Transaction joins the buffering transaction.
+func (t *tx) Transaction(fn func(backend.Conn) error) error {
+	return fn(t)
+}
+
+func (t *tx) RecordAnnounce(delta *models.AnnounceDelta) error {
+	t.buffer(t.shardIndex(delta.Torrent.Infohash), func(conn backend.Conn) error {
+		return conn.RecordAnnounce(delta)
+	})
+	return nil
+}
+
+func (t *tx) RecordSnatch(snatch *models.Snatch) error {
+	t.buffer(t.shardIndex(snatch.Infohash), func(conn backend.Conn) error {
+		return conn.RecordSnatch(snatch)
+	})
+	return nil
+}
+
+func (t *tx) IncrementUserUpload(passkey string, delta uint64) error {
+	t.buffer(0, func(conn backend.Conn) error {
+		return conn.IncrementUserUpload(passkey, delta)
+	})
+	return nil
+}
+
+func (t *tx) IncrementUserDownload(passkey string, delta uint64) error {
+	t.buffer(0, func(conn backend.Conn) error {
+		return conn.IncrementUserDownload(passkey, delta)
+	})
+	return nil
+}
+
+func (t *tx) PutUser(user *models.User) error {
+	t.buffer(0, func(conn backend.Conn) error {
+		return conn.PutUser(user)
+	})
+	return nil
+}
+
+func (t *tx) DeleteUser(passkey string) error {
+	t.buffer(0, func(conn backend.Conn) error {
+		return conn.DeleteUser(passkey)
+	})
+	return nil
+}
+
+func (t *tx) buffer(shard int, apply func(backend.Conn) error) {
+	t.writes = append(t.writes, write{shard, apply})
+}
+
+// commit applies the buffered writes in one transaction per shard, ordered by
+// each shard's first write. The writes to each shard keep their order.
+func (t *tx) commit() error {
+	var order []int
+	byShard := make(map[int][]write)
+	for _, w := range t.writes {
+		if _, exists := byShard[w.shard]; !exists {
+			order = append(order, w.shard)
+		}
+		byShard[w.shard] = append(byShard[w.shard], w)
+	}
+
+	for _, shard := range order {
+		writes := byShard[shard]
+		err := t.shards[shard].Transaction(func(conn backend.Conn) error {
+			for _, w := range writes {
+				if err := w.apply(conn); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Init registers the sharded driver as a backend for Chihaya.
+func init() {
+	backend.Register("sharded", &driver{})
+}
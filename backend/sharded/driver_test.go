@@ -0,0 +1,113 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package sharded
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/chihaya/chihaya/backend"
+	"github.com/chihaya/chihaya/backend/noop"
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// recorder is a backend that counts the announces and transactions it is
+// given.
+type recorder struct {
+	noop.NoOp
+	announces    int
+	transactions int
+}
+
+func (r *recorder) Transaction(fn func(backend.Conn) error) error {
+	r.transactions++
+	return fn(r)
+}
+
+func (r *recorder) RecordAnnounce(delta *models.AnnounceDelta) error {
+	r.announces++
+	return nil
+}
+
+func announceDelta(infohash string) *models.AnnounceDelta {
+	return &models.AnnounceDelta{Torrent: &models.Torrent{Infohash: infohash}}
+}
+
+func TestWeightedSharding(t *testing.T) {
+	shards := []*recorder{{}, {}}
+	s, err := New([]backend.Conn{shards[0], shards[1]}, []int{3, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		infohash := fmt.Sprintf("infohash%d", i)
+		if err := s.RecordAnnounce(announceDelta(infohash)); err != nil {
+			t.Fatal(err)
+		}
+		if s.shardIndex(infohash) != s.shardIndex(infohash) {
+			t.Fatal("expected an infohash to always map to the same shard")
+		}
+	}
+
+	if shards[0].announces < 650 || shards[0].announces > 850 {
+		t.Errorf("expected about 3/4 of torrents on the heavier shard, got %d/1000", shards[0].announces)
+	}
+	if shards[0].announces+shards[1].announces != 1000 {
+		t.Errorf("expected every announce to be recorded once")
+	}
+}
+
+func TestShardedTransaction(t *testing.T) {
+	shards := []*recorder{{}, {}}
+	s, err := New([]backend.Conn{shards[0], shards[1]}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var infohash string
+	for i := 0; s.shardIndex(infohash) != 1; i++ {
+		infohash = fmt.Sprintf("infohash%d", i)
+	}
+
+	err = s.Transaction(func(conn backend.Conn) error {
+		if err := conn.RecordAnnounce(announceDelta(infohash)); err != nil {
+			return err
+		}
+		if shards[1].announces != 0 {
+			t.Error("expected writes to be buffered until the transaction ends")
+		}
+		return conn.RecordAnnounce(announceDelta(infohash))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shards[1].announces != 2 || shards[1].transactions != 1 || shards[0].transactions != 0 {
+		t.Errorf("expected one transaction on the torrent's shard, got %+v", shards)
+	}
+}
+
+func TestOpenSharded(t *testing.T) {
+	conn, err := backend.Open(&config.DriverConfig{
+		Name:   "sharded",
+		Params: map[string]string{"shards": "noop, noop", "weights": "1,2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := conn.(*Sharded); len(s.shards) != 2 || len(s.slots) != 3 {
+		t.Errorf("expected 2 shards in 3 slots, got %d in %d", len(s.shards), len(s.slots))
+	}
+
+	_, err = backend.Open(&config.DriverConfig{
+		Name:   "sharded",
+		Params: map[string]string{"shards": "noop,noop", "weights": "1"},
+	})
+	if err != ErrBadWeights {
+		t.Errorf("expected mismatched weights to be rejected, got %v", err)
+	}
+}
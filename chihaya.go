@@ -16,9 +16,11 @@ import (
 	"github.com/chihaya/chihaya/http"
 	"github.com/chihaya/chihaya/stats"
 	"github.com/chihaya/chihaya/tracker"
+	"github.com/chihaya/chihaya/udp"
 
 	// See the README for how to import custom drivers.
 	_ "github.com/chihaya/chihaya/backend/noop"
+	_ "github.com/chihaya/chihaya/backend/sharded"
 )
 
 var (
@@ -77,6 +79,26 @@ func Boot() {
 		glog.Fatal("New: ", err)
 	}
 
+	var udpSrv *udp.Server
+	if cfg.UDPListenAddr != "" {
+		udpSrv = udp.NewServer(cfg, tkr)
+		go func() {
+			if err := udpSrv.ListenAndServe(); err != nil {
+				glog.Errorf("Failed to run UDP server: %s", err.Error())
+			}
+		}()
+	}
+
 	http.Serve(cfg, tkr)
+
+	// The tracker is only closed once every server has stopped, so that none
+	// of them handle requests with a closed tracker or race the final
+	// snapshot.
+	if udpSrv != nil {
+		udpSrv.Stop()
+	}
+	if err := tkr.Close(); err != nil {
+		glog.Errorf("Failed to shutdown tracker cleanly: %s", err.Error())
+	}
 	glog.Info("Gracefully shut down")
 }
@@ -8,8 +8,11 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -33,6 +36,72 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 	return err
 }
 
+// IPNets is a list of IP networks, and adds JSON marshalling from IP addresses
+// or CIDRs.
+type IPNets []*net.IPNet
+
+// ParseIPNets parses a list of IP addresses or CIDRs. A single address is
+// parsed as a network containing only itself.
+func ParseIPNets(strs []string) (IPNets, error) {
+	nets := make(IPNets, 0, len(strs))
+	for _, str := range strs {
+		if strings.Contains(str, "/") {
+			_, ipnet, err := net.ParseCIDR(str)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, ipnet)
+			continue
+		}
+
+		ip := net.ParseIP(str)
+		switch {
+		case ip == nil:
+			return nil, fmt.Errorf("invalid IP address: %q", str)
+		case ip.To4() != nil:
+			nets = append(nets, &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)})
+		default:
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+		}
+	}
+	return nets, nil
+}
+
+// Contains returns true if any of the networks contains ip.
+func (n IPNets) Contains(ip net.IP) bool {
+	for _, ipnet := range n {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON transforms IP networks into JSON.
+func (n IPNets) MarshalJSON() ([]byte, error) {
+	strs := make([]string, len(n))
+	for i, ipnet := range n {
+		strs[i] = ipnet.String()
+	}
+	return json.Marshal(strs)
+}
+
+// UnmarshalJSON transforms JSON into IP networks, failing on any entry that is
+// neither an IP address nor a CIDR.
+func (n *IPNets) UnmarshalJSON(b []byte) error {
+	var strs []string
+	if err := json.Unmarshal(b, &strs); err != nil {
+		return err
+	}
+
+	nets, err := ParseIPNets(strs)
+	if err != nil {
+		return err
+	}
+	*n = nets
+	return nil
+}
+
 // DriverConfig is the configuration used to connect to a tracker.Driver or
 // a backend.Driver.
 type DriverConfig struct {
@@ -41,47 +110,181 @@ type DriverConfig struct {
 }
 
 // SubnetConfig is the configuration used to specify if local peers should be
-// given a preference when responding to an announce.
+// given a preference when responding to an announce, and if peers that are
+// likely behind the same NAT as the announcer should be left out.
 type SubnetConfig struct {
 	PreferredSubnet     bool `json:"preferred_subnet,omitempty"`
 	PreferredIPv4Subnet int  `json:"preferred_ipv4_subnet,omitempty"`
 	PreferredIPv6Subnet int  `json:"preferred_ipv6_subnet,omitempty"`
+
+	ExcludeSameSubnet  bool `json:"exclude_same_subnet,omitempty"`
+	ExcludedIPv4Subnet int  `json:"excluded_ipv4_subnet,omitempty"`
+	ExcludedIPv6Subnet int  `json:"excluded_ipv6_subnet,omitempty"`
+}
+
+// ProxyConfig is the configuration used to determine the real address of
+// peers when running behind trusted reverse proxies.
+//
+// TrustedProxies is a list of IP addresses or CIDRs. The X-Forwarded-For header
+// is only honoured for requests from these addresses, and the right-most
+// address in it that is not itself a trusted proxy is used, since the
+// addresses to its left are sent by the client.
+type ProxyConfig struct {
+	TrustedProxies IPNets `json:"trusted_proxies,omitempty"`
 }
 
 // NetConfig is the configuration used to tune networking behaviour.
+//
+// AllowIPv6Param accepts the global IPv6 address that BEP 7 clients send in
+// the ipv6 parameter even when spoofing is not allowed. It is only added to
+// peers connecting over IPv4 when DualStackedPeers is enabled. With
+// StrictIPv6Param, announces over IPv6 are rejected if the parameter does not
+// match the connecting address.
+//
+// PeerFamilyPreference controls which address families of peers are returned
+// to an announcer. By default IPv6 peers are only given to announcers with an
+// IPv6 address, and IPv4 peers to every announcer unless RespectAF is set. See
+// the PeerFamily constants for the other modes.
 type NetConfig struct {
-	AllowIPSpoofing  bool   `json:"allow_ip_spoofing"`
-	DualStackedPeers bool   `json:"dual_stacked_peers"`
-	RealIPHeader     string `json:"real_ip_header"`
-	RespectAF        bool   `json:"respect_af"`
+	AllowIPSpoofing      bool   `json:"allow_ip_spoofing"`
+	DualStackedPeers     bool   `json:"dual_stacked_peers"`
+	DedupeDualStack      bool   `json:"dedupe_dual_stack"`
+	AllowIPv6Param       bool   `json:"allow_ipv6_param"`
+	StrictIPv6Param      bool   `json:"strict_ipv6_param"`
+	RealIPHeader         string `json:"real_ip_header"`
+	RespectAF            bool   `json:"respect_af"`
+	PeerFamilyPreference string `json:"peer_family_preference"`
+	AllowPrivateIPs      bool   `json:"allow_private_ips"`
 	SubnetConfig
+	ProxyConfig
 }
 
+// The modes of PeerFamilyPreference.
+const (
+	// PeerFamilyBoth returns peers of both families to every announcer.
+	PeerFamilyBoth = "both"
+
+	// PeerFamilyMatchAnnouncer returns peers of a family only to announcers
+	// with an address of that family.
+	PeerFamilyMatchAnnouncer = "match_announcer"
+
+	// PeerFamilyPreferIPv4 and PeerFamilyPreferIPv6 are like
+	// PeerFamilyMatchAnnouncer, but announcers with both families are given
+	// peers of the preferred family before any of the other.
+	PeerFamilyPreferIPv4 = "prefer_ipv4"
+	PeerFamilyPreferIPv6 = "prefer_ipv6"
+)
+
 // StatsConfig is the configuration used to record runtime statistics.
 type StatsConfig struct {
 	BufferSize int  `json:"stats_buffer_size"`
 	IncludeMem bool `json:"include_mem_stats"`
 	VerboseMem bool `json:"verbose_mem_stats"`
 
+	// HotTorrentTracking is the number of torrents whose announces are
+	// counted in order to report the busiest ones. 0 disables it.
+	// HotTorrentWindow is how often they are reported, counting only the
+	// announces received since the last report.
+	HotTorrentTracking int      `json:"hot_torrent_tracking"`
+	HotTorrentWindow   Duration `json:"hot_torrent_window"`
+
 	MemUpdateInterval Duration `json:"mem_stats_interval"`
 }
 
 // WhitelistConfig is the configuration used enable and store a whitelist of
-// acceptable torrent client peer ID prefixes.
+// acceptable torrent client peer ID prefixes, as well as a blacklist of
+// unacceptable ones.
+//
+// Blacklist entries are matched as prefixes of the client ID, so "BT0"
+// rejects every 0.x version of BitTorrent. A leading '-' and trailing '*' are
+// accepted for readability, e.g. "-BT0*".
 type WhitelistConfig struct {
 	ClientWhitelistEnabled bool     `json:"client_whitelist_enabled"`
 	ClientWhitelist        []string `json:"client_whitelist,omitempty"`
+	ClientBlacklist        []string `json:"client_blacklist,omitempty"`
 }
 
 // TrackerConfig is the configuration for tracker functionality.
 type TrackerConfig struct {
-	PrivateEnabled        bool     `json:"private_enabled"`
-	FreeleechEnabled      bool     `json:"freeleech_enabled"`
-	PurgeInactiveTorrents bool     `json:"purge_inactive_torrents"`
-	Announce              Duration `json:"announce"`
-	MinAnnounce           Duration `json:"min_announce"`
-	NumWantFallback       int      `json:"default_num_want"`
-	TorrentMapShards      int      `json:"torrent_map_shards"`
+	PrivateEnabled             bool     `json:"private_enabled"`
+	EnforceTorrentACLs         bool     `json:"enforce_torrent_acls"`
+	FreeleechEnabled           bool     `json:"freeleech_enabled"`
+	PurgeInactiveTorrents      bool     `json:"purge_inactive_torrents"`
+	CountImplicitCompletes     bool     `json:"count_implicit_completes"`
+	ExcludeMetadataPeers       bool     `json:"exclude_metadata_peers"`
+	LearnMetadataSize          bool     `json:"learn_metadata_size"`
+	PreferCapableSeeders       bool     `json:"prefer_capable_seeders"`
+	ReturnNewestPeers          bool     `json:"return_newest_peers"`
+	IncludeRecentlyDeparted    bool     `json:"include_recently_departed"`
+	BEP40Ordering              bool     `json:"bep40_ordering"`
+	StablePeerSelection        bool     `json:"stable_peer_selection"`
+	TreatPartialSeedsSpecially bool     `json:"treat_partial_seeds_specially"`
+	SeedersGetSeeders          bool     `json:"seeders_get_seeders"`
+	EnforceMinInterval         bool     `json:"enforce_min_interval"`
+	EnforceTrackerID           bool     `json:"enforce_tracker_id"`
+	StrictStartedEvents        bool     `json:"strict_started_events"`
+	CompactOnly                bool     `json:"compact_only"`
+	RejectNonCompact           bool     `json:"reject_non_compact"`
+	AuditLogEnabled            bool     `json:"audit_log_enabled"`
+	Announce                   Duration `json:"announce"`
+	MinAnnounce                Duration `json:"min_announce"`
+	AnnounceJitter             Duration `json:"announce_jitter"`
+	AnnounceRateBurst          int      `json:"announce_rate_burst"`
+	AnnounceRateInterval       Duration `json:"announce_rate_interval"`
+	AuditLogBurst              int      `json:"audit_log_burst"`
+	AuditLogInterval           Duration `json:"audit_log_interval"`
+	PeerListCacheTTL           Duration `json:"peer_list_cache_ttl"`
+	DedupWindow                Duration `json:"dedup_window"`
+	RecentlyDepartedTTL        Duration `json:"recently_departed_ttl"`
+	StablePeerEpoch            Duration `json:"stable_peer_epoch"`
+	BackendBreakerThreshold    int      `json:"backend_breaker_threshold"`
+	BackendBreakerCooldown     Duration `json:"backend_breaker_cooldown"`
+	NumWantFallback            int      `json:"default_num_want"`
+	MaxNumWant                 int      `json:"max_num_want"`
+	TorrentMapShards           int      `json:"torrent_map_shards"`
+	MaxPeersPerTorrent         int      `json:"max_peers_per_torrent"`
+	MaxPeersPerUser            int      `json:"max_peers_per_user"`
+	MaxPeersPerIP              int      `json:"max_peers_per_ip"`
+	MaxActiveLeechPerUser      int      `json:"max_active_leech_per_user"`
+	MaxSeedersReturned         int      `json:"max_seeders_returned"`
+	MinRatio                   float64  `json:"min_ratio"`
+	WarnRatio                  float64  `json:"warn_ratio"`
+	SeederLeecherRatio         float64  `json:"seeder_leecher_ratio"`
+	RatioGraceBytes            uint64   `json:"ratio_grace_bytes"`
+	MaxBytesPerAnnounce        uint64   `json:"max_bytes_per_announce"`
+	PeerStaleAge               Duration `json:"peer_stale_age"`
+	ReapInterval               Duration `json:"reap_interval"`
+	TorrentMaxIdle             Duration `json:"torrent_max_idle"`
+	TorrentPurgeInterval       Duration `json:"torrent_purge_interval"`
+	SnapshotInterval           Duration `json:"snapshot_interval"`
+
+	// DrainTimeout bounds how long closing the tracker waits for in-flight
+	// requests to finish. Zero waits for as long as they take.
+	DrainTimeout Duration `json:"drain_timeout"`
+
+	// TrackerID is returned to clients, which echo it on later announces. A
+	// random ID is generated at startup if it is empty.
+	TrackerID string `json:"tracker_id"`
+
+	// AnnounceWarning, if not empty, is sent as a warning message with every
+	// announce, such as to give notice of maintenance.
+	AnnounceWarning string `json:"announce_warning"`
+
+	// SnapshotPath, if not empty, is the file that the swarms are saved to
+	// every SnapshotInterval and on shutdown, and restored from on startup.
+	SnapshotPath string `json:"snapshot_path"`
+
+	// BlockedInfohashes is a list of hex-encoded infohashes that are refused
+	// in addition to any blocked by the backend.
+	BlockedInfohashes []string `json:"blocked_infohashes,omitempty"`
+
+	// FixedPeers is a list of ip:port addresses, such as always-on seed
+	// boxes, that are included in every peer list.
+	FixedPeers []string `json:"fixed_peers,omitempty"`
+
+	// CategoryAnnounceIntervals overrides the announce interval of torrents
+	// in the listed categories, unless a torrent sets its own.
+	CategoryAnnounceIntervals map[string]Duration `json:"category_announce_intervals,omitempty"`
 
 	NetConfig
 	WhitelistConfig
@@ -94,12 +297,50 @@ type HTTPConfig struct {
 	HttpReadTimeout  Duration `json:"http_read_timeout"`
 	HttpWriteTimeout Duration `json:"http_write_timeout"`
 	HttpListenLimit  int      `json:"http_listen_limit"`
+
+	// GzipMinSize is the size in bytes from which announce responses are
+	// gzipped for clients that accept it. Compression is disabled if it is 0.
+	GzipMinSize int `json:"http_gzip_min_size"`
+
+	// OmitMinInterval and OmitScrapeCounts leave the min interval and the
+	// complete and incomplete counts out of announce responses, which saves
+	// bytes for trackers whose clients do not need them.
+	OmitMinInterval  bool `json:"http_omit_min_interval"`
+	OmitScrapeCounts bool `json:"http_omit_scrape_counts"`
+
+	// ResponseSigningKey, if not empty, is the secret used to sign announce
+	// responses with an HMAC, so that custom clients can detect tampering
+	// with their peer lists.
+	ResponseSigningKey string `json:"http_response_signing_key"`
+
+	// ParameterAliases maps nonstandard announce parameter names used by
+	// some clients to the standard names, such as "infohash" to "info_hash".
+	ParameterAliases map[string]string `json:"http_parameter_aliases,omitempty"`
+
+	// JSONResponsesEnabled lets clients ask for JSON announce and scrape
+	// responses instead of bencode, with format=json or an Accept header
+	// of application/json.
+	JSONResponsesEnabled bool `json:"http_json_responses_enabled"`
+
+	// WebTorrentEnabled serves browser clients, which exchange WebRTC
+	// signals through the tracker by long-polling for up to
+	// WebTorrentPollTimeout. The timeout must be shorter than the write
+	// timeout.
+	WebTorrentEnabled     bool     `json:"http_webtorrent_enabled"`
+	WebTorrentPollTimeout Duration `json:"http_webtorrent_poll_timeout"`
+}
+
+// UDPConfig is the configuration for UDP functionality. UDP is disabled if
+// UDPListenAddr is empty.
+type UDPConfig struct {
+	UDPListenAddr string `json:"udp_listen_addr"`
 }
 
 // Config is the global configuration for an instance of Chihaya.
 type Config struct {
 	TrackerConfig
 	HTTPConfig
+	UDPConfig
 	DriverConfig
 	StatsConfig
 }
@@ -107,18 +348,72 @@ type Config struct {
 // DefaultConfig is a configuration that can be used as a fallback value.
 var DefaultConfig = Config{
 	TrackerConfig: TrackerConfig{
-		PrivateEnabled:        false,
-		FreeleechEnabled:      false,
-		PurgeInactiveTorrents: true,
-		Announce:              Duration{30 * time.Minute},
-		MinAnnounce:           Duration{15 * time.Minute},
-		NumWantFallback:       50,
-		TorrentMapShards:      1,
+		PrivateEnabled:             false,
+		EnforceTorrentACLs:         false,
+		FreeleechEnabled:           false,
+		PurgeInactiveTorrents:      true,
+		CountImplicitCompletes:     false,
+		ExcludeMetadataPeers:       false,
+		LearnMetadataSize:          false,
+		PreferCapableSeeders:       false,
+		ReturnNewestPeers:          false,
+		IncludeRecentlyDeparted:    false,
+		BEP40Ordering:              false,
+		StablePeerSelection:        false,
+		TreatPartialSeedsSpecially: false,
+		SeedersGetSeeders:          false,
+		EnforceMinInterval:         false,
+		EnforceTrackerID:           false,
+		StrictStartedEvents:        false,
+		CompactOnly:                false,
+		RejectNonCompact:           false,
+		AuditLogEnabled:            false,
+		Announce:                   Duration{30 * time.Minute},
+		MinAnnounce:                Duration{15 * time.Minute},
+		AnnounceJitter:             Duration{0},
+		AnnounceRateBurst:          0,
+		AnnounceRateInterval:       Duration{5 * time.Minute},
+		AuditLogBurst:              100,
+		AuditLogInterval:           Duration{100 * time.Millisecond},
+		PeerListCacheTTL:           Duration{0},
+		DedupWindow:                Duration{0},
+		RecentlyDepartedTTL:        Duration{time.Minute},
+		StablePeerEpoch:            Duration{time.Hour},
+		BackendBreakerThreshold:    0,
+		BackendBreakerCooldown:     Duration{30 * time.Second},
+		NumWantFallback:            50,
+		MaxNumWant:                 50,
+		TorrentMapShards:           1,
+		MaxPeersPerTorrent:         0,
+		MaxPeersPerUser:            0,
+		MaxPeersPerIP:              0,
+		MaxActiveLeechPerUser:      0,
+		MaxSeedersReturned:         0,
+		MinRatio:                   0,
+		WarnRatio:                  0,
+		SeederLeecherRatio:         1,
+		RatioGraceBytes:            0,
+		MaxBytesPerAnnounce:        0,
+		PeerStaleAge:               Duration{0},
+		ReapInterval:               Duration{5 * time.Minute},
+		TorrentMaxIdle:             Duration{0},
+		TorrentPurgeInterval:       Duration{time.Hour},
+		SnapshotInterval:           Duration{5 * time.Minute},
+		DrainTimeout:               Duration{30 * time.Second},
 
 		NetConfig: NetConfig{
-			AllowIPSpoofing:  true,
-			DualStackedPeers: true,
-			RespectAF:        false,
+			AllowIPSpoofing:      true,
+			DualStackedPeers:     true,
+			DedupeDualStack:      false,
+			AllowIPv6Param:       false,
+			StrictIPv6Param:      false,
+			RespectAF:            false,
+			PeerFamilyPreference: "",
+			AllowPrivateIPs:      true,
+			SubnetConfig: SubnetConfig{
+				ExcludedIPv4Subnet: 32,
+				ExcludedIPv6Subnet: 128,
+			},
 		},
 
 		WhitelistConfig: WhitelistConfig{
@@ -131,6 +426,19 @@ var DefaultConfig = Config{
 		RequestTimeout:   Duration{10 * time.Second},
 		HttpReadTimeout:  Duration{10 * time.Second},
 		HttpWriteTimeout: Duration{10 * time.Second},
+		GzipMinSize:      1024,
+		OmitMinInterval:  false,
+		OmitScrapeCounts: false,
+
+		ResponseSigningKey:   "",
+		JSONResponsesEnabled: false,
+
+		WebTorrentEnabled:     false,
+		WebTorrentPollTimeout: Duration{5 * time.Second},
+	},
+
+	UDPConfig: UDPConfig{
+		UDPListenAddr: "",
 	},
 
 	DriverConfig: DriverConfig{
@@ -142,6 +450,9 @@ var DefaultConfig = Config{
 		IncludeMem: true,
 		VerboseMem: false,
 
+		HotTorrentTracking: 0,
+		HotTorrentWindow:   Duration{5 * time.Minute},
+
 		MemUpdateInterval: Duration{5 * time.Second},
 	},
 }
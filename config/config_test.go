@@ -0,0 +1,33 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package config
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTrustedProxies(t *testing.T) {
+	cfg, err := Decode(strings.NewReader(`{"trusted_proxies": ["10.0.0.1", "fc00::/7"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []string{"10.0.0.1", "fc00::1"} {
+		if !cfg.TrustedProxies.Contains(net.ParseIP(addr)) {
+			t.Errorf("expected %s to be trusted", addr)
+		}
+	}
+	if cfg.TrustedProxies.Contains(net.ParseIP("10.0.0.2")) {
+		t.Error("expected 10.0.0.2 not to be trusted")
+	}
+
+	for _, proxy := range []string{"10.0.0.256", "10.0.0.0/33", "proxy"} {
+		if _, err := Decode(strings.NewReader(`{"trusted_proxies": ["` + proxy + `"]}`)); err == nil {
+			t.Errorf("expected %q to be rejected", proxy)
+		}
+	}
+}
@@ -5,15 +5,25 @@
 package http
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/chihaya/bencode"
+	"github.com/chihaya/chihaya/backend"
+	"github.com/chihaya/chihaya/backend/noop"
 	"github.com/chihaya/chihaya/config"
 	"github.com/chihaya/chihaya/tracker"
 	"github.com/chihaya/chihaya/tracker/models"
@@ -48,6 +58,89 @@ func TestPublicAnnounce(t *testing.T) {
 	checkAnnounce(peer3, expected, srv, t)
 }
 
+func TestSeedersGetSeeders(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.SeedersGetSeeders = true
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true)
+	peer2 := makePeerParams("peer2", true)
+	peer3 := makePeerParams("peer3", false)
+
+	checkAnnounce(peer1, makeResponse(1, 0), srv, t)
+	checkAnnounce(peer2, makeResponse(2, 0, peer1), srv, t)
+	checkAnnounce(peer3, makeResponse(2, 1, peer1, peer2), srv, t)
+
+	// Leechers are given first, and seeders fill in the rest.
+	peer1["numwant"] = "1"
+	checkAnnounce(peer1, makeResponse(2, 1, peer3), srv, t)
+	peer1["numwant"] = "2"
+	checkAnnounce(peer1, makeResponse(2, 1, peer3, peer2), srv, t)
+}
+
+func TestPausedAnnounce(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true)
+	peer2 := makePeerParams("peer2", true)
+	peer3 := makePeerParams("peer3", false)
+
+	checkAnnounce(peer1, makeResponse(1, 0), srv, t)
+	checkAnnounce(peer2, makeResponse(2, 0), srv, t)
+	checkAnnounce(peer3, makeResponse(2, 1, peer1, peer2), srv, t)
+
+	// Paused peers stay in the swarm but are not handed out.
+	peer1["event"] = "paused"
+	checkAnnounce(peer1, makeResponse(2, 1, nil), srv, t)
+	checkAnnounce(peer3, makeResponse(2, 1, peer2), srv, t)
+
+	// Resuming makes the peer available again.
+	delete(peer1, "event")
+	checkAnnounce(peer1, makeResponse(2, 1, peer3), srv, t)
+	checkAnnounce(peer3, makeResponse(2, 1, peer1, peer2), srv, t)
+}
+
+func TestPartialSeedAnnounce(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.TreatPartialSeedsSpecially = true
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", false)
+	peer2 := makePeerParams("peer2", false)
+	peer3 := makePeerParams("peer3", true)
+
+	checkAnnounce(peer1, makeResponse(0, 1), srv, t)
+	checkAnnounce(peer2, makeResponse(0, 2, peer1), srv, t)
+	checkAnnounce(peer3, makeResponse(1, 2, peer1, peer2), srv, t)
+
+	// Partial seeds are handed out to leechers, but not to seeders.
+	peer1["event"] = "paused"
+	checkAnnounce(peer1, makeResponse(1, 2, nil), srv, t)
+	checkAnnounce(peer2, makeResponse(1, 2, peer3, peer1), srv, t)
+	checkAnnounce(peer3, makeResponse(1, 2, peer2), srv, t)
+
+	// They remain partial seeds until they make progress.
+	delete(peer1, "event")
+	checkAnnounce(peer1, makeResponse(1, 2, peer2), srv, t)
+	checkAnnounce(peer3, makeResponse(1, 2, peer2), srv, t)
+
+	peer1["left"] = "0"
+	checkAnnounce(peer1, makeResponse(2, 1, peer2), srv, t)
+	checkAnnounce(peer3, makeResponse(2, 1, peer2), srv, t)
+}
+
 func TestTorrentPurging(t *testing.T) {
 	cfg := config.DefaultConfig
 	srv, err := setupTracker(&cfg)
@@ -56,37 +149,1567 @@ func TestTorrentPurging(t *testing.T) {
 	}
 	defer srv.Close()
 
-	torrentAPIPath := srv.URL + "/torrents/" + url.QueryEscape(infoHash)
+	torrentAPIPath := srv.URL + "/torrents/" + url.QueryEscape(infoHash)
+
+	// Add one seeder.
+	peer := makePeerParams("peer1", true)
+	announce(peer, srv)
+
+	_, status, err := fetchPath(torrentAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusOK {
+		t.Fatalf("expected torrent to exist (got %s)", http.StatusText(status))
+	}
+
+	// Remove seeder.
+	peer = makePeerParams("peer1", true)
+	peer["event"] = "stopped"
+	announce(peer, srv)
+
+	_, status, err = fetchPath(torrentAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusNotFound {
+		t.Fatalf("expected torrent to have been purged (got %s)", http.StatusText(status))
+	}
+}
+
+func TestRemoveTorrent(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	torrentAPIPath := srv.URL + "/torrents/" + url.QueryEscape(infoHash)
+	remove := func() int {
+		req, _ := http.NewRequest("DELETE", torrentAPIPath, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	announce(makePeerParams("peer1", true), srv)
+	announce(makePeerParams("peer2", false), srv)
+
+	if status := remove(); status != http.StatusOK {
+		t.Fatalf("expected the torrent to be removed (got %s)", http.StatusText(status))
+	}
+
+	_, status, err := fetchPath(torrentAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusNotFound {
+		t.Fatalf("expected the torrent to be gone (got %s)", http.StatusText(status))
+	}
+
+	if status := remove(); status != http.StatusNotFound {
+		t.Errorf("expected removing a missing torrent to fail (got %s)", http.StatusText(status))
+	}
+
+	// The swarm was dropped along with the torrent.
+	expected := makeResponse(0, 1)
+	checkAnnounce(makePeerParams("peer3", false), expected, srv, t)
+}
+
+func TestOnSnatch(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snatches := make(chan *models.Snatch, 2)
+	tkr.OnSnatch = func(snatch *models.Snatch) {
+		snatches <- snatch
+	}
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer := makePeerParams("peer1", false)
+	announce(peer, srv)
+
+	peer = makePeerParams("peer1", true)
+	peer["event"] = "completed"
+	announce(peer, srv)
+
+	select {
+	case snatch := <-snatches:
+		if snatch.Infohash != infoHash || snatch.PeerID != "peer1" {
+			t.Errorf("expected a snatch by peer1, got %+v", snatch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected OnSnatch to be called")
+	}
+
+	// Resending the completed event is not another snatch.
+	announce(peer, srv)
+	select {
+	case snatch := <-snatches:
+		t.Errorf("expected no further snatches, got %+v", snatch)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestOnTorrentEmpty(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PurgeInactiveTorrents = false
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var emptied []string
+	tkr.OnTorrentEmpty = func(infohash string) {
+		emptied = append(emptied, infohash)
+	}
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true)
+	peer2 := makePeerParams("peer2", false)
+	announce(peer1, srv)
+	announce(peer2, srv)
+
+	peer1["event"] = "stopped"
+	announce(peer1, srv)
+	if len(emptied) != 0 {
+		t.Fatalf("expected no callback while peers remain, got %d", len(emptied))
+	}
+
+	peer2["event"] = "stopped"
+	announce(peer2, srv)
+	announce(peer2, srv)
+	if len(emptied) != 1 || emptied[0] != infoHash {
+		t.Fatalf("expected one callback once the last peer left, got %d", len(emptied))
+	}
+
+	delete(peer1, "event")
+	announce(peer1, srv)
+	peer1["event"] = "stopped"
+	announce(peer1, srv)
+	if len(emptied) != 2 {
+		t.Fatalf("expected another callback after the swarm emptied again, got %d", len(emptied))
+	}
+}
+
+func TestSwarmChurn(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", false)
+	peer2 := makePeerParams("peer2", false)
+	announce(peer1, srv)
+	announce(peer2, srv)
+
+	// Completing does not leave the swarm.
+	peer1["event"] = "completed"
+	peer1["left"] = "0"
+	announce(peer1, srv)
+
+	peer2["event"] = "stopped"
+	announce(peer2, srv)
+
+	torrent, err := tkr.TorrentSnapshot(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.CreatedAt == 0 {
+		t.Error("expected the torrent's creation time to be set")
+	}
+	if torrent.PeersJoined != 2 || torrent.PeersLeft != 1 {
+		t.Errorf("expected 2 peers to join and 1 to leave, got %d and %d", torrent.PeersJoined, torrent.PeersLeft)
+	}
+}
+
+func TestLinkedTorrentAnnounce(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	secondary := "\xfe" + infoHash[1:]
+
+	peer1 := makePeerParams("peer1", true)
+	peer2 := makePeerParams("peer2", true)
+	peer2["info_hash"] = secondary
+	announce(peer1, srv)
+	announce(peer2, srv)
+
+	if err := tkr.LinkTorrents(infoHash, secondary); err != nil {
+		t.Fatal(err)
+	}
+
+	peer3 := makePeerParams("peer3", false)
+	peer3["info_hash"] = secondary
+	expected := makeResponse(2, 1, peer1, peer2)
+	checkAnnounce(peer3, expected, srv, t)
+}
+
+func TestStalePeerPurging(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.Announce = config.Duration{
+		Duration: 10 * time.Millisecond,
+	}
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	torrentAPIPath := srv.URL + "/torrents/" + url.QueryEscape(infoHash)
+
+	// Add one seeder.
+	peer1 := makePeerParams("peer1", true)
+	announce(peer1, srv)
+
+	_, status, err := fetchPath(torrentAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusOK {
+		t.Fatalf("expected torrent to exist (got %s)", http.StatusText(status))
+	}
+
+	// Add a leecher.
+	peer2 := makePeerParams("peer2", false)
+	expected := makeResponse(1, 1, peer1)
+	expected["interval"] = int64(0)
+	checkAnnounce(peer2, expected, srv, t)
+
+	// Let them both expire.
+	time.Sleep(30 * time.Millisecond)
+
+	_, status, err = fetchPath(torrentAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusNotFound {
+		t.Fatalf("expected torrent to have been purged (got %s)", http.StatusText(status))
+	}
+}
+
+func TestPrivateAnnounce(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadPrivateTestData(tkr)
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer srv.Close()
+	baseURL := srv.URL
+
+	peer1 := makePeerParams("-TR2820-peer1", false)
+	peer2 := makePeerParams("-TR2820-peer2", false)
+	peer3 := makePeerParams("-TR2820-peer3", true)
+
+	expected := makeResponse(0, 1)
+	srv.URL = baseURL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv1"
+	checkAnnounce(peer1, expected, srv, t)
+
+	expected = makeResponse(0, 2, peer1)
+	srv.URL = baseURL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv2"
+	checkAnnounce(peer2, expected, srv, t)
+
+	expected = makeResponse(1, 2, peer1, peer2)
+	srv.URL = baseURL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv3"
+	checkAnnounce(peer3, expected, srv, t)
+
+	expected = makeResponse(1, 2, peer2, peer3)
+	srv.URL = baseURL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv1"
+	checkAnnounce(peer1, expected, srv, t)
+}
+
+func TestUnknownPasskeyAnnounce(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadPrivateTestData(tkr)
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.URL = srv.URL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv9"
+
+	peer := makePeerParams("-TR2820-peer1", false)
+	failure := bencode.Dict{"failure reason": models.ErrUserDNE.Error()}
+	checkAnnounce(peer, failure, srv, t)
+}
+
+func TestUserProvisioning(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadPrivateTestData(tkr)
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	srv.URL = srv.URL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv9"
+
+	body := strings.NewReader(`{"id": 9, "passkey": "vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv9"}`)
+	req, _ := http.NewRequest("PUT", srv.URL, body)
+	if res, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else {
+		res.Body.Close()
+	}
+
+	peer := makePeerParams("-TR2820-peer1", false)
+	expected := makeResponse(0, 1)
+	checkAnnounce(peer, expected, srv, t)
+
+	req, _ = http.NewRequest("DELETE", srv.URL, nil)
+	if res, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else {
+		res.Body.Close()
+	}
+
+	failure := bencode.Dict{"failure reason": models.ErrUserDNE.Error()}
+	checkAnnounce(peer, failure, srv, t)
+}
+
+func TestUserTotals(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadPrivateTestData(tkr)
+	passkey := "vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv1"
+	tkr.PutUser(&models.User{ID: 1, Passkey: passkey, UpMultiplier: 1, DownMultiplier: 1})
+	tkr.PutTorrent(&models.Torrent{
+		ID:             1,
+		Infohash:       infoHash,
+		UpMultiplier:   1,
+		DownMultiplier: 1,
+		Seeders:        models.NewPeerMap(true, tkr.Config),
+		Leechers:       models.NewPeerMap(false, tkr.Config),
+	})
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.URL = srv.URL + "/users/" + passkey
+
+	before, _ := tkr.FindUser(passkey)
+
+	peer := makePeerParams("-TR2820-peer1", false)
+	checkAnnounce(peer, makeResponse(0, 1), srv, t)
+
+	peer["uploaded"] = "1000"
+	peer["downloaded"] = "500"
+	checkAnnounce(peer, makeResponse(0, 1), srv, t)
+
+	user, err := tkr.FindUser(passkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Uploaded != 1000 || user.Downloaded != 500 {
+		t.Errorf("expected totals of 1000 up and 500 down, got %d and %d", user.Uploaded, user.Downloaded)
+	}
+	if before.Uploaded != 0 {
+		t.Error("expected users found earlier to be left unchanged")
+	}
+}
+
+// failingBackend fails every transaction after its writes have been made.
+type failingBackend struct {
+	noop.NoOp
+}
+
+func (b *failingBackend) Transaction(fn func(backend.Conn) error) error {
+	if err := fn(b); err != nil {
+		return err
+	}
+	return errors.New("commit failed")
+}
+
+func TestFailedTransaction(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkr.Backend = &failingBackend{}
+
+	passkey := "vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv1"
+	tkr.PutUser(&models.User{ID: 1, Passkey: passkey, UpMultiplier: 1, DownMultiplier: 1})
+	tkr.PutTorrent(&models.Torrent{
+		ID:             1,
+		Infohash:       infoHash,
+		UpMultiplier:   1,
+		DownMultiplier: 1,
+		Seeders:        models.NewPeerMap(true, tkr.Config),
+		Leechers:       models.NewPeerMap(false, tkr.Config),
+	})
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.URL = srv.URL + "/users/" + passkey
+
+	peer := makePeerParams("-TR2820-peer1", false)
+	peer["uploaded"] = "1000"
+	peer["downloaded"] = "500"
+	if _, err := announce(peer, srv); err != nil {
+		t.Fatal(err)
+	}
+
+	// The storage is left as it was, in agreement with the backend.
+	torrent, err := tkr.TorrentSnapshot(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.TotalUploaded != 0 || torrent.TotalDownloaded != 0 {
+		t.Errorf("expected no transfer to be recorded, got %d up and %d down", torrent.TotalUploaded, torrent.TotalDownloaded)
+	}
+	user, err := tkr.FindUser(passkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Uploaded != 0 || user.Downloaded != 0 {
+		t.Errorf("expected user totals to be unchanged, got %d up and %d down", user.Uploaded, user.Downloaded)
+	}
+}
+
+func TestMaxPeersPerUser(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	cfg.MaxPeersPerUser = 1
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadPrivateTestData(tkr)
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.URL = srv.URL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv1"
+
+	peer1 := makePeerParams("-TR2820-peer1", false)
+	peer2 := makePeerParams("-TR2820-peer2", false)
+
+	expected := makeResponse(0, 1)
+	checkAnnounce(peer1, expected, srv, t)
+
+	// Reannouncing with an existing peer is still allowed.
+	checkAnnounce(peer1, expected, srv, t)
+
+	failure := bencode.Dict{"failure reason": models.ErrTooManyPeers.Error()}
+	checkAnnounce(peer2, failure, srv, t)
+}
+
+func TestMaxPeersPerIP(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MaxPeersPerIP = 2
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true, "10.0.0.1")
+	peer2 := makePeerParams("peer2", true, "10.0.0.1")
+	peer3 := makePeerParams("peer3", true, "10.0.0.1")
+	peer4 := makePeerParams("peer4", false, "10.0.0.2")
+
+	checkAnnounce(peer1, makeResponse(1, 0), srv, t)
+	checkAnnounce(peer2, makeResponse(2, 0), srv, t)
+
+	failure := bencode.Dict{"failure reason": models.ErrTooManyPeersFromIP.Error()}
+	checkAnnounce(peer3, failure, srv, t)
+
+	// Existing peers may reannounce, and other addresses are unaffected.
+	checkAnnounce(peer1, makeResponse(2, 0), srv, t)
+	checkAnnounce(peer4, makeResponse(2, 1, peer1, peer2), srv, t)
+}
+
+func TestMaxActiveLeechPerUser(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	cfg.MaxActiveLeechPerUser = 1
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadPrivateTestData(tkr)
+	otherInfohash := strings.Repeat("\x01", 20)
+	tkr.PutTorrent(&models.Torrent{
+		ID:       2,
+		Infohash: otherInfohash,
+		Seeders:  models.NewPeerMap(true, tkr.Config),
+		Leechers: models.NewPeerMap(false, tkr.Config),
+	})
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.URL = srv.URL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv1"
+
+	leecher := makePeerParams("-TR2820-peer1", false)
+	other := makePeerParams("-TR2820-peer1", false)
+	other["info_hash"] = otherInfohash
+
+	checkAnnounce(leecher, makeResponse(0, 1), srv, t)
+
+	failure := bencode.Dict{"failure reason": models.ErrTooManyLeeches.Error()}
+	checkAnnounce(other, failure, srv, t)
+
+	// Seeding is unlimited.
+	seeder := makePeerParams("-TR2820-peer1", true)
+	seeder["info_hash"] = otherInfohash
+	checkAnnounce(seeder, makeResponse(1, 0), srv, t)
+
+	// Another client stopping the first torrent does not free up the user's
+	// leech, since the first client is still leeching it.
+	second := makePeerParams("-TR2820-peer3", false)
+	second["event"] = "stopped"
+	announce(second, srv)
+	checkAnnounce(other, failure, srv, t)
+
+	// Once the first torrent is complete, another can be leeched.
+	leecher["event"] = "completed"
+	leecher["left"] = "0"
+	checkAnnounce(leecher, makeResponse(1, 0), srv, t)
+
+	other["peer_id"] = "-TR2820-peer2"
+	checkAnnounce(other, makeResponse(1, 1), srv, t)
+}
+
+func TestClientWhitelist(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.ClientWhitelistEnabled = true
+	cfg.ClientWhitelist = []string{"TR2820"}
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("-TR2820-peer1", false)
+	expected := makeResponse(0, 1)
+	checkAnnounce(peer1, expected, srv, t)
+
+	peer2 := makePeerParams("-XX1150-peer2", false)
+	failure := bencode.Dict{"failure reason": models.ErrClientUnapproved.Error()}
+	checkAnnounce(peer2, failure, srv, t)
+}
+
+func TestClientBlacklist(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.ClientBlacklist = []string{"-BT0*"}
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("-BT7000-peer1", false)
+	expected := makeResponse(0, 1)
+	checkAnnounce(peer1, expected, srv, t)
+
+	peer2 := makePeerParams("-BT0300-peer2", false)
+	failure := bencode.Dict{"failure reason": models.ErrClientBlacklisted.Error()}
+	checkAnnounce(peer2, failure, srv, t)
+
+	// The rejected peer must not have been added to the swarm.
+	expected = makeResponse(0, 1)
+	checkAnnounce(peer1, expected, srv, t)
+}
+
+type rejectionRecorder []string
+
+func (r *rejectionRecorder) LogRejection(ann *models.Announce, reason string) {
+	*r = append(*r, reason)
+}
+
+func TestAuditLog(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.ClientBlacklist = []string{"-BT0*"}
+	cfg.AuditLogBurst = 2
+	cfg.AuditLogInterval = config.Duration{Duration: time.Hour}
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejections := &rejectionRecorder{}
+	tkr.AuditLogger = rejections
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	announce(makePeerParams("-BT7000-peer1", false), srv)
+	if len(*rejections) != 0 {
+		t.Fatalf("expected accepted announces not to be audited, got %v", *rejections)
+	}
+
+	for i := 0; i < 3; i++ {
+		announce(makePeerParams("-BT0300-peer2", false), srv)
+	}
+	if len(*rejections) != 2 || (*rejections)[0] != models.ErrClientBlacklisted.Error() {
+		t.Errorf("expected 2 rate-limited rejections to be audited, got %v", *rejections)
+	}
+}
+
+func TestBlockedInfohash(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.BlockedInfohashes = []string{hex.EncodeToString([]byte(infoHash))}
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	failure := bencode.Dict{"failure reason": models.ErrBlockedInfohash.Error()}
+
+	peer := makePeerParams("peer1", false)
+	checkAnnounce(peer, failure, srv, t)
+	checkScrape(params{"info_hash": infoHash}, failure, srv, t)
+}
+
+func TestAnnounceRateLimit(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.AnnounceRateBurst = 2
+	cfg.AnnounceRateInterval = config.Duration{Duration: time.Hour}
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", false)
+	peer2 := makePeerParams("peer2", false)
+
+	expected := makeResponse(0, 1)
+	checkAnnounce(peer1, expected, srv, t)
+	checkAnnounce(peer1, expected, srv, t)
+
+	failure := bencode.Dict{"failure reason": models.ErrAnnounceTooFrequent.Error()}
+	checkAnnounce(peer1, failure, srv, t)
+
+	// Other peers have their own buckets.
+	expected = makeResponse(0, 2, peer1)
+	checkAnnounce(peer2, expected, srv, t)
+
+	// So does each torrent a peer announces, since clients use the same peer
+	// ID for all of them.
+	for i := 0; i < 5; i++ {
+		peer1["info_hash"] = strings.Repeat(strconv.Itoa(i), 20)
+		checkAnnounce(peer1, makeResponse(0, 1), srv, t)
+	}
+}
+
+func TestEnforceMinInterval(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.EnforceMinInterval = true
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", false)
+	expected := makeResponse(0, 1)
+	checkAnnounce(peer1, expected, srv, t)
+
+	failure := bencode.Dict{"failure reason": models.ErrAnnounceTooFrequent.Error()}
+	checkAnnounce(peer1, failure, srv, t)
+
+	peer2 := makePeerParams("peer2", true)
+	expected = makeResponse(1, 1, peer1)
+	checkAnnounce(peer2, expected, srv, t)
+
+	peer1["event"] = "stopped"
+	expected = makeResponse(1, 0, nil)
+	checkAnnounce(peer1, expected, srv, t)
+}
+
+func TestTrackerID(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.TrackerID = "tracker1"
+	cfg.EnforceTrackerID = true
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", false)
+	expected := makeResponse(0, 1)
+	expected["tracker id"] = "tracker1"
+	checkAnnounce(peer1, expected, srv, t)
+
+	peer1["trackerid"] = "tracker1"
+	checkAnnounce(peer1, expected, srv, t)
+
+	peer1["trackerid"] = "tracker2"
+	failure := bencode.Dict{"failure reason": models.ErrInvalidTrackerID.Error()}
+	checkAnnounce(peer1, failure, srv, t)
+}
+
+func TestAnnounceMiddleware(t *testing.T) {
+	cfg := config.DefaultConfig
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []string
+	logging := func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(ann *models.Announce, w tracker.Writer) error {
+			calls = append(calls, ann.PeerID)
+			return next(ann, w)
+		}
+	}
+	rejecting := func(next tracker.AnnounceHandler) tracker.AnnounceHandler {
+		return func(ann *models.Announce, w tracker.Writer) error {
+			if ann.PeerID == "rejected" {
+				return models.ErrBadRequest
+			}
+			return next(ann, w)
+		}
+	}
+	tkr.AnnounceMiddleware = []tracker.AnnounceMiddleware{logging, rejecting}
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true)
+	expected := makeResponse(1, 0)
+	checkAnnounce(peer1, expected, srv, t)
+
+	peer2 := makePeerParams("rejected", false)
+	failure := bencode.Dict{"failure reason": models.ErrBadRequest.Error()}
+	checkAnnounce(peer2, failure, srv, t)
+
+	if !reflect.DeepEqual(calls, []string{"peer1", "rejected"}) {
+		t.Errorf("expected both announces to be logged, got %v", calls)
+	}
+}
+
+func TestAnnounceDedup(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.DedupWindow = config.Duration{Duration: time.Minute}
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", false)
+	peer2 := makePeerParams("peer2", false)
+
+	checkAnnounce(peer1, makeResponse(0, 1), srv, t)
+	checkAnnounce(peer2, makeResponse(0, 2, peer1), srv, t)
+
+	// A retry is given the response to the original announce.
+	checkAnnounce(peer1, makeResponse(0, 1), srv, t)
+
+	peer1["left"] = "0"
+	checkAnnounce(peer1, makeResponse(1, 1, peer2), srv, t)
+
+	// Stopping is never deduplicated, so stopping twice fails since the peer
+	// has already left.
+	peer1["event"] = "stopped"
+	checkAnnounce(peer1, makeResponse(0, 1, nil), srv, t)
+	failure := bencode.Dict{"failure reason": models.ErrBadRequest.Error()}
+	checkAnnounce(peer1, failure, srv, t)
+
+	// Announcing again within the window rejoins the swarm rather than being
+	// given the response cached before the peer stopped.
+	delete(peer1, "event")
+	checkAnnounce(peer1, makeResponse(1, 1, peer2), srv, t)
+	peer3 := makePeerParams("peer3", false)
+	checkAnnounce(peer3, makeResponse(1, 2, peer1, peer2), srv, t)
+}
+
+func TestAnnounceWarning(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.AnnounceWarning = "maintenance at midnight"
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	expected := makeResponse(0, 1)
+	expected["warning message"] = cfg.AnnounceWarning
+	checkAnnounce(makePeerParams("peer1", false), expected, srv, t)
+}
+
+func TestSignedAnnounce(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.ResponseSigningKey = "secret"
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	body, err := announce(makePeerParams("peer1", false), srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := "d9:signature32:"
+	if !strings.HasPrefix(string(body), prefix) || len(body) < len(prefix)+32 {
+		t.Fatalf("expected the response to start with a signature, got %q", body)
+	}
+	sig := body[len(prefix) : len(prefix)+32]
+	unsigned := append([]byte("d"), body[len(prefix)+32:]...)
+
+	mac := hmac.New(sha256.New, []byte(cfg.ResponseSigningKey))
+	mac.Write(unsigned)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		t.Error("expected the signature to match the rest of the response")
+	}
+
+	got, err := bencode.Unmarshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dict := got.(bencode.Dict); dict["interval"] != int64(1800) {
+		t.Errorf("expected the signed response to decode, got %v", dict)
+	}
+}
+
+func TestOmittedFields(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.OmitMinInterval = true
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	expected := makeResponse(0, 1)
+	delete(expected, "min interval")
+	checkAnnounce(makePeerParams("peer1", false), expected, srv, t)
+
+	cfg.OmitScrapeCounts = true
+	expected = makeResponse(0, 0, makePeerParams("peer1", false))
+	delete(expected, "min interval")
+	delete(expected, "complete")
+	delete(expected, "incomplete")
+	checkAnnounce(makePeerParams("peer2", false), expected, srv, t)
+}
+
+func TestFixedPeers(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.FixedPeers = []string{"10.0.0.9:6881"}
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	fixed := params{"peer_id": "", "ip": "10.0.0.9", "port": "6881"}
+
+	peer1 := makePeerParams("peer1", true)
+	expected := makeResponse(1, 0, fixed)
+	checkAnnounce(peer1, expected, srv, t)
+
+	// Fixed peers take precedence over the swarm, and count toward numwant.
+	peer2 := makePeerParams("peer2", false)
+	peer2["numwant"] = "1"
+	expected = makeResponse(1, 1, fixed)
+	checkAnnounce(peer2, expected, srv, t)
+
+	peer2["numwant"] = "2"
+	expected = makeResponse(1, 1, fixed, peer1)
+	checkAnnounce(peer2, expected, srv, t)
+}
+
+func TestTorrentACLs(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+	cfg.EnforceTorrentACLs = true
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadPrivateTestData(tkr)
+
+	user, _ := tkr.FindUser("vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv1")
+	user.GroupID = 7
+	tkr.PutUser(user)
+
+	torrent, _ := tkr.FindTorrent(infoHash)
+	torrent.AllowedUserGroups = []uint64{7}
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	baseURL := srv.URL
+
+	peer1 := makePeerParams("-TR2820-peer1", false)
+	peer2 := makePeerParams("-TR2820-peer2", false)
+
+	expected := makeResponse(0, 1)
+	srv.URL = baseURL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv1"
+	checkAnnounce(peer1, expected, srv, t)
+
+	failure := bencode.Dict{"failure reason": models.ErrUnauthorizedTorrent.Error()}
+	srv.URL = baseURL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv2"
+	checkAnnounce(peer2, failure, srv, t)
+}
+
+func TestSeedOnlyTorrent(t *testing.T) {
+	cfg := config.DefaultConfig
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tkr.PutTorrent(&models.Torrent{
+		Infohash: infoHash,
+		Seeders:  models.NewPeerMap(true, tkr.Config),
+		Leechers: models.NewPeerMap(false, tkr.Config),
+		SeedOnly: true,
+	})
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true)
+	peer2 := makePeerParams("peer2", false)
+
+	expected := makeResponse(1, 0)
+	checkAnnounce(peer1, expected, srv, t)
+
+	failure := bencode.Dict{"failure reason": models.ErrLeechingDisabled.Error()}
+	checkAnnounce(peer2, failure, srv, t)
+}
+
+func TestAnnounceKeyChangedIP(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true, "10.0.0.1")
+	peer1["key"] = "deadbeef"
+	peer2 := makePeerParams("peer2", false, "10.0.0.3")
+
+	expected := makeResponse(1, 0)
+	checkAnnounce(peer1, expected, srv, t)
+
+	peer1["ip"] = "10.0.0.2"
+	checkAnnounce(peer1, expected, srv, t)
+
+	expected = makeResponse(1, 1, peer1)
+	checkAnnounce(peer2, expected, srv, t)
+}
+
+func TestRequireCrypto(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	plain := makePeerParams("plain", true, "10.0.0.1")
+	crypto := makePeerParams("crypto", true, "10.0.0.2")
+	crypto["supportcrypto"] = "1"
+	leecher := makePeerParams("leecher", false, "10.0.0.3")
+	leecher["requirecrypto"] = "1"
+
+	checkAnnounce(plain, makeResponse(1, 0), srv, t)
+	checkAnnounce(crypto, makeResponse(2, 0), srv, t)
+
+	// Peers that do not support encryption are left out of the response.
+	expected := makeResponse(2, 1, crypto)
+	checkAnnounce(leecher, expected, srv, t)
+
+	// Requiring encryption implies supporting it.
+	leecher2 := makePeerParams("leecher2", false, "10.0.0.4")
+	leecher2["requirecrypto"] = "1"
+	expected = makeResponse(2, 2, crypto, leecher)
+	checkAnnounce(leecher2, expected, srv, t)
+}
+
+func TestParameterAliases(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.ParameterAliases = map[string]string{"infohash": "info_hash"}
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer := makePeerParams("peer1", true)
+	peer["infohash"] = peer["info_hash"]
+	delete(peer, "info_hash")
+
+	checkAnnounce(peer, makeResponse(1, 0), srv, t)
+}
+
+func TestMetadataSize(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.LearnMetadataSize = true
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// Peers fetching metadata are not told a size that is not yet known.
+	leecher := makePeerParams("leecher", false, "10.0.0.1")
+	leecher["metadata_size"] = "0"
+	checkAnnounce(leecher, makeResponse(0, 1), srv, t)
+
+	// A size reported by a single peer is not trusted, even if it announces
+	// again under another peer ID.
+	seeder := makePeerParams("seeder", true, "10.0.0.2")
+	seeder["metadata_size"] = "1000"
+	checkAnnounce(seeder, makeResponse(1, 1, leecher), srv, t)
+
+	renamed := makePeerParams("renamed", true, "10.0.0.2")
+	renamed["metadata_size"] = "1000"
+	checkAnnounce(renamed, makeResponse(2, 1, leecher), srv, t)
+
+	// A size is learned once enough peers agree on it.
+	seeder["metadata_size"] = "31337"
+	checkAnnounce(seeder, makeResponse(2, 1, leecher), srv, t)
+
+	other := makePeerParams("other", true, "10.0.0.3")
+	other["metadata_size"] = "31337"
+	expected := makeResponse(3, 1, leecher)
+	expected["metadata_size"] = int64(31337)
+	checkAnnounce(other, expected, srv, t)
+
+	// The learned size is kept.
+	seeder["metadata_size"] = "1000"
+	checkAnnounce(seeder, expected, srv, t)
+
+	expected = makeResponse(3, 1, seeder, renamed, other)
+	expected["metadata_size"] = int64(31337)
+	checkAnnounce(leecher, expected, srv, t)
+
+	leecher["metadata_size"] = "size"
+	failure := bencode.Dict{"failure reason": models.ErrMalformedRequest.Error()}
+	checkAnnounce(leecher, failure, srv, t)
+}
+
+func TestRecentlyDepartedPeers(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.IncludeRecentlyDeparted = true
+	cfg.PurgeInactiveTorrents = false
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	seeder := makePeerParams("seeder", true, "10.0.0.1")
+	checkAnnounce(seeder, makeResponse(1, 0), srv, t)
+
+	seeder["event"] = "stopped"
+	checkAnnounce(seeder, makeResponse(0, 0, nil), srv, t)
+	delete(seeder, "event")
+
+	// The departed seeder pads the otherwise empty peer list.
+	leecher := makePeerParams("leecher", false, "10.0.0.2")
+	checkAnnounce(leecher, makeResponse(0, 1, seeder), srv, t)
+
+	// Once it rejoins, it is only returned once.
+	checkAnnounce(seeder, makeResponse(1, 1, leecher), srv, t)
+	checkAnnounce(leecher, makeResponse(1, 1, seeder), srv, t)
+}
+
+func TestPreferredSubnet(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PreferredSubnet = true
+	cfg.PreferredIPv4Subnet = 8
+	cfg.PreferredIPv6Subnet = 16
+	cfg.DualStackedPeers = false
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peerA1 := makePeerParams("peerA1", false, "44.0.0.1")
+	peerA2 := makePeerParams("peerA2", false, "44.0.0.2")
+	peerA3 := makePeerParams("peerA3", false, "44.0.0.3")
+	peerA4 := makePeerParams("peerA4", false, "44.0.0.4")
+	peerB1 := makePeerParams("peerB1", false, "45.0.0.1")
+	peerB2 := makePeerParams("peerB2", false, "45.0.0.2")
+	peerC1 := makePeerParams("peerC1", false, "fc01::1")
+	peerC2 := makePeerParams("peerC2", false, "fc01::2")
+	peerC3 := makePeerParams("peerC3", false, "fc01::3")
+	peerD1 := makePeerParams("peerD1", false, "fc02::1")
+	peerD2 := makePeerParams("peerD2", false, "fc02::2")
+
+	expected := makeResponse(0, 1)
+	checkAnnounce(peerA1, expected, srv, t)
+
+	expected = makeResponse(0, 2, peerA1)
+	checkAnnounce(peerA2, expected, srv, t)
+
+	expected = makeResponse(0, 3, peerA1, peerA2)
+	checkAnnounce(peerB1, expected, srv, t)
+
+	peerB2["numwant"] = "1"
+	expected = makeResponse(0, 4, peerB1)
+	checkAnnounce(peerB2, expected, srv, t)
+	checkAnnounce(peerB2, expected, srv, t)
+
+	peerA3["numwant"] = "2"
+	expected = makeResponse(0, 5, peerA1, peerA2)
+	checkAnnounce(peerA3, expected, srv, t)
+	checkAnnounce(peerA3, expected, srv, t)
+
+	peerA4["numwant"] = "3"
+	expected = makeResponse(0, 6, peerA1, peerA2, peerA3)
+	checkAnnounce(peerA4, expected, srv, t)
+	checkAnnounce(peerA4, expected, srv, t)
+
+	expected = makeResponse(0, 7, peerA1, peerA2, peerA3, peerA4, peerB1, peerB2)
+	checkAnnounce(peerC1, expected, srv, t)
+
+	peerC2["numwant"] = "1"
+	expected = makeResponse(0, 8, peerC1)
+	checkAnnounce(peerC2, expected, srv, t)
+	checkAnnounce(peerC2, expected, srv, t)
+
+	peerC3["numwant"] = "2"
+	expected = makeResponse(0, 9, peerC1, peerC2)
+	checkAnnounce(peerC3, expected, srv, t)
+	checkAnnounce(peerC3, expected, srv, t)
+
+	expected = makeResponse(0, 10, peerA1, peerA2, peerA3, peerA4, peerB1, peerB2, peerC1, peerC2, peerC3)
+	checkAnnounce(peerD1, expected, srv, t)
+
+	peerD2["numwant"] = "1"
+	expected = makeResponse(0, 11, peerD1)
+	checkAnnounce(peerD2, expected, srv, t)
+	checkAnnounce(peerD2, expected, srv, t)
+}
+
+func TestBinaryPeerIDAnnounce(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("\xff\xfe//\x00\x89peer1", true)
+	peer2 := makePeerParams("peer2", false)
+
+	expected := makeResponse(1, 0)
+	checkAnnounce(peer1, expected, srv, t)
+
+	expected = makeResponse(1, 1, peer1)
+	checkAnnounce(peer2, expected, srv, t)
+}
+
+func TestNoPeerIDAnnounce(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true)
+	peer2 := makePeerParams("peer2", false)
+	peer2["no_peer_id"] = "1"
+
+	expected := makeResponse(1, 0)
+	checkAnnounce(peer1, expected, srv, t)
+
+	expected = makeResponse(1, 1)
+	expected["peers"] = bencode.List{
+		bencode.Dict{"ip": peer1["ip"], "port": int64(1234)},
+	}
+	checkAnnounce(peer2, expected, srv, t)
+
+	// Compact responses take precedence.
+	peer2["compact"] = "1"
+	expected = makeResponse(1, 1)
+	expected["peers"] = "\x0a\x00\x00\x01\x04\xd2"
+	checkAnnounce(peer2, expected, srv, t)
+}
+
+func TestCompactAnnounce(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	compact := "\xff\x09\x7f\x05\x04\xd2"
+	ip := "255.9.127.5" // Use the same IP for all of them so we don't have to worry about order.
+
+	peer1 := makePeerParams("peer1", false, ip)
+	peer1["compact"] = "1"
+
+	peer2 := makePeerParams("peer2", false, ip)
+	peer2["compact"] = "1"
+
+	peer3 := makePeerParams("peer3", false, ip)
+	peer3["compact"] = "1"
+
+	expected := makeResponse(0, 1)
+	expected["peers"] = ""
+	checkAnnounce(peer1, expected, srv, t)
+
+	expected = makeResponse(0, 2)
+	expected["peers"] = compact
+	checkAnnounce(peer2, expected, srv, t)
+
+	expected = makeResponse(0, 3)
+	expected["peers"] = compact + compact
+	checkAnnounce(peer3, expected, srv, t)
+}
+
+func TestCompactDualStackAnnounce(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true, "10.0.0.1")
+	peer1["ipv6"] = "fc00::1"
+	peer1["compact"] = "1"
+
+	peer2 := makePeerParams("peer2", false, "10.0.0.2")
+	peer2["ipv6"] = "fc00::2"
+	peer2["compact"] = "1"
+
+	expected := makeResponse(2, 0)
+	expected["peers"] = ""
+	checkAnnounce(peer1, expected, srv, t)
+
+	expected = makeResponse(2, 2)
+	expected["peers"] = "\x0a\x00\x00\x01\x04\xd2"
+	expected["peers6"] = "\xfc\x00" + strings.Repeat("\x00", 13) + "\x01\x04\xd2"
+	checkAnnounce(peer2, expected, srv, t)
+}
+
+func TestCompactOnly(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.CompactOnly = true
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true, "10.0.0.1")
+	expected := makeResponse(1, 0)
+	expected["peers"] = ""
+	checkAnnounce(peer1, expected, srv, t)
+
+	peer2 := makePeerParams("peer2", false, "10.0.0.2")
+	expected = makeResponse(1, 1)
+	expected["peers"] = "\x0a\x00\x00\x01\x04\xd2"
+	checkAnnounce(peer2, expected, srv, t)
+
+	cfg.RejectNonCompact = true
+	failure := bencode.Dict{"failure reason": models.ErrCompactRequired.Error()}
+	checkAnnounce(peer2, failure, srv, t)
+
+	peer2["compact"] = "1"
+	checkAnnounce(peer2, expected, srv, t)
+}
+
+func TestDedupeDualStackAnnounce(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.DedupeDualStack = true
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true, "10.0.0.1")
+	peer1["ipv6"] = "fc00::1"
+	peer1["compact"] = "1"
+
+	peer2 := makePeerParams("peer2", false, "10.0.0.2")
+	peer2["ipv6"] = "fc00::2"
+	peer2["compact"] = "1"
+
+	peer3 := makePeerParams("peer3", false, "10.0.0.3")
+	peer3["compact"] = "1"
+
+	expected := makeResponse(2, 0)
+	expected["peers"] = ""
+	checkAnnounce(peer1, expected, srv, t)
+
+	// Announcers using IPv6 are only given the IPv6 address.
+	expected = makeResponse(2, 2)
+	expected["peers"] = ""
+	expected["peers6"] = "\xfc\x00" + strings.Repeat("\x00", 13) + "\x01\x04\xd2"
+	checkAnnounce(peer2, expected, srv, t)
+
+	// Everyone else is only given the IPv4 address.
+	expected = makeResponse(2, 3)
+	expected["peers"] = "\x0a\x00\x00\x01\x04\xd2\x0a\x00\x00\x02\x04\xd2"
+	checkAnnounce(peer3, expected, srv, t)
+
+	// Duplicates are removed before the list is cut down to numwant.
+	peer4 := makePeerParams("peer4", false, "10.0.0.4")
+	peer4["ipv6"] = "fc00::4"
+	peer4["compact"] = "1"
+	peer4["numwant"] = "2"
+	for i := 0; i < 10; i++ {
+		body, err := announce(peer4, srv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := bencode.Unmarshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dict := got.(bencode.Dict)
+		peers, _ := dict["peers"].(string)
+		peers6, _ := dict["peers6"].(string)
+		if n := len(peers)/6 + len(peers6)/18; n != 2 {
+			t.Fatalf("expected 2 peers, got %d", n)
+		}
+	}
+}
+
+func TestAnnounceJitter(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.AnnounceJitter = config.Duration{Duration: 10 * time.Minute}
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for i := 0; i < 10; i++ {
+		peer := makePeerParams("peer"+strconv.Itoa(i), false)
+		body, err := announce(peer, srv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := bencode.Unmarshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dict := got.(bencode.Dict)
+
+		interval := dict["interval"].(int64)
+		if interval < 1800 || interval >= 2400 {
+			t.Errorf("interval %d outside of jitter range [1800, 2400)", interval)
+		}
+		if minInterval := dict["min interval"].(int64); minInterval != 900 {
+			t.Errorf("expected min interval to be unjittered (got %d)", minInterval)
+		}
+	}
+}
+
+func TestAnnounceAddressFamilyModes(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.DualStackedPeers = false
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peerA := makePeerParams("peerA", false, "44.0.0.1")
+	peerB := makePeerParams("peerB", false, "fc01::1")
+	peerC := makePeerParams("peerC", false, "fc01::2")
+	peerD := makePeerParams("peerD", false, "fc01::3")
+
+	expected := makeResponse(0, 1)
+	checkAnnounce(peerA, expected, srv, t)
+
+	expected = makeResponse(0, 2, peerA)
+	checkAnnounce(peerB, expected, srv, t)
+
+	peerC["no_ipv6"] = "1"
+	expected = makeResponse(0, 3, peerA)
+	checkAnnounce(peerC, expected, srv, t)
+
+	peerD["ipv6_only"] = "1"
+	expected = makeResponse(0, 4, peerB, peerC)
+	checkAnnounce(peerD, expected, srv, t)
+}
+
+func TestMaxPeersPerTorrent(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MaxPeersPerTorrent = 2
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true)
+	peer2 := makePeerParams("peer2", false)
+	peer3 := makePeerParams("peer3", false)
 
-	// Add one seeder.
-	peer := makePeerParams("peer1", true)
-	announce(peer, srv)
+	expected := makeResponse(1, 0)
+	checkAnnounce(peer1, expected, srv, t)
 
-	_, status, err := fetchPath(torrentAPIPath)
+	expected = makeResponse(1, 1, peer1)
+	checkAnnounce(peer2, expected, srv, t)
+
+	// The swarm is full, so the oldest peer is evicted.
+	expected = makeResponse(0, 2, peer2)
+	checkAnnounce(peer3, expected, srv, t)
+}
+
+func TestExternalIP(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.DualStackedPeers = false
+
+	srv, err := setupTracker(&cfg)
 	if err != nil {
 		t.Fatal(err)
-	} else if status != http.StatusOK {
-		t.Fatalf("expected torrent to exist (got %s)", http.StatusText(status))
 	}
+	defer srv.Close()
 
-	// Remove seeder.
-	peer = makePeerParams("peer1", true)
-	peer["event"] = "stopped"
-	announce(peer, srv)
+	peer1 := makePeerParams("peer1", true, "44.0.0.1")
+	expected := makeResponse(1, 0)
+	expected["external ip"] = "\x2c\x00\x00\x01"
+	checkAnnounce(peer1, expected, srv, t)
 
-	_, status, err = fetchPath(torrentAPIPath)
+	peer2 := makePeerParams("peer2", true, "fc01::1")
+	expected = makeResponse(2, 0)
+	expected["external ip"] = "\xfc\x01" + strings.Repeat("\x00", 13) + "\x01"
+	checkAnnounce(peer2, expected, srv, t)
+}
+
+func TestInvalidIP(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.DualStackedPeers = false
+	cfg.AllowPrivateIPs = false
+
+	srv, err := setupTracker(&cfg)
 	if err != nil {
 		t.Fatal(err)
-	} else if status != http.StatusNotFound {
-		t.Fatalf("expected torrent to have been purged (got %s)", http.StatusText(status))
 	}
+	defer srv.Close()
+
+	failure := bencode.Dict{"failure reason": models.ErrInvalidIP.Error()}
+
+	for _, ip := range []string{"fe80::1", "0.0.0.0", "127.0.0.1", "10.0.0.1", "fc01::1"} {
+		peer := makePeerParams("peer1", true, ip)
+		checkAnnounce(peer, failure, srv, t)
+	}
+
+	peer := makePeerParams("peer1", true, "44.0.0.1")
+	expected := makeResponse(1, 0)
+	checkAnnounce(peer, expected, srv, t)
 }
 
-func TestStalePeerPurging(t *testing.T) {
+func TestLoopbackIPWithPrivateIPs(t *testing.T) {
 	cfg := config.DefaultConfig
-	cfg.Announce = config.Duration{
-		Duration: 10 * time.Millisecond,
-	}
+	cfg.DualStackedPeers = false
+	cfg.AllowPrivateIPs = true
 
 	srv, err := setupTracker(&cfg)
 	if err != nil {
@@ -94,177 +1717,240 @@ func TestStalePeerPurging(t *testing.T) {
 	}
 	defer srv.Close()
 
-	torrentAPIPath := srv.URL + "/torrents/" + url.QueryEscape(infoHash)
+	// Loopback addresses are unreachable even when private ones are allowed.
+	failure := bencode.Dict{"failure reason": models.ErrInvalidIP.Error()}
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		peer := makePeerParams("peer1", true, ip)
+		checkAnnounce(peer, failure, srv, t)
+	}
 
-	// Add one seeder.
-	peer1 := makePeerParams("peer1", true)
-	announce(peer1, srv)
+	peer := makePeerParams("peer1", true, "10.0.0.1")
+	checkAnnounce(peer, makeResponse(1, 0), srv, t)
+}
 
-	_, status, err := fetchPath(torrentAPIPath)
+func TestMalformedQueryAnnounce(t *testing.T) {
+	cfg := config.DefaultConfig
+	srv, err := setupTracker(&cfg)
 	if err != nil {
 		t.Fatal(err)
-	} else if status != http.StatusOK {
-		t.Fatalf("expected torrent to exist (got %s)", http.StatusText(status))
 	}
+	defer srv.Close()
 
-	// Add a leecher.
-	peer2 := makePeerParams("peer2", false)
-	expected := makeResponse(1, 1, peer1)
-	expected["interval"] = int64(0)
-	checkAnnounce(peer2, expected, srv, t)
+	for _, path := range []string{"/announce?info_hash=%zz", "/scrape?info_hash=%zz"} {
+		body, status, err := fetchPath(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != http.StatusOK {
+			t.Errorf("expected %s to fail with 200 OK, got %d", path, status)
+		}
 
-	// Let them both expire.
-	time.Sleep(30 * time.Millisecond)
+		expected := bencode.Dict{"failure reason": models.ErrMalformedRequest.Error()}
+		if got, err := bencode.Unmarshal(body); err != nil || !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v for %s, got %q", expected, path, body)
+		}
+	}
+}
 
-	_, status, err = fetchPath(torrentAPIPath)
+func TestMalformedInfohash(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
 	if err != nil {
 		t.Fatal(err)
-	} else if status != http.StatusNotFound {
-		t.Fatalf("expected torrent to have been purged (got %s)", http.StatusText(status))
 	}
+	defer srv.Close()
+
+	peer1 := makePeerParams("peer1", true)
+	peer1["info_hash"] = "short"
+	failure := bencode.Dict{"failure reason": models.ErrBadRequest.Error()}
+	checkAnnounce(peer1, failure, srv, t)
+
+	// Hex-encoded infohashes announce on the same torrent.
+	peer1 = makePeerParams("peer1", true)
+	checkAnnounce(peer1, makeResponse(1, 0), srv, t)
+
+	peer2 := makePeerParams("peer2", false)
+	peer2["info_hash"] = hex.EncodeToString([]byte(infoHash))
+	checkAnnounce(peer2, makeResponse(1, 1, peer1), srv, t)
 }
 
-func TestPrivateAnnounce(t *testing.T) {
+func TestGzipAnnounce(t *testing.T) {
 	cfg := config.DefaultConfig
-	cfg.PrivateEnabled = true
+	cfg.GzipMinSize = 200
 
-	tkr, err := tracker.New(&cfg)
+	srv, err := setupTracker(&cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer srv.Close()
 
-	loadPrivateTestData(tkr)
-
-	srv, err := createServer(tkr, &cfg)
-	if err != nil {
-		t.Fatal(err)
-	}
+	// The default transport transparently decompresses responses, so the
+	// header is sent explicitly.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	fetchGzipped := func(p params) (*http.Response, []byte) {
+		values := &url.Values{}
+		for k, v := range p {
+			values.Add(k, v)
+		}
 
-	defer srv.Close()
-	baseURL := srv.URL
+		req, _ := http.NewRequest("GET", srv.URL+"/announce?"+values.Encode(), nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
 
-	peer1 := makePeerParams("-TR2820-peer1", false)
-	peer2 := makePeerParams("-TR2820-peer2", false)
-	peer3 := makePeerParams("-TR2820-peer3", true)
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, body
+	}
 
-	expected := makeResponse(0, 1)
-	srv.URL = baseURL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv1"
-	checkAnnounce(peer1, expected, srv, t)
+	// Small responses are not compressed.
+	peer1 := makePeerParams("peer1", true)
+	res, _ := fetchGzipped(peer1)
+	if encoding := res.Header.Get("Content-Encoding"); encoding != "" {
+		t.Errorf("expected a small response to be uncompressed, got %q", encoding)
+	}
 
-	expected = makeResponse(0, 2, peer1)
-	srv.URL = baseURL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv2"
-	checkAnnounce(peer2, expected, srv, t)
+	for i := 2; i <= 5; i++ {
+		announce(makePeerParams("peer"+strconv.Itoa(i), true), srv)
+	}
 
-	expected = makeResponse(1, 2, peer1, peer2)
-	srv.URL = baseURL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv3"
-	checkAnnounce(peer3, expected, srv, t)
+	peer6 := makePeerParams("peer6", false)
+	res, body := fetchGzipped(peer6)
+	if encoding := res.Header.Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("expected a large response to be gzipped, got %q", encoding)
+	}
 
-	expected = makeResponse(1, 2, peer2, peer3)
-	srv.URL = baseURL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv1"
-	checkAnnounce(peer1, expected, srv, t)
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := bencode.Unmarshal(decoded); err != nil {
+		t.Error(err)
+	} else if got.(bencode.Dict)["complete"] != int64(5) {
+		t.Errorf("expected 5 seeders in the decompressed response, got %v", got)
+	}
 }
 
-func TestPreferredSubnet(t *testing.T) {
+func TestAnnounceAfterClose(t *testing.T) {
 	cfg := config.DefaultConfig
-	cfg.PreferredSubnet = true
-	cfg.PreferredIPv4Subnet = 8
-	cfg.PreferredIPv6Subnet = 16
-	cfg.DualStackedPeers = false
 
-	srv, err := setupTracker(&cfg)
+	tkr, err := tracker.New(&cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer srv.Close()
 
-	peerA1 := makePeerParams("peerA1", false, "44.0.0.1")
-	peerA2 := makePeerParams("peerA2", false, "44.0.0.2")
-	peerA3 := makePeerParams("peerA3", false, "44.0.0.3")
-	peerA4 := makePeerParams("peerA4", false, "44.0.0.4")
-	peerB1 := makePeerParams("peerB1", false, "45.0.0.1")
-	peerB2 := makePeerParams("peerB2", false, "45.0.0.2")
-	peerC1 := makePeerParams("peerC1", false, "fc01::1")
-	peerC2 := makePeerParams("peerC2", false, "fc01::2")
-	peerC3 := makePeerParams("peerC3", false, "fc01::3")
-	peerD1 := makePeerParams("peerD1", false, "fc02::1")
-	peerD2 := makePeerParams("peerD2", false, "fc02::2")
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
 
-	expected := makeResponse(0, 1)
-	checkAnnounce(peerA1, expected, srv, t)
+	if err = tkr.Close(); err != nil {
+		t.Fatal(err)
+	}
 
-	expected = makeResponse(0, 2, peerA1)
-	checkAnnounce(peerA2, expected, srv, t)
+	values := &url.Values{}
+	for k, v := range makePeerParams("peer1", true) {
+		values.Add(k, v)
+	}
 
-	expected = makeResponse(0, 3, peerA1, peerA2)
-	checkAnnounce(peerB1, expected, srv, t)
+	_, status, err := fetchPath(srv.URL + "/announce?" + values.Encode())
+	if err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusInternalServerError {
+		t.Fatalf("expected announce to a closed tracker to fail (got %s)", http.StatusText(status))
+	}
+}
 
-	peerB2["numwant"] = "1"
-	expected = makeResponse(0, 4, peerB1)
-	checkAnnounce(peerB2, expected, srv, t)
-	checkAnnounce(peerB2, expected, srv, t)
+type noPeersSelector struct{}
 
-	peerA3["numwant"] = "2"
-	expected = makeResponse(0, 5, peerA1, peerA2)
-	checkAnnounce(peerA3, expected, srv, t)
-	checkAnnounce(peerA3, expected, srv, t)
+func (noPeersSelector) SelectPeers(ann *models.Announce, announcer *models.Peer, t *models.Torrent, wanted int) (ipv4s, ipv6s models.PeerList) {
+	return models.PeerList{}, models.PeerList{}
+}
 
-	peerA4["numwant"] = "3"
-	expected = makeResponse(0, 6, peerA1, peerA2, peerA3)
-	checkAnnounce(peerA4, expected, srv, t)
-	checkAnnounce(peerA4, expected, srv, t)
+func TestCustomPeerSelector(t *testing.T) {
+	cfg := config.DefaultConfig
 
-	expected = makeResponse(0, 7, peerA1, peerA2, peerA3, peerA4, peerB1, peerB2)
-	checkAnnounce(peerC1, expected, srv, t)
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkr.PeerSelector = noPeersSelector{}
 
-	peerC2["numwant"] = "1"
-	expected = makeResponse(0, 8, peerC1)
-	checkAnnounce(peerC2, expected, srv, t)
-	checkAnnounce(peerC2, expected, srv, t)
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
 
-	peerC3["numwant"] = "2"
-	expected = makeResponse(0, 9, peerC1, peerC2)
-	checkAnnounce(peerC3, expected, srv, t)
-	checkAnnounce(peerC3, expected, srv, t)
+	peer1 := makePeerParams("peer1", true)
+	peer2 := makePeerParams("peer2", false)
 
-	expected = makeResponse(0, 10, peerA1, peerA2, peerA3, peerA4, peerB1, peerB2, peerC1, peerC2, peerC3)
-	checkAnnounce(peerD1, expected, srv, t)
+	expected := makeResponse(1, 0)
+	checkAnnounce(peer1, expected, srv, t)
 
-	peerD2["numwant"] = "1"
-	expected = makeResponse(0, 11, peerD1)
-	checkAnnounce(peerD2, expected, srv, t)
-	checkAnnounce(peerD2, expected, srv, t)
+	expected = makeResponse(1, 1)
+	checkAnnounce(peer2, expected, srv, t)
 }
 
-func TestCompactAnnounce(t *testing.T) {
+func TestAnnounceNumWant(t *testing.T) {
 	srv, err := setupTracker(&config.DefaultConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer srv.Close()
 
-	compact := "\xff\x09\x7f\x05\x04\xd2"
-	ip := "255.9.127.5" // Use the same IP for all of them so we don't have to worry about order.
+	peer1 := makePeerParams("peer1", true)
+	peer2 := makePeerParams("peer2", false)
 
-	peer1 := makePeerParams("peer1", false, ip)
-	peer1["compact"] = "1"
+	expected := makeResponse(1, 0)
+	checkAnnounce(peer1, expected, srv, t)
 
-	peer2 := makePeerParams("peer2", false, ip)
-	peer2["compact"] = "1"
+	peer2["numwant"] = "0"
+	expected = makeResponse(1, 1, nil)
+	checkAnnounce(peer2, expected, srv, t)
 
-	peer3 := makePeerParams("peer3", false, ip)
-	peer3["compact"] = "1"
+	delete(peer2, "numwant")
+	expected = makeResponse(1, 1, peer1)
+	checkAnnounce(peer2, expected, srv, t)
+}
 
-	expected := makeResponse(0, 1)
-	expected["peers"] = ""
-	checkAnnounce(peer1, expected, srv, t)
+func TestMaxNumWant(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MaxNumWant = 2
 
-	expected = makeResponse(0, 2)
-	expected["peers"] = compact
-	checkAnnounce(peer2, expected, srv, t)
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
 
-	expected = makeResponse(0, 3)
-	expected["peers"] = compact + compact
-	checkAnnounce(peer3, expected, srv, t)
+	for i := 1; i <= 3; i++ {
+		announce(makePeerParams("peer"+strconv.Itoa(i), true), srv)
+	}
+
+	peer4 := makePeerParams("peer4", false)
+	peer4["numwant"] = "100000"
+	body, err := announce(peer4, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := bencode.Unmarshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peers := got.(bencode.Dict)["peers"].(bencode.List); len(peers) != 2 {
+		t.Errorf("expected numwant to be capped at 2 peers, got %d", len(peers))
+	}
 }
 
 func makePeerParams(id string, seed bool, extra ...string) params {
@@ -333,6 +2019,16 @@ func checkAnnounce(p params, expected interface{}, srv *httptest.Server, t *test
 	got, err := bencode.Unmarshal(body)
 	if e, ok := got.(bencode.Dict); ok {
 		sortPeersInResponse(e)
+
+		// Only compare the external IP and tracker ID if the test cares
+		// about them.
+		if ex, ok := expected.(bencode.Dict); ok {
+			for _, key := range []string{"external ip", "tracker id"} {
+				if _, ok := ex[key]; !ok {
+					delete(e, key)
+				}
+			}
+		}
 	}
 
 	if !reflect.DeepEqual(got, expected) {
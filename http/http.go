@@ -77,9 +77,19 @@ func newRouter(s *Server) *httprouter.Router {
 
 		r.PUT("/users/:passkey", makeHandler(s.putUser))
 		r.DELETE("/users/:passkey", makeHandler(s.delUser))
+
+		if s.config.WebTorrentEnabled {
+			r.POST("/users/:passkey/webtorrent/announce", makeHandler(s.serveWebAnnounce))
+			r.GET("/users/:passkey/webtorrent/signals", makeHandler(s.serveWebSignals))
+		}
 	} else {
 		r.GET("/announce", makeHandler(s.serveAnnounce))
 		r.GET("/scrape", makeHandler(s.serveScrape))
+
+		if s.config.WebTorrentEnabled {
+			r.POST("/webtorrent/announce", makeHandler(s.serveWebAnnounce))
+			r.GET("/webtorrent/signals", makeHandler(s.serveWebSignals))
+		}
 	}
 
 	if s.config.ClientWhitelistEnabled {
@@ -92,6 +102,7 @@ func newRouter(s *Server) *httprouter.Router {
 	r.PUT("/torrents/:infohash", makeHandler(s.putTorrent))
 	r.DELETE("/torrents/:infohash", makeHandler(s.delTorrent))
 	r.GET("/check", makeHandler(s.check))
+	r.GET("/healthz", makeHandler(s.healthz))
 	r.GET("/stats", makeHandler(s.stats))
 
 	return r
@@ -119,7 +130,8 @@ func (s *Server) connState(conn net.Conn, state http.ConnState) {
 }
 
 // Serve creates a new Server and proceeds to block while handling requests
-// until a graceful shutdown.
+// until a graceful shutdown. The tracker is left open, since other servers
+// may still be using it.
 func Serve(cfg *config.Config, tkr *tracker.Tracker) {
 	srv := &Server{
 		config:  cfg,
@@ -150,8 +162,4 @@ func Serve(cfg *config.Config, tkr *tracker.Tracker) {
 			glog.Errorf("Failed to gracefully run HTTP server: %s", err.Error())
 		}
 	}
-
-	if err := srv.tracker.Close(); err != nil {
-		glog.Errorf("Failed to shutdown tracker cleanly: %s", err.Error())
-	}
 }
@@ -10,6 +10,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"sort"
+	"testing"
 
 	"github.com/chihaya/bencode"
 	"github.com/chihaya/chihaya/config"
@@ -83,3 +84,36 @@ func sortPeersInResponse(dict bencode.Dict) {
 		sort.Stable(peerList(peers))
 	}
 }
+
+func TestHealthz(t *testing.T) {
+	cfg := config.DefaultConfig
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	_, status, err := fetchPath(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusOK {
+		t.Fatalf("expected a running tracker to be healthy (got %s)", http.StatusText(status))
+	}
+
+	if err = tkr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, status, err = fetchPath(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusServiceUnavailable {
+		t.Fatalf("expected a closed tracker to be unhealthy (got %s)", http.StatusText(status))
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// jsonWriter implements the tracker.Writer interface for clients that asked
+// for JSON responses, such as web dashboards and scripts. The keys are the
+// same as in bencoded responses, but binary values such as infohashes and
+// peer IDs are hex encoded, since they are not guaranteed to be valid UTF-8.
+type jsonWriter struct {
+	http.ResponseWriter
+
+	omitMinInterval  bool
+	omitScrapeCounts bool
+}
+
+// newJSONWriter returns a jsonWriter that omits the configured fields.
+func newJSONWriter(w http.ResponseWriter, cfg *config.HTTPConfig) *jsonWriter {
+	return &jsonWriter{
+		ResponseWriter:   w,
+		omitMinInterval:  cfg.OmitMinInterval,
+		omitScrapeCounts: cfg.OmitScrapeCounts,
+	}
+}
+
+// wantsJSON returns true if JSON responses are enabled and a request asks for
+// one, either with format=json in its query or by accepting application/json.
+func wantsJSON(r *http.Request, cfg *config.HTTPConfig) bool {
+	if !cfg.JSONResponsesEnabled {
+		return false
+	}
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteError writes a JSON object with a failure reason, and the number of
+// minutes to wait for temporary failures.
+func (w *jsonWriter) WriteError(err error) error {
+	return w.writeJSON(errorDict(err))
+}
+
+// WriteAnnounce writes a JSON representation of an AnnounceResponse. Peers
+// are always listed as objects, even if the client asked for a compact
+// response.
+func (w *jsonWriter) WriteAnnounce(res *models.AnnounceResponse) error {
+	peers := make([]map[string]interface{}, 0, len(res.IPv4Peers)+len(res.IPv6Peers))
+	for _, list := range []models.PeerList{res.IPv4Peers, res.IPv6Peers} {
+		for i := range list {
+			peer := map[string]interface{}{
+				"ip":   list[i].IP.String(),
+				"port": list[i].Port,
+			}
+			if !res.NoPeerID {
+				peer["peer id"] = hex.EncodeToString([]byte(list[i].ID))
+			}
+			peers = append(peers, peer)
+		}
+	}
+
+	dict := announceDict(res, w.omitMinInterval, w.omitScrapeCounts)
+	dict["peers"] = peers
+	if res.ExternalIP != nil {
+		dict["external ip"] = res.ExternalIP.String()
+	}
+
+	return w.writeJSON(dict)
+}
+
+// WriteScrape writes a JSON representation of a ScrapeResponse, with the
+// files keyed by their hex encoded infohashes.
+func (w *jsonWriter) WriteScrape(res *models.ScrapeResponse) error {
+	files := make(map[string]interface{}, len(res.Files))
+	for _, torrent := range res.Files {
+		files[hex.EncodeToString([]byte(torrent.Infohash))] = torrentDict(res, torrent)
+	}
+
+	return w.writeJSON(map[string]interface{}{
+		"files": files,
+	})
+}
+
+func (w *jsonWriter) writeJSON(v interface{}) error {
+	w.Header().Set("Content-Type", jsonContentType)
+	return json.NewEncoder(w).Encode(v)
+}
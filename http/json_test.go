@@ -0,0 +1,186 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/chihaya/bencode"
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+func TestJSONResponses(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.JSONResponsesEnabled = true
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// Clients that do not ask for JSON still get bencode.
+	seeder := makePeerParams("seeder", true, "10.0.0.1")
+	checkAnnounce(seeder, makeResponse(1, 0), srv, t)
+
+	leecher := makePeerParams("leecher", false, "10.0.0.2")
+	leecher["format"] = "json"
+	leecher["compact"] = "1"
+	body, err := announce(leecher, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("announce response is not JSON: %s", err)
+	}
+	if got["external ip"] != "10.0.0.2" {
+		t.Errorf("expected external ip 10.0.0.2, got %v", got["external ip"])
+	}
+	delete(got, "external ip")
+	delete(got, "tracker id")
+
+	expected := map[string]interface{}{
+		"interval":     float64(cfg.Announce.Seconds()),
+		"min interval": float64(cfg.MinAnnounce.Seconds()),
+		"complete":     float64(1),
+		"incomplete":   float64(1),
+		"peers": []interface{}{map[string]interface{}{
+			"ip":      "10.0.0.1",
+			"port":    float64(1234),
+			"peer id": hex.EncodeToString([]byte("seeder")),
+		}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("\ngot:    %#v\nwanted: %#v", got, expected)
+	}
+
+	// Scrapes select JSON with the Accept header.
+	values := url.Values{"info_hash": {infoHash}}
+	req, err := http.NewRequest("GET", srv.URL+"/scrape?"+values.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json; charset=utf-8")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = nil
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("scrape response is not JSON: %s", err)
+	}
+	expected = map[string]interface{}{
+		"files": map[string]interface{}{
+			hex.EncodeToString([]byte(infoHash)): map[string]interface{}{
+				"complete":   float64(1),
+				"incomplete": float64(1),
+				"downloaded": float64(0),
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("\ngot:    %#v\nwanted: %#v", got, expected)
+	}
+}
+
+func TestJSONResponsesDisabled(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer := makePeerParams("peer1", true)
+	peer["format"] = "json"
+
+	body, err := announce(peer, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bencode.Unmarshal(body); err != nil {
+		t.Errorf("expected a bencoded response, got %q", body)
+	}
+}
+
+func TestJSONResponsesOmitFields(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.JSONResponsesEnabled = true
+	cfg.OmitMinInterval = true
+	cfg.OmitScrapeCounts = true
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	peer := makePeerParams("peer1", true, "10.0.0.1")
+	peer["format"] = "json"
+	body, err := announce(peer, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("announce response is not JSON: %s", err)
+	}
+	for _, key := range []string{"min interval", "complete", "incomplete"} {
+		if _, exists := got[key]; exists {
+			t.Errorf("expected %q to be omitted, got %v", key, got[key])
+		}
+	}
+}
+
+func TestJSONScrapeTransfers(t *testing.T) {
+	cfg := config.DefaultConfig
+	torrent := &models.Torrent{
+		Infohash:        infoHash,
+		Seeders:         models.NewPeerMap(true, &cfg),
+		Leechers:        models.NewPeerMap(false, &cfg),
+		DownloadRate:    2.5,
+		TotalUploaded:   100,
+		TotalDownloaded: 200,
+	}
+
+	rec := httptest.NewRecorder()
+	w := newJSONWriter(rec, &cfg.HTTPConfig)
+	if err := w.WriteScrape(&models.ScrapeResponse{Files: []*models.Torrent{torrent}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]map[string]map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("scrape response is not JSON: %s", err)
+	}
+	expected := map[string]interface{}{
+		"complete":         float64(0),
+		"incomplete":       float64(0),
+		"downloaded":       float64(0),
+		"download rate":    float64(2),
+		"total uploaded":   float64(100),
+		"total downloaded": float64(200),
+	}
+	if file := got["files"][hex.EncodeToString([]byte(infoHash))]; !reflect.DeepEqual(file, expected) {
+		t.Errorf("\ngot:    %#v\nwanted: %#v", file, expected)
+	}
+}
@@ -90,6 +90,23 @@ func New(query string) (*Query, error) {
 	return q, nil
 }
 
+// Alias copies the values of parameters to the names they are aliases of,
+// unless a parameter with that name was also given. aliases maps aliases to
+// canonical names, and is matched case-insensitively like parameter names.
+func (q *Query) Alias(aliases map[string]string) {
+	for alias, canonical := range aliases {
+		val, exists := q.Params[strings.ToLower(alias)]
+		if !exists {
+			continue
+		}
+
+		canonical = strings.ToLower(canonical)
+		if _, exists := q.Params[canonical]; !exists {
+			q.Params[canonical] = val
+		}
+	}
+}
+
 // Uint64 is a helper to obtain a uint of any length from a Query. After being
 // called, you can safely cast the uint64 to your desired length.
 func (q *Query) Uint64(key string) (uint64, error) {
@@ -74,6 +74,25 @@ func TestInvalidQueries(t *testing.T) {
 	}
 }
 
+func TestAlias(t *testing.T) {
+	q, err := New("infohash=abc&Peer=def&peer_id=ghi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Alias(map[string]string{"InfoHash": "info_hash", "peer": "peer_id", "missing": "port"})
+
+	if q.Params["info_hash"] != "abc" {
+		t.Errorf("expected the alias to set info_hash, got %q", q.Params["info_hash"])
+	}
+	if q.Params["peer_id"] != "ghi" {
+		t.Errorf("expected the canonical peer_id to be kept, got %q", q.Params["peer_id"])
+	}
+	if _, exists := q.Params["port"]; exists {
+		t.Error("expected a missing alias to leave port unset")
+	}
+}
+
 func BenchmarkParseQuery(b *testing.B) {
 	for bCount := 0; bCount < b.N; bCount++ {
 		for parseIndex, parseStr := range ValidAnnounceArguments {
@@ -14,6 +14,7 @@ import (
 	"github.com/julienschmidt/httprouter"
 
 	"github.com/chihaya/chihaya/stats"
+	"github.com/chihaya/chihaya/tracker"
 	"github.com/chihaya/chihaya/tracker/models"
 )
 
@@ -44,6 +45,17 @@ func (s *Server) check(w http.ResponseWriter, r *http.Request, p httprouter.Para
 	return handleError(err)
 }
 
+// healthz reports whether the tracker is able to serve requests, so that load
+// balancers stop routing to unhealthy instances.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	if err := s.tracker.Healthy(); err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+
+	_, err := w.Write([]byte("OK"))
+	return handleError(err)
+}
+
 func (s *Server) stats(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
 	w.Header().Set("Content-Type", jsonContentType)
 
@@ -73,10 +85,15 @@ func (s *Server) stats(w http.ResponseWriter, r *http.Request, p httprouter.Para
 	return handleError(err)
 }
 
-func handleTorrentError(err error, w *Writer) (int, error) {
+// handleTorrentError writes errors caused by the client as a failure reason
+// with a 200 OK status, reserving HTTP errors for faults of the tracker.
+func handleTorrentError(err error, w tracker.Writer) (int, error) {
 	if err == nil {
 		return http.StatusOK, nil
-	} else if _, ok := err.(models.ClientError); ok {
+	}
+
+	switch err.(type) {
+	case models.ClientError, models.NotFoundError:
 		w.WriteError(err)
 		stats.RecordEvent(stats.ClientError)
 		return http.StatusOK, nil
@@ -88,7 +105,11 @@ func handleTorrentError(err error, w *Writer) (int, error) {
 func (s *Server) serveAnnounce(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
 	stats.RecordEvent(stats.Announce)
 
-	writer := &Writer{w}
+	var writer tracker.Writer = newWriter(w, r, &s.config.HTTPConfig)
+	if wantsJSON(r, &s.config.HTTPConfig) {
+		writer = newJSONWriter(w, &s.config.HTTPConfig)
+	}
+
 	ann, err := NewAnnounce(s.config, r, p)
 	if err != nil {
 		return handleTorrentError(err, writer)
@@ -100,7 +121,11 @@ func (s *Server) serveAnnounce(w http.ResponseWriter, r *http.Request, p httprou
 func (s *Server) serveScrape(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
 	stats.RecordEvent(stats.Scrape)
 
-	writer := &Writer{w}
+	var writer tracker.Writer = &Writer{ResponseWriter: w}
+	if wantsJSON(r, &s.config.HTTPConfig) {
+		writer = newJSONWriter(w, &s.config.HTTPConfig)
+	}
+
 	scrape, err := NewScrape(s.config, r, p)
 	if err != nil {
 		return handleTorrentError(err, writer)
@@ -115,7 +140,7 @@ func (s *Server) getTorrent(w http.ResponseWriter, r *http.Request, p httprouter
 		return http.StatusNotFound, err
 	}
 
-	torrent, err := s.tracker.FindTorrent(infohash)
+	torrent, err := s.tracker.TorrentSnapshot(infohash)
 	if err != nil {
 		return handleError(err)
 	}
@@ -147,8 +172,7 @@ func (s *Server) delTorrent(w http.ResponseWriter, r *http.Request, p httprouter
 		return http.StatusNotFound, err
 	}
 
-	s.tracker.DeleteTorrent(infohash)
-	return http.StatusOK, nil
+	return handleError(s.tracker.RemoveTorrent(infohash))
 }
 
 func (s *Server) getUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
@@ -176,12 +200,16 @@ func (s *Server) putUser(w http.ResponseWriter, r *http.Request, p httprouter.Pa
 		return http.StatusBadRequest, err
 	}
 
-	s.tracker.PutUser(&user)
+	if err := s.tracker.PutUser(&user); err != nil {
+		return http.StatusInternalServerError, err
+	}
 	return http.StatusOK, nil
 }
 
 func (s *Server) delUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
-	s.tracker.DeleteUser(p.ByName("passkey"))
+	if err := s.tracker.DeleteUser(p.ByName("passkey")); err != nil {
+		return http.StatusInternalServerError, err
+	}
 	return http.StatusOK, nil
 }
 
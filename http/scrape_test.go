@@ -14,6 +14,7 @@ import (
 
 	"github.com/chihaya/bencode"
 	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/tracker"
 )
 
 func TestPublicScrape(t *testing.T) {
@@ -58,6 +59,152 @@ func TestPublicScrape(t *testing.T) {
 	checkScrape(scrapeParams, makeScrapeResponse(2, 0, 0), srv, t)
 }
 
+func TestImplicitCompleteScrape(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.CountImplicitCompletes = true
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	scrapeParams := params{"info_hash": infoHash}
+
+	// Add a leecher.
+	peer := makePeerParams("peer1", false)
+	announce(peer, srv)
+
+	checkScrape(scrapeParams, makeScrapeResponse(0, 1, 0), srv, t)
+
+	// Finish without sending the completed event.
+	peer = makePeerParams("peer1", true)
+	announce(peer, srv)
+
+	checkScrape(scrapeParams, makeScrapeResponse(1, 0, 1), srv, t)
+
+	// Reannouncing as a seeder must not count another snatch.
+	announce(peer, srv)
+
+	checkScrape(scrapeParams, makeScrapeResponse(1, 0, 1), srv, t)
+}
+
+func TestRepeatedCompleteScrape(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	scrapeParams := params{"info_hash": infoHash}
+
+	peer := makePeerParams("peer1", false)
+	announce(peer, srv)
+
+	peer = makePeerParams("peer1", true)
+	peer["event"] = "completed"
+	announce(peer, srv)
+
+	checkScrape(scrapeParams, makeScrapeResponse(1, 0, 1), srv, t)
+
+	// Resending the completed event must succeed without another snatch.
+	expected := makeResponse(1, 0)
+	checkAnnounce(peer, expected, srv, t)
+
+	checkScrape(scrapeParams, makeScrapeResponse(1, 0, 1), srv, t)
+}
+
+func TestMultiScrape(t *testing.T) {
+	srv, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// Add one seeder.
+	peer := makePeerParams("peer1", true)
+	announce(peer, srv)
+
+	values := &url.Values{}
+	values.Add("info_hash", infoHash)
+	values.Add("info_hash", "unknowninfohash12345")
+
+	body, status, err := fetchPath(srv.URL + "/scrape?" + values.Encode())
+	if err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusOK {
+		t.Fatalf("expected scrape to succeed (got %s)", http.StatusText(status))
+	}
+
+	got, err := bencode.Unmarshal(body)
+	expected := makeScrapeResponse(1, 0, 0)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("\ngot:    %#v\nwanted: %#v", got, expected)
+	}
+}
+
+func TestMetadataPeerScrape(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.ExcludeMetadataPeers = true
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	scrapeParams := params{"info_hash": infoHash}
+
+	magnet := makePeerParams("peer1", false)
+	announce(magnet, srv)
+
+	leecher := makePeerParams("peer2", false)
+	leecher["downloaded"] = "100"
+	announce(leecher, srv)
+
+	checkScrape(scrapeParams, makeScrapeResponse(0, 1, 0), srv, t)
+
+	// Once it has the metadata, it starts downloading like any leecher.
+	magnet["downloaded"] = "100"
+	announce(magnet, srv)
+
+	checkScrape(scrapeParams, makeScrapeResponse(0, 2, 0), srv, t)
+}
+
+func TestTransferScrape(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PrivateEnabled = true
+
+	tkr, err := tracker.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadPrivateTestData(tkr)
+
+	srv, err := createServer(tkr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.URL = srv.URL + "/users/vvvvvvvvvvvvvvvvvvvvvvvvvvvvvvv1"
+
+	scrapeParams := params{"info_hash": infoHash}
+
+	peer := makePeerParams("-TR2820-peer1", false)
+	announce(peer, srv)
+	checkScrape(scrapeParams, makeScrapeResponse(0, 1, 0), srv, t)
+
+	// The totals are the bytes reported by peers, regardless of multipliers.
+	peer["uploaded"] = "1000"
+	peer["downloaded"] = "400"
+	announce(peer, srv)
+
+	expected := makeScrapeResponse(0, 1, 0)
+	file := expected["files"].(bencode.Dict)[infoHash].(bencode.Dict)
+	file["total uploaded"] = int64(1000)
+	file["total downloaded"] = int64(400)
+	checkScrape(scrapeParams, expected, srv, t)
+}
+
 func makeScrapeResponse(seeders, leechers, downloaded int64) bencode.Dict {
 	return bencode.Dict{
 		"files": bencode.Dict{
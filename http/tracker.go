@@ -5,10 +5,13 @@
 package http
 
 import (
+	"encoding/base32"
+	"encoding/hex"
 	"errors"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 
@@ -21,17 +24,30 @@ import (
 func NewAnnounce(cfg *config.Config, r *http.Request, p httprouter.Params) (*models.Announce, error) {
 	q, err := query.New(r.URL.RawQuery)
 	if err != nil {
-		return nil, err
+		return nil, models.ErrMalformedRequest
 	}
+	q.Alias(cfg.ParameterAliases)
 
 	compact := q.Params["compact"] != "0"
+	noPeerID := q.Params["no_peer_id"] == "1"
 	event, _ := q.Params["event"]
-	numWant := requestedPeerCount(q, cfg.NumWantFallback)
+	key, _ := q.Params["key"]
+	trackerID, _ := q.Params["trackerid"]
+	numWant, numWantProvided := requestedPeerCount(q)
+	noIPv4 := q.Params["ipv6_only"] == "1"
+	noIPv6 := q.Params["no_ipv6"] == "1"
+	supportCrypto := q.Params["supportcrypto"] == "1"
+	requireCrypto := q.Params["requirecrypto"] == "1"
+
+	if noIPv4 && noIPv6 {
+		return nil, models.ErrMalformedRequest
+	}
 
 	infohash, exists := q.Params["info_hash"]
 	if !exists {
 		return nil, models.ErrMalformedRequest
 	}
+	infohash = normalizeInfohash(infohash)
 
 	peerID, exists := q.Params["peer_id"]
 	if !exists {
@@ -43,6 +59,11 @@ func NewAnnounce(cfg *config.Config, r *http.Request, p httprouter.Params) (*mod
 		return nil, models.ErrMalformedRequest
 	}
 
+	ipv6, err = announcedIPv6(q, ipv4, ipv6, &cfg.NetConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	port, err := q.Uint64("port")
 	if err != nil {
 		return nil, models.ErrMalformedRequest
@@ -63,20 +84,47 @@ func NewAnnounce(cfg *config.Config, r *http.Request, p httprouter.Params) (*mod
 		return nil, models.ErrMalformedRequest
 	}
 
+	// Few clients report the bytes they discarded for failing hash checks.
+	var corrupt uint64
+	if _, exists := q.Params["corrupt"]; exists {
+		if corrupt, err = q.Uint64("corrupt"); err != nil {
+			return nil, models.ErrMalformedRequest
+		}
+	}
+
+	// Clients that have a magnet link's metadata may report its size.
+	var metadataSize uint64
+	if _, exists := q.Params["metadata_size"]; exists {
+		if metadataSize, err = q.Uint64("metadata_size"); err != nil {
+			return nil, models.ErrMalformedRequest
+		}
+	}
+
 	return &models.Announce{
 		Config:     cfg,
 		Compact:    compact,
+		Corrupt:    corrupt,
 		Downloaded: downloaded,
 		Event:      event,
 		IPv4:       ipv4,
 		IPv6:       ipv6,
 		Infohash:   infohash,
+		Key:        key,
 		Left:       left,
+		NoIPv4:     noIPv4,
+		NoIPv6:     noIPv6,
+		NoPeerID:   noPeerID,
 		NumWant:    numWant,
 		Passkey:    p.ByName("passkey"),
 		PeerID:     peerID,
 		Port:       port,
+		TrackerID:  trackerID,
 		Uploaded:   uploaded,
+
+		SupportCrypto:   supportCrypto,
+		RequireCrypto:   requireCrypto,
+		MetadataSize:    int(metadataSize),
+		NumWantProvided: numWantProvided,
 	}, nil
 }
 
@@ -84,7 +132,7 @@ func NewAnnounce(cfg *config.Config, r *http.Request, p httprouter.Params) (*mod
 func NewScrape(cfg *config.Config, r *http.Request, p httprouter.Params) (*models.Scrape, error) {
 	q, err := query.New(r.URL.RawQuery)
 	if err != nil {
-		return nil, err
+		return nil, models.ErrMalformedRequest
 	}
 
 	if q.Infohashes == nil {
@@ -95,6 +143,10 @@ func NewScrape(cfg *config.Config, r *http.Request, p httprouter.Params) (*model
 		q.Infohashes = []string{q.Params["info_hash"]}
 	}
 
+	for i, infohash := range q.Infohashes {
+		q.Infohashes[i] = normalizeInfohash(infohash)
+	}
+
 	return &models.Scrape{
 		Config: cfg,
 
@@ -103,17 +155,35 @@ func NewScrape(cfg *config.Config, r *http.Request, p httprouter.Params) (*model
 	}, nil
 }
 
-// requestedPeerCount returns the wanted peer count or the provided fallback.
-func requestedPeerCount(q *query.Query, fallback int) int {
+// normalizeInfohash decodes an infohash sent as 40 hex or 32 base32
+// characters, as some clients and magnet links do, into its 20-byte binary
+// form. Any other infohash is returned unchanged.
+func normalizeInfohash(infohash string) string {
+	switch len(infohash) {
+	case 40:
+		if decoded, err := hex.DecodeString(infohash); err == nil {
+			return string(decoded)
+		}
+	case 32:
+		if decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(infohash)); err == nil {
+			return string(decoded)
+		}
+	}
+	return infohash
+}
+
+// requestedPeerCount returns the wanted peer count and whether one was
+// provided. Invalid or negative counts are treated as not provided.
+func requestedPeerCount(q *query.Query) (numWant int, provided bool) {
 	if numWantStr, exists := q.Params["numwant"]; exists {
 		numWant, err := strconv.Atoi(numWantStr)
-		if err != nil {
-			return fallback
+		if err != nil || numWant < 0 {
+			return 0, false
 		}
-		return numWant
+		return numWant, true
 	}
 
-	return fallback
+	return 0, false
 }
 
 // requestedIP returns the IP addresses for a request. If there are multiple
@@ -159,6 +229,7 @@ func requestedIP(q *query.Query, r *http.Request, cfg *config.NetConfig) (v4, v6
 		host, _, err = net.SplitHostPort(r.RemoteAddr)
 
 		if err == nil && host != "" {
+			host = forwardedFor(r, host, &cfg.ProxyConfig)
 			if v4, v6, done = getIPs(host, v4, v6, cfg); done {
 				return
 			}
@@ -171,6 +242,68 @@ func requestedIP(q *query.Query, r *http.Request, cfg *config.NetConfig) (v4, v6
 	return
 }
 
+// announcedIPv6 returns the IPv6 address of a client, adding the one sent in
+// the ipv6 parameter by BEP 7 clients connecting over IPv4 if AllowIPv6Param
+// is enabled. Only global unicast addresses are accepted, with or without a
+// port. The address a client connects from is always kept.
+func announcedIPv6(q *query.Query, v4, v6 net.IP, cfg *config.NetConfig) (net.IP, error) {
+	str, exists := q.Params["ipv6"]
+	if !exists || !cfg.AllowIPv6Param {
+		return v6, nil
+	}
+
+	if host, _, err := net.SplitHostPort(str); err == nil {
+		str = host
+	}
+	ip := net.ParseIP(str)
+	if ip == nil || ip.To4() != nil || !ip.IsGlobalUnicast() {
+		return v6, nil
+	}
+
+	switch {
+	case v6 != nil:
+		if cfg.StrictIPv6Param && !ip.Equal(v6) {
+			return nil, models.ErrMismatchedIPv6
+		}
+		return v6, nil
+	case v4 != nil && !cfg.DualStackedPeers:
+		return v6, nil
+	}
+	return ip, nil
+}
+
+// forwardedFor returns the client address from the X-Forwarded-For header if
+// the request was made by a trusted proxy, and the remote address otherwise.
+func forwardedFor(r *http.Request, remote string, cfg *config.ProxyConfig) string {
+	if !trustedProxy(remote, cfg.TrustedProxies) {
+		return remote
+	}
+
+	header := strings.Join(r.Header["X-Forwarded-For"], ",")
+	if header == "" {
+		return remote
+	}
+
+	// Each proxy appends the address it received the request from, so the
+	// addresses left of the last untrusted one may have been spoofed by the
+	// client.
+	addrs := strings.Split(header, ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		if addr := strings.TrimSpace(addrs[i]); !trustedProxy(addr, cfg.TrustedProxies) {
+			return addr
+		}
+	}
+
+	return strings.TrimSpace(addrs[0])
+}
+
+// trustedProxy returns true if an address is within any of the provided
+// networks.
+func trustedProxy(addr string, proxies config.IPNets) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && proxies.Contains(ip)
+}
+
 func getIPs(ipstr string, ipv4, ipv6 net.IP, cfg *config.NetConfig) (net.IP, net.IP, bool) {
 	var done bool
 
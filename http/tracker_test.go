@@ -0,0 +1,120 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/http/query"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+var forwardedForTests = []struct {
+	remote   string
+	header   string
+	expected string
+}{
+	{"10.0.0.1", "44.0.0.1", "10.0.0.1"}, // Untrusted proxy.
+	{"127.0.0.1", "", "127.0.0.1"},
+	{"127.0.0.1", "44.0.0.1", "44.0.0.1"},
+	{"127.0.0.1", "44.0.0.1, 45.0.0.1", "45.0.0.1"}, // Spoofed by 45.0.0.1.
+	{"127.0.0.1", "44.0.0.1, 192.168.0.2", "44.0.0.1"},
+	{"127.0.0.1", "192.168.0.1, 192.168.0.2", "192.168.0.1"},
+	{"192.168.0.3", "fc01::1", "fc01::1"},
+}
+
+func TestForwardedFor(t *testing.T) {
+	proxies, err := config.ParseIPNets([]string{"127.0.0.1", "192.168.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range forwardedForTests {
+		cfg := &config.ProxyConfig{TrustedProxies: proxies}
+
+		r := &http.Request{Header: make(http.Header)}
+		if tt.header != "" {
+			r.Header.Set("X-Forwarded-For", tt.header)
+		}
+
+		if got := forwardedFor(r, tt.remote, cfg); got != tt.expected {
+			t.Errorf("forwardedFor(%q, %q) = %q, expected %q", tt.remote, tt.header, got, tt.expected)
+		}
+	}
+}
+
+var normalizeInfohashTests = []struct {
+	infohash string
+	expected string
+}{
+	{infoHash, infoHash},
+	{"89d4bc521116ca1d42a2f30d1f274d94e4681daf", infoHash},
+	{"89D4BC521116CA1D42A2F30D1F274D94E4681DAF", infoHash},
+	{"RHKLYUQRC3FB2QVC6MGR6J2NSTSGQHNP", infoHash},
+	{"rhklyuqrc3fb2qvc6mgr6j2nstsgqhnp", infoHash},
+	{"short", "short"},
+	{"zz d4bc521116ca1d42a2f30d1f274d94e4681daf", "zz d4bc521116ca1d42a2f30d1f274d94e4681daf"},
+}
+
+func TestNormalizeInfohash(t *testing.T) {
+	for _, tt := range normalizeInfohashTests {
+		if got := normalizeInfohash(tt.infohash); got != tt.expected {
+			t.Errorf("normalizeInfohash(%q) = %q, expected %q", tt.infohash, got, tt.expected)
+		}
+	}
+}
+
+var announcedIPv6Tests = []struct {
+	param      string
+	observed   string
+	dualStack  bool
+	strict     bool
+	expected   string
+	mismatched bool
+}{
+	{"2001:db8::1", "10.0.0.1", true, false, "2001:db8::1", false},
+	{"[2001:db8::1]:6881", "10.0.0.1", true, false, "2001:db8::1", false},
+	{"2001:db8::1", "10.0.0.1", false, false, "", false},
+	{"fe80::1", "10.0.0.1", true, false, "", false},
+	{"10.0.0.2", "10.0.0.1", true, false, "", false},
+	{"2001:db8::1", "2001:db8::2", true, false, "2001:db8::2", false},
+	{"2001:db8::1", "2001:db8::2", true, true, "", true},
+	{"2001:db8::2", "2001:db8::2", true, true, "2001:db8::2", false},
+}
+
+func TestAnnouncedIPv6(t *testing.T) {
+	for _, tt := range announcedIPv6Tests {
+		cfg := &config.NetConfig{
+			AllowIPv6Param:   true,
+			StrictIPv6Param:  tt.strict,
+			DualStackedPeers: tt.dualStack,
+		}
+		q := &query.Query{Params: map[string]string{"ipv6": tt.param}}
+
+		var v4, v6 net.IP
+		if ip := net.ParseIP(tt.observed); ip.To4() != nil {
+			v4 = ip.To4()
+		} else {
+			v6 = ip
+		}
+
+		got, err := announcedIPv6(q, v4, v6, cfg)
+		if tt.mismatched {
+			if err != models.ErrMismatchedIPv6 {
+				t.Errorf("expected %q from %s to be rejected, got %v", tt.param, tt.observed, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("expected %q from %s to be accepted, got %v", tt.param, tt.observed, err)
+		} else if expected := net.ParseIP(tt.expected); !got.Equal(expected) {
+			t.Errorf("announcedIPv6(%q) from %s = %s, expected %s", tt.param, tt.observed, got, expected)
+		}
+	}
+}
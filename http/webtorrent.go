@@ -0,0 +1,282 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/http/query"
+	"github.com/chihaya/chihaya/stats"
+	"github.com/chihaya/chihaya/tracker"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// webAnnounce is the JSON body of an announce by a WebTorrent browser client.
+// Binary values such as the infohash are sent as strings with one character
+// per byte.
+type webAnnounce struct {
+	InfoHash   string          `json:"info_hash"`
+	PeerID     string          `json:"peer_id"`
+	Uploaded   uint64          `json:"uploaded"`
+	Downloaded uint64          `json:"downloaded"`
+	Left       *uint64         `json:"left"`
+	Event      string          `json:"event"`
+	Offers     []webOffer      `json:"offers"`
+	Answer     json.RawMessage `json:"answer"`
+	ToPeerID   string          `json:"to_peer_id"`
+	OfferID    string          `json:"offer_id"`
+}
+
+type webOffer struct {
+	OfferID string          `json:"offer_id"`
+	Offer   json.RawMessage `json:"offer"`
+}
+
+// webSignal is a signal as it is delivered to a browser client.
+type webSignal struct {
+	Action   string          `json:"action"`
+	InfoHash string          `json:"info_hash"`
+	PeerID   string          `json:"peer_id"`
+	OfferID  string          `json:"offer_id"`
+	Offer    json.RawMessage `json:"offer,omitempty"`
+	Answer   json.RawMessage `json:"answer,omitempty"`
+}
+
+// NewWebAnnounce generates a models.Announce from a WebTorrent announce. The
+// client wants one peer for each of the offers it sent.
+func NewWebAnnounce(cfg *config.Config, r *http.Request, p httprouter.Params, req *webAnnounce) (*models.Announce, error) {
+	infohash, err := binaryString(req.InfoHash)
+	if err != nil || infohash == "" {
+		return nil, models.ErrMalformedRequest
+	}
+
+	peerID, err := binaryString(req.PeerID)
+	if err != nil || peerID == "" {
+		return nil, models.ErrMalformedRequest
+	}
+
+	// Only the address of the request is used, since browser clients cannot
+	// be contacted directly anyway.
+	ipv4, ipv6, err := requestedIP(&query.Query{Params: map[string]string{}}, r, &cfg.NetConfig)
+	if err != nil {
+		return nil, models.ErrMalformedRequest
+	}
+
+	// Clients that do not know how much is left, e.g. when started from a
+	// magnet link, are leeching.
+	left := uint64(math.MaxUint64)
+	if req.Left != nil {
+		left = *req.Left
+	}
+
+	event := req.Event
+	if event == "update" {
+		event = ""
+	}
+
+	return &models.Announce{
+		Config:     cfg,
+		Downloaded: req.Downloaded,
+		Event:      event,
+		IPv4:       ipv4,
+		IPv6:       ipv6,
+		Infohash:   infohash,
+		Left:       left,
+		NumWant:    len(req.Offers),
+		Passkey:    p.ByName("passkey"),
+		PeerID:     peerID,
+		Uploaded:   req.Uploaded,
+
+		NumWantProvided: true,
+		WebRTC:          true,
+	}, nil
+}
+
+// webWriter implements the tracker.Writer interface for WebTorrent clients.
+// Rather than returning peers, it relays the client's offers to them, and the
+// client's answer to the peer that made the offer.
+type webWriter struct {
+	http.ResponseWriter
+
+	tracker *tracker.Tracker
+	req     *webAnnounce
+	ann     *models.Announce
+}
+
+// WriteError writes a JSON object with a failure reason.
+func (w *webWriter) WriteError(err error) error {
+	return w.writeJSON(map[string]interface{}{
+		"action":         "announce",
+		"failure reason": err.Error(),
+	})
+}
+
+// WriteAnnounce relays the offers and answer of the announce, and then writes
+// a JSON representation of an AnnounceResponse, along with the token the
+// client needs to poll for its signals. Answers to peers that are not in the
+// swarm are dropped.
+func (w *webWriter) WriteAnnounce(res *models.AnnounceResponse) error {
+	peers := append(append(models.PeerList{}, res.IPv4Peers...), res.IPv6Peers...)
+	for i, peer := range peers {
+		if i >= len(w.req.Offers) {
+			break
+		}
+		w.tracker.SendSignal(w.ann.Infohash, peer.ID, models.Signal{
+			PeerID:  w.ann.PeerID,
+			OfferID: w.req.Offers[i].OfferID,
+			Offer:   w.req.Offers[i].Offer,
+		})
+	}
+
+	if w.req.Answer != nil && w.req.ToPeerID != "" {
+		if toPeerID, err := binaryString(w.req.ToPeerID); err == nil {
+			w.tracker.SendSignal(w.ann.Infohash, toPeerID, models.Signal{
+				PeerID:  w.ann.PeerID,
+				OfferID: w.req.OfferID,
+				Answer:  w.req.Answer,
+			})
+		}
+	}
+
+	dict := map[string]interface{}{
+		"action":       "announce",
+		"info_hash":    w.req.InfoHash,
+		"interval":     int64(res.Interval.Seconds()),
+		"complete":     res.Complete,
+		"incomplete":   res.Incomplete,
+		"signal_token": w.tracker.SignalToken(w.ann.Infohash, w.ann.PeerID),
+	}
+	if res.WarningMessage != "" {
+		dict["warning message"] = res.WarningMessage
+	}
+
+	return w.writeJSON(dict)
+}
+
+// WriteScrape writes a JSON representation of a ScrapeResponse.
+func (w *webWriter) WriteScrape(res *models.ScrapeResponse) error {
+	files := make(map[string]interface{}, len(res.Files))
+	for _, torrent := range res.Files {
+		files[toBinaryString(torrent.Infohash)] = map[string]interface{}{
+			"complete":   res.Complete(torrent),
+			"incomplete": res.Incomplete(torrent),
+			"downloaded": res.Downloaded(torrent),
+		}
+	}
+
+	return w.writeJSON(map[string]interface{}{
+		"action": "scrape",
+		"files":  files,
+	})
+}
+
+func (w *webWriter) writeJSON(v interface{}) error {
+	w.Header().Set("Content-Type", jsonContentType)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// maxWebAnnounceSize bounds the JSON body of a WebTorrent announce, which is
+// mostly made up of the WebRTC offers for the peers it is given.
+const maxWebAnnounceSize = 64 << 10
+
+func (s *Server) serveWebAnnounce(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	stats.RecordEvent(stats.Announce)
+
+	var req webAnnounce
+	writer := &webWriter{ResponseWriter: w, tracker: s.tracker, req: &req}
+
+	body := http.MaxBytesReader(w, r.Body, maxWebAnnounceSize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return handleTorrentError(models.ErrRequestTooLarge, writer)
+		}
+		return handleTorrentError(models.ErrMalformedRequest, writer)
+	}
+
+	ann, err := NewWebAnnounce(s.config, r, p, &req)
+	if err != nil {
+		return handleTorrentError(err, writer)
+	}
+	writer.ann = ann
+
+	return handleTorrentError(s.tracker.HandleAnnounce(ann, writer), writer)
+}
+
+// serveWebSignals long-polls for the signals sent to a browser client, and
+// writes them as a JSON array. The client must present the signal token it
+// was given when it announced.
+func (s *Server) serveWebSignals(w http.ResponseWriter, r *http.Request, p httprouter.Params) (int, error) {
+	q, err := query.New(r.URL.RawQuery)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	infohash, exists := q.Params["info_hash"]
+	if !exists {
+		return http.StatusBadRequest, models.ErrMalformedRequest
+	}
+	peerID, exists := q.Params["peer_id"]
+	if !exists {
+		return http.StatusBadRequest, models.ErrMalformedRequest
+	}
+
+	token, _ := q.Params["token"]
+
+	if s.config.PrivateEnabled {
+		if _, err := s.tracker.FindUser(p.ByName("passkey")); err != nil {
+			return handleError(err)
+		}
+	}
+
+	received, err := s.tracker.ReceiveSignals(infohash, peerID, token, s.config.WebTorrentPollTimeout.Duration)
+	if err != nil {
+		return handleError(err)
+	}
+
+	signals := []webSignal{}
+	for _, signal := range received {
+		signals = append(signals, webSignal{
+			Action:   "announce",
+			InfoHash: toBinaryString(infohash),
+			PeerID:   toBinaryString(signal.PeerID),
+			OfferID:  signal.OfferID,
+			Offer:    signal.Offer,
+			Answer:   signal.Answer,
+		})
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
+	return handleError(json.NewEncoder(w).Encode(signals))
+}
+
+// binaryString decodes a string with one character per byte, as WebTorrent
+// clients use for binary values.
+func binaryString(s string) (string, error) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return "", models.ErrMalformedRequest
+		}
+		b = append(b, byte(r))
+	}
+	return string(b), nil
+}
+
+// toBinaryString encodes binary data with one character per byte, the inverse
+// of binaryString.
+func toBinaryString(s string) string {
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes)
+}
@@ -0,0 +1,200 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// webRealIPHeader carries the address of browser peers in tests, which have
+// no ip parameter to set it with.
+const webRealIPHeader = "X-Real-Ip"
+
+func postWebAnnounce(req map[string]interface{}, srv *httptest.Server, t *testing.T) map[string]interface{} {
+	req["info_hash"] = toBinaryString(infoHash)
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest("POST", srv.URL+"/webtorrent/announce", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", jsonContentType)
+
+	// The loopback address of the test server is unreachable.
+	request.Header.Set(webRealIPHeader, "10.0.0.9")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var res map[string]interface{}
+	if err = json.NewDecoder(response.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func fetchWebSignals(peerID, token string, srv *httptest.Server) ([]byte, int, error) {
+	values := &url.Values{}
+	values.Add("info_hash", infoHash)
+	values.Add("peer_id", peerID)
+	values.Add("token", token)
+
+	return fetchPath(srv.URL + "/webtorrent/signals?" + values.Encode())
+}
+
+func pollWebSignals(peerID, token string, srv *httptest.Server, t *testing.T) []map[string]interface{} {
+	body, status, err := fetchWebSignals(peerID, token, srv)
+	if err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusOK {
+		t.Fatalf("expected polling to succeed (got %s)", http.StatusText(status))
+	}
+
+	var signals []map[string]interface{}
+	if err = json.Unmarshal(body, &signals); err != nil {
+		t.Fatal(err)
+	}
+	return signals
+}
+
+func TestWebTorrentSignaling(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.WebTorrentEnabled = true
+	cfg.WebTorrentPollTimeout = config.Duration{Duration: 10 * time.Millisecond}
+	cfg.RealIPHeader = webRealIPHeader
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	offer := map[string]interface{}{"type": "offer", "sdp": "offer-sdp"}
+	answer := map[string]interface{}{"type": "answer", "sdp": "answer-sdp"}
+
+	res := postWebAnnounce(map[string]interface{}{
+		"peer_id": "webpeer1",
+		"left":    0,
+		"offers":  []interface{}{map[string]interface{}{"offer_id": "offer1", "offer": offer}},
+	}, srv, t)
+	token1, _ := res["signal_token"].(string)
+	if token1 == "" {
+		t.Fatal("expected a signal token")
+	}
+	delete(res, "signal_token")
+	expected := map[string]interface{}{
+		"action":     "announce",
+		"info_hash":  toBinaryString(infoHash),
+		"interval":   float64(1800),
+		"complete":   float64(1),
+		"incomplete": float64(0),
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("\ngot:    %#v\nwanted: %#v", res, expected)
+	}
+
+	// Regular peers cannot connect to browser peers.
+	peer := makePeerParams("peer1", false)
+	checkAnnounce(peer, makeResponse(1, 1), srv, t)
+
+	res = postWebAnnounce(map[string]interface{}{
+		"peer_id": "webpeer2",
+		"offers":  []interface{}{map[string]interface{}{"offer_id": "offer2", "offer": offer}},
+	}, srv, t)
+	token2, _ := res["signal_token"].(string)
+
+	// Knowing a peer ID is not enough to read its signals.
+	if _, status, err := fetchWebSignals("webpeer1", token2, srv); err != nil {
+		t.Fatal(err)
+	} else if status != http.StatusBadRequest {
+		t.Errorf("expected polling with another peer's token to fail (got %s)", http.StatusText(status))
+	}
+
+	signals := pollWebSignals("webpeer1", token1, srv, t)
+	expectedSignals := []map[string]interface{}{{
+		"action":    "announce",
+		"info_hash": toBinaryString(infoHash),
+		"peer_id":   "webpeer2",
+		"offer_id":  "offer2",
+		"offer":     offer,
+	}}
+	if !reflect.DeepEqual(signals, expectedSignals) {
+		t.Errorf("\ngot:    %#v\nwanted: %#v", signals, expectedSignals)
+	}
+
+	postWebAnnounce(map[string]interface{}{
+		"peer_id":    "webpeer1",
+		"left":       0,
+		"to_peer_id": "webpeer2",
+		"offer_id":   "offer2",
+		"answer":     answer,
+	}, srv, t)
+
+	// Answers to peers outside the swarm are dropped.
+	postWebAnnounce(map[string]interface{}{
+		"peer_id":    "webpeer1",
+		"left":       0,
+		"to_peer_id": "webpeer3",
+		"offer_id":   "offer3",
+		"answer":     answer,
+	}, srv, t)
+
+	signals = pollWebSignals("webpeer2", token2, srv, t)
+	expectedSignals = []map[string]interface{}{{
+		"action":    "announce",
+		"info_hash": toBinaryString(infoHash),
+		"peer_id":   "webpeer1",
+		"offer_id":  "offer2",
+		"answer":    answer,
+	}}
+	if !reflect.DeepEqual(signals, expectedSignals) {
+		t.Errorf("\ngot:    %#v\nwanted: %#v", signals, expectedSignals)
+	}
+
+	if signals = pollWebSignals("webpeer2", token2, srv, t); len(signals) != 0 {
+		t.Errorf("expected no more signals, got %#v", signals)
+	}
+}
+
+func TestWebAnnounceTooLarge(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.WebTorrentEnabled = true
+	cfg.RealIPHeader = webRealIPHeader
+
+	srv, err := setupTracker(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	offer := map[string]interface{}{"type": "offer", "sdp": strings.Repeat("a", maxWebAnnounceSize)}
+	res := postWebAnnounce(map[string]interface{}{
+		"peer_id": "webpeer1",
+		"left":    0,
+		"offers":  []interface{}{map[string]interface{}{"offer_id": "offer1", "offer": offer}},
+	}, srv, t)
+
+	if reason := res["failure reason"]; reason != models.ErrRequestTooLarge.Error() {
+		t.Errorf("expected the announce to be refused as too large, got %v", res)
+	}
+}
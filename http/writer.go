@@ -6,33 +6,107 @@ package http
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/chihaya/bencode"
+	"github.com/chihaya/chihaya/config"
 	"github.com/chihaya/chihaya/tracker/models"
 )
 
 // Writer implements the tracker.Writer interface for the HTTP protocol.
 type Writer struct {
 	http.ResponseWriter
+
+	// gzipMinSize is the size from which announce responses are gzipped, or
+	// 0 if the client does not accept gzip.
+	gzipMinSize int
+
+	omitMinInterval  bool
+	omitScrapeCounts bool
+
+	// signingKey is the key announce responses are signed with, or nil if
+	// they are not signed.
+	signingKey []byte
+}
+
+// newWriter returns a Writer for a request, which gzips large announce
+// responses if the client accepts it, omits the configured fields, and signs
+// announce responses if a signing key is configured.
+func newWriter(w http.ResponseWriter, r *http.Request, cfg *config.HTTPConfig) *Writer {
+	writer := &Writer{
+		ResponseWriter:   w,
+		omitMinInterval:  cfg.OmitMinInterval,
+		omitScrapeCounts: cfg.OmitScrapeCounts,
+	}
+	if acceptsGzip(r) {
+		writer.gzipMinSize = cfg.GzipMinSize
+	}
+	if cfg.ResponseSigningKey != "" {
+		writer.signingKey = []byte(cfg.ResponseSigningKey)
+	}
+	return writer
+}
+
+// acceptsGzip returns true if the Accept-Encoding header of a request allows
+// gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(encoding, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
 }
 
-// WriteError writes a bencode dict with a failure reason.
+// WriteError writes a bencode dict with a failure reason. The status is always
+// 200 OK, since some clients stop announcing altogether after any other
+// status, even for errors they could recover from. Temporary failures also
+// tell the client how many minutes to wait before retrying (BEP 31).
 func (w *Writer) WriteError(err error) error {
 	bencoder := bencode.NewEncoder(w)
+	return bencoder.Encode(errorDict(err))
+}
 
-	return bencoder.Encode(bencode.Dict{
+// errorDict returns the dictionary model of a failed request, which is shared
+// by every response format.
+func errorDict(err error) bencode.Dict {
+	dict := bencode.Dict{
 		"failure reason": err.Error(),
-	})
+	}
+	if retry, ok := err.(models.RetryError); ok {
+		dict["retry in"] = int64((retry.RetryIn + time.Minute - 1) / time.Minute)
+	}
+	return dict
 }
 
 // WriteAnnounce writes a bencode dict representation of an AnnounceResponse.
 func (w *Writer) WriteAnnounce(res *models.AnnounceResponse) error {
-	dict := bencode.Dict{
-		"complete":     res.Complete,
-		"incomplete":   res.Incomplete,
-		"interval":     res.Interval,
-		"min interval": res.MinInterval,
+	dict := announceDict(res, w.omitMinInterval, w.omitScrapeCounts)
+
+	if res.ExternalIP != nil {
+		if ip := res.ExternalIP.To4(); ip != nil {
+			dict["external ip"] = []byte(ip)
+		} else {
+			dict["external ip"] = []byte(res.ExternalIP)
+		}
 	}
 
 	if res.Compact {
@@ -48,71 +122,165 @@ func (w *Writer) WriteAnnounce(res *models.AnnounceResponse) error {
 			}
 		}
 	} else if res.IPv4Peers != nil || res.IPv6Peers != nil {
-		dict["peers"] = peersList(res.IPv4Peers, res.IPv6Peers)
+		dict["peers"] = peersList(res.IPv4Peers, res.IPv6Peers, res.NoPeerID)
 	}
 
-	bencoder := bencode.NewEncoder(w)
-	return bencoder.Encode(dict)
+	var buf bytes.Buffer
+	bencoder := bencode.NewEncoder(&buf)
+	if err := bencoder.Encode(dict); err != nil {
+		return err
+	}
+
+	body := buf.Bytes()
+	if w.signingKey != nil {
+		body = signResponse(body, w.signingKey)
+	}
+	return w.writeBody(body)
+}
+
+// announceDict returns the dictionary model of the fields of an
+// AnnounceResponse that every response format shares, leaving out the
+// external IP and the peers, whose encodings differ.
+func announceDict(res *models.AnnounceResponse, omitMinInterval, omitScrapeCounts bool) bencode.Dict {
+	dict := bencode.Dict{
+		"interval": int64(res.Interval / time.Second),
+	}
+
+	if !omitMinInterval {
+		dict["min interval"] = int64(res.MinInterval / time.Second)
+	}
+	if !omitScrapeCounts {
+		dict["complete"] = res.Complete
+		dict["incomplete"] = res.Incomplete
+	}
+
+	if res.TrackerID != "" {
+		dict["tracker id"] = res.TrackerID
+	}
+
+	if res.WarningMessage != "" {
+		dict["warning message"] = res.WarningMessage
+	}
+
+	// Uses the key of the BEP 9 extension handshake, so that clients which
+	// prefetch metadata can recognise it.
+	if res.MetadataSize > 0 {
+		dict["metadata_size"] = res.MetadataSize
+	}
+
+	return dict
+}
+
+// signatureKey is the key of the signature in signed announce responses.
+const signatureKey = "signature"
+
+// signResponse adds an HMAC-SHA256 of a bencoded dict, keyed by key, to the
+// dict under signatureKey. Dicts are not encoded canonically, so the signature
+// covers the exact bytes of the dict, and is inserted as its first entry:
+// clients verify it by removing that entry and computing the HMAC of the rest.
+func signResponse(dict, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(dict)
+	sig := mac.Sum(nil)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "d%d:%s%d:", len(signatureKey), signatureKey, len(sig))
+	buf.Write(sig)
+	buf.Write(dict[1:])
+	return buf.Bytes()
+}
+
+// writeBody writes a response body, gzipping it if it is large enough for the
+// overhead to be worthwhile and the client accepts it.
+func (w *Writer) writeBody(body []byte) error {
+	if w.gzipMinSize <= 0 || len(body) < w.gzipMinSize {
+		_, err := w.Write(body)
+		return err
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w.ResponseWriter)
+	if _, err := gz.Write(body); err != nil {
+		return err
+	}
+	return gz.Close()
 }
 
 // WriteScrape writes a bencode dict representation of a ScrapeResponse.
 func (w *Writer) WriteScrape(res *models.ScrapeResponse) error {
 	dict := bencode.Dict{
-		"files": filesDict(res.Files),
+		"files": filesDict(res),
 	}
 
 	bencoder := bencode.NewEncoder(w)
 	return bencoder.Encode(dict)
 }
 
+// compactPeers encodes peers as in BEP 23 and BEP 7: a 4-byte IPv4 or 16-byte
+// IPv6 address followed by a 2-byte port, for each peer.
 func compactPeers(ipv6 bool, peers models.PeerList) []byte {
 	var compactPeers bytes.Buffer
 
-	if ipv6 {
-		for _, peer := range peers {
-			compactPeers.Write(peer.IP)
-			compactPeers.Write([]byte{byte(peer.Port >> 8), byte(peer.Port & 0xff)})
-		}
-	} else {
-		for _, peer := range peers {
-			compactPeers.Write(peer.IP)
-			compactPeers.Write([]byte{byte(peer.Port >> 8), byte(peer.Port & 0xff)})
+	for _, peer := range peers {
+		if ipv6 {
+			compactPeers.Write(peer.IP.To16())
+		} else {
+			compactPeers.Write(peer.IP.To4())
 		}
+		compactPeers.Write([]byte{byte(peer.Port >> 8), byte(peer.Port & 0xff)})
 	}
 
 	return compactPeers.Bytes()
 }
 
-func peersList(ipv4s, ipv6s models.PeerList) (peers []bencode.Dict) {
-	for _, peer := range ipv4s {
-		peers = append(peers, peerDict(&peer, false))
+func peersList(ipv4s, ipv6s models.PeerList, noPeerID bool) (peers []bencode.Dict) {
+	for i := range ipv4s {
+		peers = append(peers, peerDict(&ipv4s[i], noPeerID))
 	}
-	for _, peer := range ipv6s {
-		peers = append(peers, peerDict(&peer, true))
+	for i := range ipv6s {
+		peers = append(peers, peerDict(&ipv6s[i], noPeerID))
 	}
 	return peers
 }
 
-func peerDict(peer *models.Peer, ipv6 bool) bencode.Dict {
-	return bencode.Dict{
-		"ip":      peer.IP.String(),
-		"peer id": peer.ID,
-		"port":    peer.Port,
+// peerDict returns the dictionary model of a peer. The peer ID is written as a
+// raw byte string, since it is not guaranteed to be valid UTF-8, and is
+// omitted entirely if noPeerID is set.
+func peerDict(peer *models.Peer, noPeerID bool) bencode.Dict {
+	d := bencode.Dict{
+		"ip":   peer.IP.String(),
+		"port": peer.Port,
 	}
+	if !noPeerID {
+		d["peer id"] = peer.ID
+	}
+	return d
 }
 
-func filesDict(torrents []*models.Torrent) bencode.Dict {
+func filesDict(res *models.ScrapeResponse) bencode.Dict {
 	d := bencode.NewDict()
-	for _, torrent := range torrents {
-		d[torrent.Infohash] = torrentDict(torrent)
+	for _, torrent := range res.Files {
+		d[torrent.Infohash] = torrentDict(res, torrent)
 	}
 	return d
 }
 
-func torrentDict(torrent *models.Torrent) bencode.Dict {
-	return bencode.Dict{
-		"complete":   torrent.Seeders.Len(),
-		"incomplete": torrent.Leechers.Len(),
-		"downloaded": torrent.Snatches,
+func torrentDict(res *models.ScrapeResponse, torrent *models.Torrent) bencode.Dict {
+	d := bencode.Dict{
+		"complete":   res.Complete(torrent),
+		"incomplete": res.Incomplete(torrent),
+		"downloaded": res.Downloaded(torrent),
+	}
+
+	// Only private trackers estimate download rates and total transfers, so
+	// avoid sending the extension fields when there is nothing to report.
+	if torrent.DownloadRate > 0 {
+		d["download rate"] = int64(torrent.DownloadRate)
 	}
+	if torrent.TotalUploaded > 0 || torrent.TotalDownloaded > 0 {
+		d["total uploaded"] = torrent.TotalUploaded
+		d["total downloaded"] = torrent.TotalDownloaded
+	}
+
+	return d
 }
@@ -0,0 +1,80 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package stats
+
+import (
+	"container/list"
+	"encoding/hex"
+	"sort"
+)
+
+// hotTorrentsReported is the number of torrents reported in HotTorrents.
+const hotTorrentsReported = 10
+
+// TorrentCount is the number of announces received for a torrent.
+type TorrentCount struct {
+	Infohash  string
+	Announces uint64
+}
+
+type byAnnounces []TorrentCount
+
+func (c byAnnounces) Len() int           { return len(c) }
+func (c byAnnounces) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byAnnounces) Less(i, j int) bool { return c[i].Announces > c[j].Announces }
+
+// hotTorrents counts announces per torrent for a bounded number of torrents,
+// during windows that are ended by calling rotate. When full, the least
+// recently announced torrent is forgotten, so torrents that are busy right now
+// remain tracked. It is only used by the stats goroutine, so it is not
+// thread-safe.
+type hotTorrents struct {
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+func newHotTorrents(capacity int) *hotTorrents {
+	return &hotTorrents{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (h *hotTorrents) record(infohash string) {
+	if elem, exists := h.entries[infohash]; exists {
+		elem.Value.(*TorrentCount).Announces++
+		h.order.MoveToFront(elem)
+		return
+	}
+
+	if h.order.Len() >= h.capacity {
+		oldest := h.order.Back()
+		delete(h.entries, oldest.Value.(*TorrentCount).Infohash)
+		h.order.Remove(oldest)
+	}
+	h.entries[infohash] = h.order.PushFront(&TorrentCount{Infohash: infohash, Announces: 1})
+}
+
+// rotate ends the current window, returning the n tracked torrents with the
+// most announces during it, with their infohashes hex-encoded.
+func (h *hotTorrents) rotate(n int) []TorrentCount {
+	counts := make([]TorrentCount, 0, h.order.Len())
+	for elem := h.order.Front(); elem != nil; elem = elem.Next() {
+		counts = append(counts, *elem.Value.(*TorrentCount))
+	}
+	h.entries = make(map[string]*list.Element)
+	h.order.Init()
+
+	sort.Sort(byAnnounces(counts))
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	for i := range counts {
+		counts[i].Infohash = hex.EncodeToString([]byte(counts[i].Infohash))
+	}
+	return counts
+}
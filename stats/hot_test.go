@@ -0,0 +1,41 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package stats
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHotTorrents(t *testing.T) {
+	h := newHotTorrents(2)
+
+	h.record("\x01")
+	h.record("\x01")
+	h.record("\x02")
+	h.record("\x02")
+	h.record("\x02")
+
+	// The least recently announced torrent is forgotten.
+	h.record("\x03")
+
+	expected := []TorrentCount{{"02", 3}, {"03", 1}}
+	if got := h.rotate(10); !reflect.DeepEqual(got, expected) {
+		t.Errorf("\ngot:    %v\nwanted: %v", got, expected)
+	}
+
+	// Only the announces of the current window are counted.
+	h.record("\x03")
+	h.record("\x01")
+	h.record("\x01")
+
+	expected = []TorrentCount{{"01", 2}}
+	if got := h.rotate(1); !reflect.DeepEqual(got, expected) {
+		t.Errorf("\ngot:    %v\nwanted: %v", got, expected)
+	}
+	if got := h.rotate(10); len(got) != 0 {
+		t.Errorf("expected an empty window, got %v", got)
+	}
+}
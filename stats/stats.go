@@ -18,25 +18,36 @@ import (
 const (
 	Announce = iota
 	Scrape
+	SuspiciousAnnounce
+	SwarmAnomaly
+	CorruptReported
+	DedupedAnnounce
 
 	Completed
 	NewLeech
 	DeletedLeech
 	ReapedLeech
+	EvictedLeech
 	NewSeed
 	DeletedSeed
 	ReapedSeed
+	EvictedSeed
 
 	NewTorrent
 	DeletedTorrent
 	ReapedTorrent
 
+	NewUser
+	DeletedUser
+
 	AcceptedConnection
 	ClosedConnection
 
 	HandledRequest
 	ErroredRequest
 	ClientError
+	RejectedClient
+	InvalidIP
 
 	ResponseTime
 )
@@ -51,6 +62,7 @@ type PeerClassStats struct {
 	Joined  uint64 // Peers that announced.
 	Left    uint64 // Peers that paused or stopped.
 	Reaped  uint64 // Peers cleaned up after inactivity.
+	Evicted uint64 // Peers removed to make room in a full swarm.
 }
 
 type PeerStats struct {
@@ -60,6 +72,32 @@ type PeerStats struct {
 	Completed uint64         // Number of transitions from leech to seed.
 }
 
+// PeerCountHistogram counts announces by the number of peers they were given.
+type PeerCountHistogram struct {
+	None     uint64 `json:"0"`
+	UpTo10   uint64 `json:"1-10"`
+	UpTo25   uint64 `json:"11-25"`
+	UpTo50   uint64 `json:"26-50"`
+	Over50   uint64 `json:"51+"`
+	Returned uint64 // Total number of peers returned.
+}
+
+func (h *PeerCountHistogram) record(count int) {
+	switch {
+	case count == 0:
+		h.None++
+	case count <= 10:
+		h.UpTo10++
+	case count <= 25:
+		h.UpTo25++
+	case count <= 50:
+		h.UpTo50++
+	default:
+		h.Over50++
+	}
+	h.Returned += uint64(count)
+}
+
 type PercentileTimes struct {
 	P50 *faststats.Percentile
 	P90 *faststats.Percentile
@@ -78,16 +116,32 @@ type Stats struct {
 	RequestsHandled uint64 `json:"Requests.Handled"`
 	RequestsErrored uint64 `json:"Requests.Errored"`
 	ClientErrors    uint64 `json:"Requests.Bad"`
+	RejectedClients uint64 `json:"Requests.RejectedClients"`
+	InvalidIPs      uint64 `json:"Requests.InvalidIPs"`
 	ResponseTime    PercentileTimes
 
-	Announces uint64 `json:"Tracker.Announces"`
-	Scrapes   uint64 `json:"Tracker.Scrapes"`
+	Announces           uint64 `json:"Tracker.Announces"`
+	Scrapes             uint64 `json:"Tracker.Scrapes"`
+	SuspiciousAnnounces uint64 `json:"Tracker.SuspiciousAnnounces"`
+	SwarmAnomalies      uint64 `json:"Tracker.SwarmAnomalies"`
+	CorruptReports      uint64 `json:"Tracker.CorruptReports"`
+	DedupedAnnounces    uint64 `json:"Tracker.DedupedAnnounces"`
+
+	PeersReturned PeerCountHistogram `json:"Tracker.PeersReturned"`
 
 	TorrentsSize    uint64 `json:"Torrents.Size"`
 	TorrentsAdded   uint64 `json:"Torrents.Added"`
 	TorrentsRemoved uint64 `json:"Torrents.Removed"`
 	TorrentsReaped  uint64 `json:"Torrents.Reaped"`
 
+	UsersSize    uint64 `json:"Users.Size"`
+	UsersAdded   uint64 `json:"Users.Added"`
+	UsersRemoved uint64 `json:"Users.Removed"`
+
+	// HotTorrents lists the torrents with the most announces during the last
+	// completed HotTorrentWindow.
+	HotTorrents []TorrentCount `json:"Torrents.Hot"`
+
 	IPv4Peers PeerStats `json:"Peers.IPv4"`
 	IPv6Peers PeerStats `json:"Peers.IPv6"`
 
@@ -97,7 +151,12 @@ type Stats struct {
 	ipv4PeerEvents     chan int
 	ipv6PeerEvents     chan int
 	responseTimeEvents chan time.Duration
+	peerCountEvents    chan int
+	hotTorrentEvents   chan string
 	recordMemStats     <-chan time.Time
+	reportHotTorrents  <-chan time.Time
+
+	hot *hotTorrents
 
 	flattened flatjson.Map
 }
@@ -112,6 +171,7 @@ func New(cfg config.StatsConfig) *Stats {
 		ipv4PeerEvents:     make(chan int, cfg.BufferSize),
 		ipv6PeerEvents:     make(chan int, cfg.BufferSize),
 		responseTimeEvents: make(chan time.Duration, cfg.BufferSize),
+		peerCountEvents:    make(chan int, cfg.BufferSize),
 
 		ResponseTime: PercentileTimes{
 			P50: faststats.NewPercentile(0.5),
@@ -120,6 +180,12 @@ func New(cfg config.StatsConfig) *Stats {
 		},
 	}
 
+	if cfg.HotTorrentTracking > 0 && cfg.HotTorrentWindow.Duration > 0 {
+		s.hot = newHotTorrents(cfg.HotTorrentTracking)
+		s.hotTorrentEvents = make(chan string, cfg.BufferSize)
+		s.reportHotTorrents = time.NewTicker(cfg.HotTorrentWindow.Duration).C
+	}
+
 	if cfg.IncludeMem {
 		s.MemStatsWrapper = NewMemStatsWrapper(cfg.VerboseMem)
 		s.recordMemStats = time.NewTicker(cfg.MemUpdateInterval.Duration).C
@@ -154,6 +220,19 @@ func (s *Stats) RecordPeerEvent(event int, ipv6 bool) {
 	}
 }
 
+// RecordHotTorrent counts an announce towards a torrent's place among the
+// HotTorrents. It does nothing unless hot torrent tracking is enabled.
+func (s *Stats) RecordHotTorrent(infohash string) {
+	if s.hot != nil {
+		s.hotTorrentEvents <- infohash
+	}
+}
+
+// RecordPeersReturned counts the number of peers returned by an announce.
+func (s *Stats) RecordPeersReturned(count int) {
+	s.peerCountEvents <- count
+}
+
 func (s *Stats) RecordTiming(event int, duration time.Duration) {
 	switch event {
 	case ResponseTime:
@@ -175,12 +254,21 @@ func (s *Stats) handleEvents() {
 		case event := <-s.ipv6PeerEvents:
 			s.handlePeerEvent(&s.IPv6Peers, event)
 
+		case infohash := <-s.hotTorrentEvents:
+			s.hot.record(infohash)
+
+		case <-s.reportHotTorrents:
+			s.HotTorrents = s.hot.rotate(hotTorrentsReported)
+
 		case duration := <-s.responseTimeEvents:
 			f := float64(duration) / float64(time.Millisecond)
 			s.ResponseTime.P50.AddSample(f)
 			s.ResponseTime.P90.AddSample(f)
 			s.ResponseTime.P95.AddSample(f)
 
+		case count := <-s.peerCountEvents:
+			s.PeersReturned.record(count)
+
 		case <-s.recordMemStats:
 			s.MemStatsWrapper.Update()
 		}
@@ -195,6 +283,18 @@ func (s *Stats) handleEvent(event int) {
 	case Scrape:
 		s.Scrapes++
 
+	case SuspiciousAnnounce:
+		s.SuspiciousAnnounces++
+
+	case SwarmAnomaly:
+		s.SwarmAnomalies++
+
+	case CorruptReported:
+		s.CorruptReports++
+
+	case DedupedAnnounce:
+		s.DedupedAnnounces++
+
 	case NewTorrent:
 		s.TorrentsAdded++
 		s.TorrentsSize++
@@ -207,6 +307,14 @@ func (s *Stats) handleEvent(event int) {
 		s.TorrentsReaped++
 		s.TorrentsSize--
 
+	case NewUser:
+		s.UsersAdded++
+		s.UsersSize++
+
+	case DeletedUser:
+		s.UsersRemoved++
+		s.UsersSize--
+
 	case AcceptedConnection:
 		s.ConnectionsAccepted++
 		s.OpenConnections++
@@ -223,6 +331,12 @@ func (s *Stats) handleEvent(event int) {
 	case ErroredRequest:
 		s.RequestsErrored++
 
+	case RejectedClient:
+		s.RejectedClients++
+
+	case InvalidIP:
+		s.InvalidIPs++
+
 	default:
 		panic("stats: RecordEvent called with an unknown event")
 	}
@@ -246,6 +360,10 @@ func (s *Stats) handlePeerEvent(ps *PeerStats, event int) {
 		ps.Reaped++
 		ps.Current--
 
+	case EvictedLeech:
+		ps.Evicted++
+		ps.Current--
+
 	case NewSeed:
 		ps.Seeds.Joined++
 		ps.Seeds.Current++
@@ -264,6 +382,12 @@ func (s *Stats) handlePeerEvent(ps *PeerStats, event int) {
 		ps.Reaped++
 		ps.Current--
 
+	case EvictedSeed:
+		ps.Seeds.Evicted++
+		ps.Seeds.Current--
+		ps.Evicted++
+		ps.Current--
+
 	default:
 		panic("stats: RecordPeerEvent called with an unknown event")
 	}
@@ -279,6 +403,18 @@ func RecordPeerEvent(event int, ipv6 bool) {
 	DefaultStats.RecordPeerEvent(event, ipv6)
 }
 
+// RecordHotTorrent broadcasts an announce for a torrent to the default stats
+// queue.
+func RecordHotTorrent(infohash string) {
+	DefaultStats.RecordHotTorrent(infohash)
+}
+
+// RecordPeersReturned broadcasts the number of peers returned by an announce
+// to the default stats queue.
+func RecordPeersReturned(count int) {
+	DefaultStats.RecordPeersReturned(count)
+}
+
 // RecordTiming broadcasts a timing event to the default stats queue.
 func RecordTiming(event int, duration time.Duration) {
 	DefaultStats.RecordTiming(event, duration)
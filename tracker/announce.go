@@ -5,19 +5,89 @@
 package tracker
 
 import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/chihaya/chihaya/backend"
+	"github.com/chihaya/chihaya/config"
 	"github.com/chihaya/chihaya/stats"
 	"github.com/chihaya/chihaya/tracker/models"
 )
 
 // HandleAnnounce encapsulates all of the logic of handling a BitTorrent
-// client's Announce without being coupled to any transport protocol.
-func (tkr *Tracker) HandleAnnounce(ann *models.Announce, w Writer) (err error) {
+// client's Announce without being coupled to any transport protocol. The
+// announce is passed through the tracker's AnnounceMiddleware first. Errors
+// caused by the client are audited and written using w.WriteError rather than
+// returned.
+func (tkr *Tracker) HandleAnnounce(ann *models.Announce, w Writer) error {
+	if err := tkr.begin(); err != nil {
+		return err
+	}
+	defer tkr.end()
+
+	err := tkr.announceChain()(ann, w)
+	switch err.(type) {
+	case models.ClientError, models.NotFoundError:
+		tkr.auditRejection(ann, err)
+	}
+	return handleError(err, w)
+}
+
+func (tkr *Tracker) handleAnnounce(ann *models.Announce, w Writer) (err error) {
+	if !ann.NumWantProvided {
+		ann.NumWant = tkr.Config.NumWantFallback
+	}
+	if max := tkr.Config.MaxNumWant; max > 0 && ann.NumWant > max {
+		ann.NumWant = max
+	}
+
+	if err = checkIPs(ann); err != nil {
+		return err
+	}
+
+	// WebRTC clients are given JSON responses, so compactness does not apply.
+	if tkr.Config.CompactOnly && tkr.Config.RejectNonCompact && !ann.Compact && !ann.WebRTC {
+		return models.ErrCompactRequired
+	}
+
+	// Malformed infohashes must never reach the storage, where they would
+	// create junk torrents in public mode.
+	if len(ann.Infohash) != 20 {
+		return models.ErrBadRequest
+	}
+
+	if tkr.limiter != nil && !tkr.limiter.Allow(rateLimitKey(ann), time.Now()) {
+		return models.ErrAnnounceTooFrequent
+	}
+
+	if clientBlacklisted(ann.ClientID(), tkr.Config.ClientBlacklist) {
+		stats.RecordEvent(stats.RejectedClient)
+		return models.ErrClientBlacklisted
+	}
+
 	if tkr.Config.ClientWhitelistEnabled {
 		if err = tkr.ClientApproved(ann.ClientID()); err != nil {
 			return err
 		}
 	}
 
+	// Clients only echo a tracker ID once they have been given one, so an
+	// empty ID is always accepted.
+	if tkr.Config.EnforceTrackerID && ann.TrackerID != "" && ann.TrackerID != tkr.ID {
+		return models.ErrInvalidTrackerID
+	}
+
+	if err = tkr.checkInfohash(ann.Infohash); err != nil {
+		return err
+	}
+	ann.Infohash = tkr.LinkedTorrent(ann.Infohash)
+	stats.RecordHotTorrent(ann.Infohash)
+
 	var user *models.User
 	if tkr.Config.PrivateEnabled {
 		if user, err = tkr.FindUser(ann.Passkey); err != nil {
@@ -40,11 +110,40 @@ func (tkr *Tracker) HandleAnnounce(ann *models.Announce, w Writer) (err error) {
 		return err
 	}
 
+	if tkr.Config.PrivateEnabled && tkr.Config.EnforceTorrentACLs && !torrent.UserAllowed(user) {
+		return models.ErrUnauthorizedTorrent
+	}
+
+	// Retried announces are answered from the cache before they could be
+	// refused for arriving too soon.
+	dedupKey, dedupable := newDedupKey(ann)
+	if tkr.dedup != nil && dedupable {
+		if res, exists := tkr.dedup.Get(dedupKey, time.Now()); exists {
+			stats.RecordEvent(stats.DedupedAnnounce)
+			return w.WriteAnnounce(res)
+		}
+	}
+
+	if tkr.Config.EnforceMinInterval && announcedTooRecently(ann, torrent, time.Now()) {
+		return models.ErrAnnounceTooFrequent
+	}
+
+	if tkr.Config.PrivateEnabled && tkr.Config.MinRatio > 0 && ann.Left > 0 {
+		ann.NumWant = ratioLimitedNumWant(ann.Config, user, ann.NumWant)
+	}
+
 	ann.BuildPeer(user, torrent)
 	var delta *models.AnnounceDelta
 
 	if tkr.Config.PrivateEnabled {
 		delta = newAnnounceDelta(ann, torrent)
+		if delta.Suspicious {
+			glog.Warningf("Clamped suspicious announce deltas from user %d on %x", user.ID, torrent.Infohash)
+			stats.RecordEvent(stats.SuspiciousAnnounce)
+		}
+		if delta.Corrupt > 0 {
+			stats.RecordEvent(stats.CorruptReported)
+		}
 	}
 
 	created, err := tkr.updateSwarm(ann)
@@ -56,13 +155,69 @@ func (tkr *Tracker) HandleAnnounce(ann *models.Announce, w Writer) (err error) {
 	if err != nil {
 		return err
 	}
+	if tkr.dedup != nil && !dedupable {
+		tkr.dedup.Forget(announceKey(ann), ann.Infohash)
+	}
+	tkr.checkEmptied(torrent.Infohash)
+
+	var snatch *models.Snatch
+	if snatched {
+		snatch = newSnatch(ann, time.Now())
+	}
 
 	if tkr.Config.PrivateEnabled {
 		delta.Created = created
 		delta.Snatched = snatched
-		if err = tkr.Backend.RecordAnnounce(delta); err != nil {
+
+		// The announce is only recorded by the backend if the torrent is still
+		// tracked once the swarm has been updated.
+		if _, err = tkr.FindTorrent(torrent.Infohash); err != nil {
+			return err
+		}
+
+		// Only backend writes are made inside the transaction, since the
+		// storage cannot be rolled back if it fails.
+		err = tkr.callBackend(func() error {
+			return tkr.Backend.Transaction(func(conn backend.Conn) error {
+				if err := conn.RecordAnnounce(delta); err != nil {
+					return err
+				}
+
+				if delta.Uploaded > 0 {
+					if err := conn.IncrementUserUpload(user.Passkey, delta.Uploaded); err != nil {
+						return err
+					}
+				}
+				if delta.Downloaded > 0 {
+					if err := conn.IncrementUserDownload(user.Passkey, delta.Downloaded); err != nil {
+						return err
+					}
+				}
+
+				if snatched {
+					return conn.RecordSnatch(snatch)
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		if err = tkr.RecordTorrentTransfer(torrent.Infohash, delta.RawUploaded, delta.RawDownloaded); err != nil {
+			return err
+		}
+
+		// Every peer reports once per announce interval, so the rate must be
+		// averaged over at least that long to account for the whole swarm.
+		err = tkr.RecordTorrentDownload(torrent.Infohash, delta.RawDownloaded, tkr.Config.Announce.Duration)
+		if err != nil {
 			return err
 		}
+
+		// Keep the stored totals current for ratio checks on later announces.
+		tkr.IncrementUserUpload(user.Passkey, delta.Uploaded)
+		tkr.IncrementUserDownload(user.Passkey, delta.Downloaded)
 	} else if tkr.Config.PurgeInactiveTorrents && torrent.PeerCount() == 0 {
 		// Rather than deleting the torrent explicitly, let the tracker driver
 		// ensure there are no race conditions.
@@ -70,23 +225,220 @@ func (tkr *Tracker) HandleAnnounce(ann *models.Announce, w Writer) (err error) {
 		stats.RecordEvent(stats.DeletedTorrent)
 	}
 
-	return w.WriteAnnounce(newAnnounceResponse(ann))
+	if snatched {
+		tkr.queueSnatch(snatch)
+	}
+
+	// The torrent may already have been purged if the swarm emptied, in which
+	// case its metadata size is no longer known.
+	metadataSize, _ := tkr.TorrentMetadataSize(torrent.Infohash)
+	if tkr.Config.LearnMetadataSize && metadataSize == 0 && validMetadataSize(ann.MetadataSize) {
+		metadataSize, _ = tkr.RecordTorrentMetadataSize(torrent.Infohash, metadataReporter(ann), ann.MetadataSize)
+	}
+
+	res := tkr.newAnnounceResponse(ann, metadataSize)
+	if tkr.dedup != nil && dedupable {
+		tkr.dedup.Put(dedupKey, res, time.Now())
+	}
+	return w.WriteAnnounce(res)
+}
+
+// maxMetadataSize is the largest metadata size accepted from clients, well
+// beyond that of any real torrent.
+const maxMetadataSize = 32 << 20
+
+// metadataReporter identifies the peer reporting a metadata size by its
+// address rather than its peer ID, which a client is free to change.
+func metadataReporter(ann *models.Announce) string {
+	if ann.HasIPv4() {
+		return ann.IPv4.String()
+	}
+	return ann.IPv6.String()
+}
+
+// validMetadataSize returns true if a metadata size reported by a client is
+// plausible.
+func validMetadataSize(size int) bool {
+	return size > 0 && size <= maxMetadataSize
+}
+
+// privateNets are the address ranges only reachable within a local network.
+var privateNets = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipnet
+}
+
+// checkIPs drops the addresses of an announce that other peers could never
+// connect to, and returns ErrInvalidIP if none are left.
+func checkIPs(ann *models.Announce) error {
+	allowPrivate := ann.Config.AllowPrivateIPs
+
+	dropped := false
+	if ann.IPv4 != nil && !reachableIP(ann.IPv4, allowPrivate) {
+		ann.IPv4 = nil
+		dropped = true
+	}
+	if ann.IPv6 != nil && !reachableIP(ann.IPv6, allowPrivate) {
+		ann.IPv6 = nil
+		dropped = true
+	}
+
+	if dropped {
+		stats.RecordEvent(stats.InvalidIP)
+		if ann.IPv4 == nil && ann.IPv6 == nil {
+			return models.ErrInvalidIP
+		}
+	}
+	return nil
+}
+
+// reachableIP returns false for unspecified, loopback, link-local and
+// multicast addresses, as well as private addresses unless they are allowed.
+// Loopback addresses are never reachable by other peers, even on private
+// networks.
+func reachableIP(ip net.IP, allowPrivate bool) bool {
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	if allowPrivate {
+		return true
+	}
+	for _, ipnet := range privateNets {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// announceKey returns the key used to identify the announcing peer before its
+// Peer has been built.
+func announceKey(ann *models.Announce) models.PeerKey {
+	if ann.HasIPv4() {
+		return models.NewPeerKey(ann.PeerID, ann.IPv4)
+	}
+	return models.NewPeerKey(ann.PeerID, ann.IPv6)
+}
+
+// rateLimitKey returns the key of the announcing peer's rate limit bucket.
+// Clients use the same peer ID for every torrent, so each torrent has its
+// own bucket.
+func rateLimitKey(ann *models.Announce) string {
+	return ann.Infohash + string(announceKey(ann))
+}
+
+// announcedTooRecently returns true if the announcing peer is already in the
+// swarm and last announced less than MinAnnounce ago. Stopped and completed
+// events are always allowed, so that swarms stay accurate.
+func announcedTooRecently(ann *models.Announce, t *models.Torrent, now time.Time) bool {
+	if ann.Event == "stopped" || ann.Event == "completed" {
+		return false
+	}
+
+	pk := announceKey(ann)
+	peer, exists := t.Seeders.LookUp(pk)
+	if !exists {
+		peer, exists = t.Leechers.LookUp(pk)
+	}
+
+	return exists && now.Sub(time.Unix(peer.LastAnnounce, 0)) < ann.Config.MinAnnounce.Duration
+}
+
+// warningMessage returns the warning for an announce: a ratio warning for a
+// user whose ratio is below WarnRatio, followed by AnnounceWarning if set. Like
+// ratioLimitedNumWant, users that have downloaded less than RatioGraceBytes are
+// exempt from the ratio warning.
+func warningMessage(ann *models.Announce) string {
+	var warnings []string
+
+	if cfg := ann.Config; cfg.WarnRatio > 0 && ann.User != nil {
+		ratio, ok := ann.User.Ratio()
+		if ok && ann.User.Downloaded >= cfg.RatioGraceBytes && ratio < cfg.WarnRatio {
+			warnings = append(warnings, fmt.Sprintf("your ratio of %.2f is below the required %.2f", ratio, cfg.WarnRatio))
+		}
+	}
+
+	if ann.Config.AnnounceWarning != "" {
+		warnings = append(warnings, ann.Config.AnnounceWarning)
+	}
+
+	return strings.Join(warnings, "; ")
+}
+
+// ratioLimitedNumWant scales down the number of peers given to a user whose
+// ratio is below MinRatio, in proportion to how far below it they are. Users
+// that have downloaded less than RatioGraceBytes are exempt, and every user
+// wanting peers is given at least one.
+func ratioLimitedNumWant(cfg *config.Config, user *models.User, numWant int) int {
+	ratio, ok := user.Ratio()
+	if !ok || user.Downloaded < cfg.RatioGraceBytes || ratio >= cfg.MinRatio {
+		return numWant
+	}
+
+	scaled := int(float64(numWant) * ratio / cfg.MinRatio)
+	if scaled < 1 && numWant > 0 {
+		scaled = 1
+	}
+	return scaled
+}
+
+// newSnatch builds the Snatch record of an announce that completed a download.
+func newSnatch(ann *models.Announce, now time.Time) *models.Snatch {
+	snatch := &models.Snatch{
+		TorrentID: ann.Torrent.ID,
+		Infohash:  ann.Torrent.Infohash,
+		PeerID:    ann.PeerID,
+		IP:        ann.Peer.IP,
+		Time:      now,
+	}
+	if ann.User != nil {
+		snatch.UserID = ann.User.ID
+	}
+	return snatch
+}
+
+// clientBlacklisted returns true if a client ID matches any of the prefixes in
+// the blacklist.
+func clientBlacklisted(clientID string, blacklist []string) bool {
+	for _, prefix := range blacklist {
+		prefix = strings.TrimSuffix(strings.TrimPrefix(prefix, "-"), "*")
+		if prefix != "" && strings.HasPrefix(clientID, prefix) {
+			return true
+		}
+	}
+	return false
 }
 
 // Builds a partially populated AnnounceDelta, without the Snatched and Created
 // fields set.
 func newAnnounceDelta(ann *models.Announce, t *models.Torrent) *models.AnnounceDelta {
-	var oldUp, oldDown, rawDeltaUp, rawDeltaDown uint64
+	var oldUp, oldDown, oldCorrupt, rawDeltaUp, rawDeltaDown, deltaCorrupt uint64
 
-	switch {
-	case t.Seeders.Contains(ann.Peer.Key()):
-		oldPeer, _ := t.Seeders.LookUp(ann.Peer.Key())
-		oldUp = oldPeer.Uploaded
-		oldDown = oldPeer.Downloaded
-	case t.Leechers.Contains(ann.Peer.Key()):
-		oldPeer, _ := t.Leechers.LookUp(ann.Peer.Key())
+	oldPeer, exists := t.Seeders.LookUp(ann.Peer.Key())
+	if !exists {
+		oldPeer, exists = t.Leechers.LookUp(ann.Peer.Key())
+	}
+	if !exists {
+		// A peer that changed its IP address keeps its totals.
+		oldPeer, exists = t.Seeders.LookUpMoved(ann.Peer)
+	}
+	if !exists {
+		oldPeer, exists = t.Leechers.LookUpMoved(ann.Peer)
+	}
+	if exists {
 		oldUp = oldPeer.Uploaded
 		oldDown = oldPeer.Downloaded
+		oldCorrupt = oldPeer.Corrupt
 	}
 
 	// Restarting a torrent may cause a delta to be negative.
@@ -96,11 +448,28 @@ func newAnnounceDelta(ann *models.Announce, t *models.Torrent) *models.AnnounceD
 	if ann.Peer.Downloaded > oldDown {
 		rawDeltaDown = ann.Peer.Downloaded - oldDown
 	}
+	if ann.Peer.Corrupt > oldCorrupt {
+		deltaCorrupt = ann.Peer.Corrupt - oldCorrupt
+	}
+
+	// Deltas are reported by the client and trivially spoofed, so implausibly
+	// large ones are clamped.
+	var suspicious bool
+	if max := ann.Config.MaxBytesPerAnnounce; max > 0 {
+		if rawDeltaUp > max {
+			rawDeltaUp = max
+			suspicious = true
+		}
+		if rawDeltaDown > max {
+			rawDeltaDown = max
+			suspicious = true
+		}
+	}
 
 	uploaded := uint64(float64(rawDeltaUp) * ann.User.UpMultiplier * ann.Torrent.UpMultiplier)
 	downloaded := uint64(float64(rawDeltaDown) * ann.User.DownMultiplier * ann.Torrent.DownMultiplier)
 
-	if ann.Config.FreeleechEnabled {
+	if freeleech(ann, time.Now()) {
 		downloaded = 0
 	}
 
@@ -109,18 +478,66 @@ func newAnnounceDelta(ann *models.Announce, t *models.Torrent) *models.AnnounceD
 		Torrent: ann.Torrent,
 		User:    ann.User,
 
+		Suspicious: suspicious,
+
 		Uploaded:      uploaded,
 		RawUploaded:   rawDeltaUp,
 		Downloaded:    downloaded,
 		RawDownloaded: rawDeltaDown,
+
+		Corrupt: deltaCorrupt,
 	}
 }
 
+// freeleech returns true if an announce's downloads do not count against the
+// user's ratio, because freeleech is enabled globally, on the torrent, or for
+// the user.
+func freeleech(ann *models.Announce, now time.Time) bool {
+	return ann.Config.FreeleechEnabled || ann.Torrent.Freeleech || ann.User.FreeleechUntil > now.Unix()
+}
+
 // updateSwarm handles the changes to a torrent's swarm given an announce.
 func (tkr *Tracker) updateSwarm(ann *models.Announce) (created bool, err error) {
 	var createdv4, createdv6 bool
+
+	if ann.Torrent.SeedOnly && ann.Left != 0 {
+		err = models.ErrLeechingDisabled
+		return
+	}
+
 	tkr.TouchTorrent(ann.Torrent.Infohash)
 
+	if max := ann.Config.MaxPeersPerUser; max > 0 && ann.User != nil {
+		ids := make(map[string]bool)
+		ann.Torrent.Seeders.CollectUserPeerIDs(ann.User.ID, ids)
+		ann.Torrent.Leechers.CollectUserPeerIDs(ann.User.ID, ids)
+
+		if !ids[ann.PeerID] && len(ids) >= max {
+			err = models.ErrTooManyPeers
+			return
+		}
+	}
+
+	if max := ann.Config.MaxPeersPerIP; max > 0 {
+		if ann.HasIPv4() && ipFull(ann.Torrent, ann.PeerV4, max) ||
+			ann.HasIPv6() && ipFull(ann.Torrent, ann.PeerV6, max) {
+			err = models.ErrTooManyPeersFromIP
+			return
+		}
+	}
+
+	leeching := ann.Left != 0 && ann.Event != "stopped"
+	if tkr.leeches != nil && ann.User != nil && leeching &&
+		!tkr.leeches.Allow(ann.User.ID, ann.Infohash, ann.Config.MaxActiveLeechPerUser, time.Now()) {
+		err = models.ErrTooManyLeeches
+		return
+	}
+
+	if ann.Config.StrictStartedEvents && seederLeeching(ann) {
+		glog.Warningf("Seeder %x announced %d bytes left on %x", ann.PeerID, ann.Left, ann.Infohash)
+		stats.RecordEvent(stats.SwarmAnomaly)
+	}
+
 	if ann.HasIPv4() {
 		createdv4, err = tkr.updatePeer(ann, ann.PeerV4)
 		if err != nil {
@@ -134,48 +551,149 @@ func (tkr *Tracker) updateSwarm(ann *models.Announce) (created bool, err error)
 		}
 	}
 
+	// Leeches are only recorded once the peer is in the swarm, and expire
+	// once it would have been purged after missing two announces.
+	if tkr.leeches != nil && ann.User != nil {
+		if leeching {
+			ttl := 2 * maxAnnounceInterval(ann.Config, ann.Torrent)
+			tkr.leeches.Start(ann.User.ID, ann.Infohash, ann.PeerID, time.Now(), ttl)
+		} else {
+			tkr.leeches.Stop(ann.User.ID, ann.Infohash, ann.PeerID)
+		}
+	}
+
 	return createdv4 || createdv6, nil
 }
 
-func (tkr *Tracker) updatePeer(ann *models.Announce, peer *models.Peer) (created bool, err error) {
-	p, t := ann.Peer, ann.Torrent
+// ipFull returns true if a peer is new to a torrent's swarm, and its IP address
+// already has max peers in it.
+func ipFull(t *models.Torrent, p *models.Peer, max int) bool {
+	if t.Seeders.Contains(p.Key()) || t.Leechers.Contains(p.Key()) {
+		return false
+	}
+	return t.Seeders.CountIP(p.IP)+t.Leechers.CountIP(p.IP) >= max
+}
 
-	switch {
-	case t.Seeders.Contains(p.Key()):
-		err = tkr.PutSeeder(t.Infohash, p)
-		if err != nil {
+// seederLeeching returns true if a peer that is seeding a torrent claims to
+// have something left to download, which honest clients only do after losing
+// data.
+func seederLeeching(ann *models.Announce) bool {
+	if ann.Left == 0 {
+		return false
+	}
+
+	t := ann.Torrent
+	return ann.HasIPv4() && t.Seeders.Contains(ann.PeerV4.Key()) ||
+		ann.HasIPv6() && t.Seeders.Contains(ann.PeerV6.Key())
+}
+
+// updatePeer stores a peer, which stays a seeder or leecher if it is already
+// in the swarm, and is otherwise classified by how much it has left.
+func (tkr *Tracker) updatePeer(ann *models.Announce, p *models.Peer) (created bool, err error) {
+	t := ann.Torrent
+
+	if old, exists := t.Seeders.LookUp(p.Key()); exists {
+		p.UploadCapacityHint = uploadCapacityHint(&old, p)
+		p.Completed = old.Completed
+		return false, tkr.PutPeer(t.Infohash, p, true)
+	}
+	if old, exists := t.Leechers.LookUp(p.Key()); exists {
+		p.UploadCapacityHint = uploadCapacityHint(&old, p)
+		p.Completed = old.Completed
+		p.PartialSeed = p.PartialSeed || stillPartialSeed(ann, &old, p)
+		return false, tkr.PutPeer(t.Infohash, p, false)
+	}
+
+	if created, err = tkr.movePeer(t, p); created || err != nil {
+		return
+	}
+
+	if ann.Event != "" && ann.Event != "started" {
+		return false, models.ErrBadRequest
+	}
+
+	if max := ann.Config.MaxPeersPerTorrent; max > 0 && t.PeerCount() >= max {
+		if err = tkr.evictOldestPeer(t); err != nil {
 			return
 		}
+	}
 
-	case t.Leechers.Contains(p.Key()):
-		err = tkr.PutLeecher(t.Infohash, p)
-		if err != nil {
+	seeder := ann.Left == 0
+	if err = tkr.PutPeer(t.Infohash, p, seeder); err != nil {
+		return
+	}
+
+	if seeder {
+		stats.RecordPeerEvent(stats.NewSeed, p.HasIPv6())
+	} else {
+		stats.RecordPeerEvent(stats.NewLeech, p.HasIPv6())
+	}
+	return true, tkr.RecordTorrentChurn(t.Infohash, 1, 0)
+}
+
+// movePeer replaces the entry of a peer that changed its IP address, but kept
+// its peer ID and client key, with p. It returns false if there is none.
+func (tkr *Tracker) movePeer(t *models.Torrent, p *models.Peer) (moved bool, err error) {
+	if old, exists := t.Seeders.LookUpMoved(p); exists {
+		p.Completed = old.Completed
+		if err = tkr.DeleteSeeder(t.Infohash, &old); err != nil {
 			return
 		}
+		return true, tkr.PutPeer(t.Infohash, p, true)
+	}
 
-	default:
-		if ann.Event != "" && ann.Event != "started" {
-			err = models.ErrBadRequest
+	if old, exists := t.Leechers.LookUpMoved(p); exists {
+		p.Completed = old.Completed
+		if err = tkr.DeleteLeecher(t.Infohash, &old); err != nil {
 			return
 		}
+		return true, tkr.PutPeer(t.Infohash, p, false)
+	}
 
-		if ann.Left == 0 {
-			err = tkr.PutSeeder(t.Infohash, p)
-			if err != nil {
-				return
-			}
-			stats.RecordPeerEvent(stats.NewSeed, p.HasIPv6())
+	return false, nil
+}
 
-		} else {
-			err = tkr.PutLeecher(t.Infohash, p)
-			if err != nil {
-				return
-			}
-			stats.RecordPeerEvent(stats.NewLeech, p.HasIPv6())
+// stillPartialSeed returns true if a partial seed sent a regular announce
+// without making any progress. Partial seeds only send the paused event once,
+// and are treated as downloading again as soon as their amount left changes.
+func stillPartialSeed(ann *models.Announce, old, p *models.Peer) bool {
+	return old.PartialSeed && ann.Event == "" && p.Left == old.Left
+}
+
+// uploadCapacityHint estimates a peer's upload rate from the bytes it uploaded
+// since its previous announce. The previous estimate is kept if no time has
+// passed or the client restarted and reset its totals.
+func uploadCapacityHint(old, p *models.Peer) uint64 {
+	elapsed := p.LastAnnounce - old.LastAnnounce
+	if elapsed <= 0 || p.Uploaded < old.Uploaded {
+		return old.UploadCapacityHint
+	}
+	return (p.Uploaded - old.Uploaded) / uint64(elapsed)
+}
+
+// evictOldestPeer removes the peer that has gone the longest without
+// announcing from a torrent in order to make room for a new peer.
+func (tkr *Tracker) evictOldestPeer(t *models.Torrent) error {
+	seeder, seederExists := t.Seeders.Oldest()
+	leecher, leecherExists := t.Leechers.Oldest()
+
+	switch {
+	case seederExists && (!leecherExists || seeder.LastAnnounce <= leecher.LastAnnounce):
+		if err := tkr.DeleteSeeder(t.Infohash, &seeder); err != nil {
+			return err
+		}
+		stats.RecordPeerEvent(stats.EvictedSeed, seeder.HasIPv6())
+		return tkr.RecordTorrentChurn(t.Infohash, 0, 1)
+
+	case leecherExists:
+		if err := tkr.DeleteLeecher(t.Infohash, &leecher); err != nil {
+			return err
 		}
-		created = true
+		stats.RecordPeerEvent(stats.EvictedLeech, leecher.HasIPv6())
+		return tkr.RecordTorrentChurn(t.Infohash, 0, 1)
 	}
-	return
+
+	return nil
 }
 
 // handleEvent checks to see whether an announce has an event and if it does,
@@ -197,21 +715,26 @@ func (tkr *Tracker) handleEvent(ann *models.Announce) (snatched bool, err error)
 	}
 
 	if snatchedv4 || snatchedv6 {
+		// The announce shares the stored torrent, so this also updates
+		// ann.Torrent.Snatches.
 		err = tkr.IncrementTorrentSnatches(ann.Torrent.Infohash)
 		if err != nil {
 			return
 		}
-		ann.Torrent.Snatches++
 		return true, nil
 	}
 	return false, nil
 }
 
 func (tkr *Tracker) handlePeerEvent(ann *models.Announce, p *models.Peer) (snatched bool, err error) {
-	p, t := ann.Peer, ann.Torrent
+	t := ann.Torrent
 
 	switch {
-	case ann.Event == "stopped" || ann.Event == "paused":
+	case ann.Event == "paused":
+		// Paused peers are kept in the swarm, marked as paused by updateSwarm,
+		// so that resuming does not count as a new peer.
+
+	case ann.Event == "stopped":
 		// updateSwarm checks if the peer is active on the torrent,
 		// so one of these branches must be followed.
 		if t.Seeders.Contains(p.Key()) {
@@ -220,6 +743,8 @@ func (tkr *Tracker) handlePeerEvent(ann *models.Announce, p *models.Peer) (snatc
 				return
 			}
 			stats.RecordPeerEvent(stats.DeletedSeed, p.HasIPv6())
+			tkr.recordDeparture(t.Infohash, p)
+			err = tkr.RecordTorrentChurn(t.Infohash, 0, 1)
 
 		} else if t.Leechers.Contains(p.Key()) {
 			err = tkr.DeleteLeecher(t.Infohash, p)
@@ -227,11 +752,18 @@ func (tkr *Tracker) handlePeerEvent(ann *models.Announce, p *models.Peer) (snatc
 				return
 			}
 			stats.RecordPeerEvent(stats.DeletedLeech, p.HasIPv6())
+			tkr.recordDeparture(t.Infohash, p)
+			err = tkr.RecordTorrentChurn(t.Infohash, 0, 1)
 		}
 
 	case ann.Event == "completed":
-		v4seed := t.Seeders.Contains(p.Key())
-		v6seed := t.Seeders.Contains(p.Key())
+		if p.Completed {
+			// The client resent the event, e.g. after losing the response.
+			return
+		}
+
+		v4seed := ann.HasIPv4() && t.Seeders.Contains(ann.PeerV4.Key())
+		v6seed := ann.HasIPv6() && t.Seeders.Contains(ann.PeerV6.Key())
 
 		if t.Leechers.Contains(p.Key()) {
 			err = tkr.leecherFinished(t, p)
@@ -248,16 +780,27 @@ func (tkr *Tracker) handlePeerEvent(ann *models.Announce, p *models.Peer) (snatc
 	case t.Leechers.Contains(p.Key()) && ann.Left == 0:
 		// A leecher completed but the event was never received.
 		err = tkr.leecherFinished(t, p)
+		snatched = err == nil && ann.Config.CountImplicitCompletes
 	}
 
 	return
 }
 
-// leecherFinished moves a peer from the leeching pool to the seeder pool.
+// recordDeparture remembers a peer that left a swarm with a stopped event, if
+// recently departed peers are used to pad peer lists.
+func (tkr *Tracker) recordDeparture(infohash string, p *models.Peer) {
+	if tkr.departed != nil {
+		tkr.departed.Put(infohash, p, time.Now())
+	}
+}
+
+// leecherFinished moves a peer from the leeching pool to the seeder pool and
+// marks it as completed.
 func (tkr *Tracker) leecherFinished(t *models.Torrent, p *models.Peer) error {
 	if err := tkr.DeleteLeecher(t.Infohash, p); err != nil {
 		return err
 	}
+	p.Completed = true
 	if err := tkr.PutSeeder(t.Infohash, p); err != nil {
 		return err
 	}
@@ -265,36 +808,162 @@ func (tkr *Tracker) leecherFinished(t *models.Torrent, p *models.Peer) error {
 	return nil
 }
 
-func newAnnounceResponse(ann *models.Announce) *models.AnnounceResponse {
+func (tkr *Tracker) newAnnounceResponse(ann *models.Announce, metadataSize int) *models.AnnounceResponse {
 	seedCount := ann.Torrent.Seeders.Len()
 	leechCount := ann.Torrent.Leechers.Len()
 
 	res := &models.AnnounceResponse{
 		Complete:    seedCount,
 		Incomplete:  leechCount,
-		Interval:    ann.Config.Announce.Duration,
+		Interval:    announceInterval(ann.Config, ann.Torrent),
 		MinInterval: ann.Config.MinAnnounce.Duration,
-		Compact:     ann.Compact,
+		TrackerID:   tkr.ID,
+		Compact:     ann.Compact || ann.Config.CompactOnly,
+		NoPeerID:    ann.NoPeerID,
+
+		WarningMessage: warningMessage(ann),
+		MetadataSize:   metadataSize,
+	}
+
+	if ann.HasIPv4() {
+		res.ExternalIP = ann.IPv4
+	} else {
+		res.ExternalIP = ann.IPv6
 	}
 
 	if ann.NumWant > 0 && ann.Event != "stopped" && ann.Event != "paused" {
-		res.IPv4Peers, res.IPv6Peers = getPeers(ann)
+		fixedV4, fixedV6 := tkr.selectFixedPeers(ann, ann.NumWant)
+		wanted := ann.NumWant - len(fixedV4) - len(fixedV6)
+
+		res.IPv4Peers, res.IPv6Peers = fixedV4, fixedV6
+		if wanted > 0 {
+			// Dual-stacked peers may be selected twice, once per address,
+			// so enough are selected to make up for their duplicates.
+			if ann.Config.DedupeDualStack {
+				wanted *= 2
+			}
+			ipv4s, ipv6s := tkr.PeerSelector.SelectPeers(ann, ann.Peer, ann.Torrent, wanted)
+			res.IPv4Peers = append(res.IPv4Peers, ipv4s...)
+			res.IPv6Peers = append(res.IPv6Peers, ipv6s...)
+		}
+		if ann.Config.DedupeDualStack {
+			res.IPv4Peers, res.IPv6Peers = dedupeDualStack(ann, res.IPv4Peers, res.IPv6Peers)
+		}
+
+		// Sparse peer lists of leechers are padded with peers that have just
+		// left, which may well come back.
+		if tkr.departed != nil && !ann.Peer.Seeding() {
+			res.IPv4Peers, res.IPv6Peers = tkr.departedPeers(ann, res.IPv4Peers, res.IPv6Peers)
+		}
+
+		if ann.Config.DedupeDualStack {
+			res.IPv4Peers, res.IPv6Peers = dedupeDualStack(ann, res.IPv4Peers, res.IPv6Peers)
+		}
+
+		stats.RecordPeersReturned(len(res.IPv4Peers) + len(res.IPv6Peers))
 	}
 
 	return res
 }
 
-// getPeers returns lists IPv4 and IPv6 peers on a given torrent sized according
-// to the wanted parameter.
-func getPeers(ann *models.Announce) (ipv4s, ipv6s models.PeerList) {
+// dedupeDualStack removes the duplicate entries of dual-stacked peers that
+// appear in both lists, keeping the entry of the family the announcer uses,
+// and then keeps up to NumWant of the rest.
+func dedupeDualStack(ann *models.Announce, ipv4s, ipv6s models.PeerList) (models.PeerList, models.PeerList) {
+	if len(ipv4s) != 0 && len(ipv6s) != 0 {
+		if ann.HasIPv6() {
+			ipv4s = withoutPeerIDs(ipv4s, ipv6s)
+		} else {
+			ipv6s = withoutPeerIDs(ipv6s, ipv4s)
+		}
+	}
+	return truncatePeers(ipv4s, ipv6s, ann.NumWant)
+}
+
+// dualStackKey identifies the entries of a dual-stacked peer.
+type dualStackKey struct {
+	id     string
+	userID uint64
+}
+
+// withoutPeerIDs returns the peers of a list that do not share both their ID
+// and user with a peer in another. Peers without an ID, such as fixed peers,
+// are never considered duplicates.
+func withoutPeerIDs(peers, other models.PeerList) models.PeerList {
+	keys := make(map[dualStackKey]bool, len(other))
+	for _, peer := range other {
+		if peer.ID != "" {
+			keys[dualStackKey{peer.ID, peer.UserID}] = true
+		}
+	}
+
+	list := models.PeerList{}
+	for _, peer := range peers {
+		if peer.ID == "" || !keys[dualStackKey{peer.ID, peer.UserID}] {
+			list = append(list, peer)
+		}
+	}
+	return list
+}
+
+// selectFixedPeers returns up to wanted of the configured fixed peers that the
+// announcer is able to connect to. Fixed peers are not part of any swarm, so
+// they are never counted or reaped.
+func (tkr *Tracker) selectFixedPeers(ann *models.Announce, wanted int) (ipv4s, ipv6s models.PeerList) {
 	ipv4s, ipv6s = models.PeerList{}, models.PeerList{}
+	if ann.WebRTC {
+		return
+	}
 
-	if ann.Left == 0 {
-		// If they're seeding, give them only leechers.
-		return ann.Torrent.Leechers.AppendPeers(ipv4s, ipv6s, ann, ann.NumWant)
+	for _, peer := range tkr.fixedPeers {
+		if len(ipv4s)+len(ipv6s) >= wanted {
+			break
+		}
+
+		if peer.HasIPv6() {
+			if ann.GetsIPv6Peers() {
+				ipv6s = append(ipv6s, peer)
+			}
+		} else if ann.GetsIPv4Peers() {
+			ipv4s = append(ipv4s, peer)
+		}
 	}
+	return
+}
 
-	// If they're leeching, prioritize giving them seeders.
-	ipv4s, ipv6s = ann.Torrent.Seeders.AppendPeers(ipv4s, ipv6s, ann, ann.NumWant)
-	return ann.Torrent.Leechers.AppendPeers(ipv4s, ipv6s, ann, ann.NumWant-len(ipv4s)-len(ipv6s))
+// announceInterval returns the announce interval of a torrent, or else that of
+// its category, or else the configured one, plus a random jitter in
+// [0, AnnounceJitter), which spreads out reannounces from peers that joined at
+// the same time. A torrent's or category's interval is never shorter than the
+// min interval, which is never jittered.
+func announceInterval(cfg *config.Config, t *models.Torrent) time.Duration {
+	interval := baseAnnounceInterval(cfg, t)
+	if jitter := cfg.AnnounceJitter.Duration; jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return interval
+}
+
+// maxAnnounceInterval returns the longest interval that peers of a torrent
+// can be told to wait between announces, once jittered.
+func maxAnnounceInterval(cfg *config.Config, t *models.Torrent) time.Duration {
+	return baseAnnounceInterval(cfg, t) + cfg.AnnounceJitter.Duration
+}
+
+// baseAnnounceInterval returns the announce interval of a torrent before it is
+// jittered.
+func baseAnnounceInterval(cfg *config.Config, t *models.Torrent) time.Duration {
+	interval := cfg.Announce.Duration
+
+	override := t.AnnounceInterval
+	if override == 0 {
+		override = cfg.CategoryAnnounceIntervals[t.Category].Duration
+	}
+	if override > 0 {
+		interval = override
+		if interval < cfg.MinAnnounce.Duration {
+			interval = cfg.MinAnnounce.Duration
+		}
+	}
+	return interval
 }
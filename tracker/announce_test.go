@@ -0,0 +1,253 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+func TestSuspiciousAnnounceDelta(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MaxBytesPerAnnounce = 1000
+
+	torrent := &models.Torrent{
+		Infohash:       "infohash",
+		Seeders:        models.NewPeerMap(true, &cfg),
+		Leechers:       models.NewPeerMap(false, &cfg),
+		UpMultiplier:   1,
+		DownMultiplier: 1,
+	}
+	user := &models.User{ID: 1, UpMultiplier: 2, DownMultiplier: 1}
+
+	ann := testAnnounce(&cfg, "peer1", 1)
+	ann.Uploaded = 500
+	ann.Downloaded = 100
+	ann.BuildPeer(user, torrent)
+
+	delta := newAnnounceDelta(ann, torrent)
+	if delta.Suspicious || delta.RawUploaded != 500 || delta.Uploaded != 1000 {
+		t.Errorf("expected a plausible delta to be kept, got %+v", delta)
+	}
+
+	ann.Uploaded = 5000
+	ann.BuildPeer(user, torrent)
+
+	delta = newAnnounceDelta(ann, torrent)
+	if !delta.Suspicious || delta.RawUploaded != 1000 || delta.Uploaded != 2000 || delta.RawDownloaded != 100 {
+		t.Errorf("expected an implausible delta to be clamped, got %+v", delta)
+	}
+}
+
+func TestFreeleechAnnounceDelta(t *testing.T) {
+	now := time.Now()
+
+	var table = []struct {
+		global, torrent bool
+		userUntil       int64
+		expected        uint64
+	}{
+		{false, false, 0, 100},
+		{true, false, 0, 0},
+		{false, true, 0, 0},
+		{false, false, now.Add(time.Hour).Unix(), 0},
+		{false, false, now.Add(-time.Hour).Unix(), 100},
+	}
+
+	for _, tt := range table {
+		cfg := config.DefaultConfig
+		cfg.FreeleechEnabled = tt.global
+
+		torrent := &models.Torrent{
+			Infohash:       "infohash",
+			Seeders:        models.NewPeerMap(true, &cfg),
+			Leechers:       models.NewPeerMap(false, &cfg),
+			UpMultiplier:   1,
+			DownMultiplier: 1,
+			Freeleech:      tt.torrent,
+		}
+		user := &models.User{ID: 1, UpMultiplier: 1, DownMultiplier: 1, FreeleechUntil: tt.userUntil}
+
+		ann := testAnnounce(&cfg, "peer1", 1)
+		ann.Uploaded = 50
+		ann.Downloaded = 100
+		ann.BuildPeer(user, torrent)
+
+		delta := newAnnounceDelta(ann, torrent)
+		if delta.Downloaded != tt.expected || delta.RawDownloaded != 100 || delta.Uploaded != 50 {
+			t.Errorf("expected %d bytes downloaded for %+v, got %+v", tt.expected, tt, delta)
+		}
+	}
+}
+
+func TestCorruptAnnounceDelta(t *testing.T) {
+	cfg := config.DefaultConfig
+	torrent := &models.Torrent{
+		Infohash: "infohash",
+		Seeders:  models.NewPeerMap(true, &cfg),
+		Leechers: models.NewPeerMap(false, &cfg),
+	}
+	user := &models.User{ID: 1}
+
+	ann := testAnnounce(&cfg, "peer1", 1)
+	ann.Corrupt = 300
+	ann.BuildPeer(user, torrent)
+	torrent.Leechers.Put(*ann.PeerV4)
+
+	ann.Corrupt = 500
+	ann.BuildPeer(user, torrent)
+	if delta := newAnnounceDelta(ann, torrent); delta.Corrupt != 200 {
+		t.Errorf("expected a corrupt delta of 200, got %d", delta.Corrupt)
+	}
+
+	ann.Corrupt = 0
+	ann.BuildPeer(user, torrent)
+	if delta := newAnnounceDelta(ann, torrent); delta.Corrupt != 0 {
+		t.Errorf("expected a restarted client to have no corrupt delta, got %d", delta.Corrupt)
+	}
+}
+
+func TestRatioLimitedNumWant(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MinRatio = 1
+	cfg.RatioGraceBytes = 1000
+
+	var table = []struct {
+		uploaded, downloaded uint64
+		expected             int
+	}{
+		{0, 0, 50},
+		{0, 500, 50},
+		{2000, 2000, 50},
+		{5000, 2000, 50},
+		{1000, 2000, 25},
+		{0, 2000, 1},
+	}
+
+	for _, tt := range table {
+		user := &models.User{Uploaded: tt.uploaded, Downloaded: tt.downloaded}
+		if got := ratioLimitedNumWant(&cfg, user, 50); got != tt.expected {
+			t.Errorf("expected %d peers for %d/%d, got %d", tt.expected, tt.uploaded, tt.downloaded, got)
+		}
+	}
+}
+
+func TestWarningMessage(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.WarnRatio = 0.5
+	cfg.RatioGraceBytes = 1000
+
+	var table = []struct {
+		uploaded, downloaded uint64
+		notice               string
+		expected             string
+	}{
+		{0, 500, "", ""},
+		{1000, 2000, "", ""},
+		{500, 2000, "", "your ratio of 0.25 is below the required 0.50"},
+		{1000, 2000, "maintenance", "maintenance"},
+		{0, 2000, "maintenance", "your ratio of 0.00 is below the required 0.50; maintenance"},
+	}
+
+	for _, tt := range table {
+		cfg.AnnounceWarning = tt.notice
+		ann := &models.Announce{
+			Config: &cfg,
+			User:   &models.User{Uploaded: tt.uploaded, Downloaded: tt.downloaded},
+		}
+		if got := warningMessage(ann); got != tt.expected {
+			t.Errorf("expected %q for %d/%d, got %q", tt.expected, tt.uploaded, tt.downloaded, got)
+		}
+	}
+}
+
+func TestTorrentAnnounceInterval(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.Announce = config.Duration{Duration: 30 * time.Minute}
+	cfg.MinAnnounce = config.Duration{Duration: 15 * time.Minute}
+	cfg.CategoryAnnounceIntervals = map[string]config.Duration{
+		"tv":   {Duration: 45 * time.Minute},
+		"tiny": {Duration: time.Minute},
+	}
+
+	var table = []struct {
+		category           string
+		interval, expected time.Duration
+	}{
+		{"", 0, 30 * time.Minute},
+		{"", time.Hour, time.Hour},
+		{"", 20 * time.Minute, 20 * time.Minute},
+		{"", time.Minute, 15 * time.Minute},
+		{"tv", 0, 45 * time.Minute},
+		{"tv", time.Hour, time.Hour},
+		{"tiny", 0, 15 * time.Minute},
+		{"movies", 0, 30 * time.Minute},
+	}
+
+	for _, tt := range table {
+		torrent := &models.Torrent{Category: tt.category, AnnounceInterval: tt.interval}
+		if got := announceInterval(&cfg, torrent); got != tt.expected {
+			t.Errorf("expected interval %s for torrent interval %s in category %q, got %s", tt.expected, tt.interval, tt.category, got)
+		}
+	}
+}
+
+func TestSeederLeeching(t *testing.T) {
+	cfg := config.DefaultConfig
+	torrent := &models.Torrent{
+		Infohash: "infohash",
+		Seeders:  models.NewPeerMap(true, &cfg),
+		Leechers: models.NewPeerMap(false, &cfg),
+	}
+
+	ann := testAnnounce(&cfg, "peer1", 0)
+	ann.BuildPeer(nil, torrent)
+	torrent.Seeders.Put(*ann.PeerV4)
+
+	if seederLeeching(ann) {
+		t.Error("expected a seeder with nothing left to be consistent")
+	}
+
+	ann.Left = 1
+	ann.BuildPeer(nil, torrent)
+	if !seederLeeching(ann) {
+		t.Error("expected a seeder with data left to be flagged")
+	}
+
+	ann = testAnnounce(&cfg, "peer2", 1)
+	ann.BuildPeer(nil, torrent)
+	if seederLeeching(ann) {
+		t.Error("expected a new leecher to be consistent")
+	}
+}
+
+func TestDedupeDualStack(t *testing.T) {
+	cfg := config.DefaultConfig
+	ann := &models.Announce{Config: &cfg, IPv4: net.ParseIP("10.0.0.9").To4(), NumWant: 3}
+
+	ipv4s := models.PeerList{
+		{IP: net.ParseIP("10.0.0.8").To4()},
+		{ID: "peer1", IP: net.ParseIP("10.0.0.1").To4()},
+		{ID: "peer2", UserID: 1, IP: net.ParseIP("10.0.0.2").To4()},
+	}
+	ipv6s := models.PeerList{
+		{IP: net.ParseIP("fc00::8")},
+		{ID: "peer1", IP: net.ParseIP("fc00::1")},
+		{ID: "peer2", UserID: 2, IP: net.ParseIP("fc00::2")},
+	}
+
+	// Fixed peers have no ID, and peers of other users merely share one.
+	ipv4s, ipv6s = dedupeDualStack(ann, ipv4s, ipv6s)
+	if len(ipv4s) != 2 || len(ipv6s) != 1 {
+		t.Fatalf("expected 2 IPv4 and 1 IPv6 peers, got %v and %v", ipv4s, ipv6s)
+	}
+	if ipv6s[0].ID != "" {
+		t.Errorf("expected the IPv6 fixed peer to be kept, got %v", ipv6s)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// AuditLogger records the announces a tracker rejects, so that operators can
+// find out why clients are refused.
+type AuditLogger interface {
+	LogRejection(ann *models.Announce, reason string)
+}
+
+// glogAuditLogger is the AuditLogger used when AuditLogEnabled is set. It logs
+// one line of key=value pairs per rejection.
+type glogAuditLogger struct{}
+
+func (glogAuditLogger) LogRejection(ann *models.Announce, reason string) {
+	glog.Infof("Rejected announce: ipv4=%s ipv6=%s infohash=%x client=%q reason=%q",
+		ann.IPv4, ann.IPv6, ann.Infohash, ann.ClientID(), reason)
+}
+
+// auditRejection passes a rejected announce to the AuditLogger, unless the
+// rejections are arriving faster than the audit log rate limit, such as during
+// an attack.
+func (tkr *Tracker) auditRejection(ann *models.Announce, err error) {
+	if tkr.AuditLogger == nil {
+		return
+	}
+	if tkr.auditLimiter != nil && !tkr.auditLimiter.Allow("", time.Now()) {
+		return
+	}
+	tkr.AuditLogger.LogRejection(ann, err.Error())
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// circuitBreaker stops requests from reaching a failing backend, so that they
+// fail immediately instead of each waiting for the backend to time out. The
+// breaker opens after threshold consecutive failures. Once cooldown has
+// passed, a single request is let through as a probe: if it succeeds the
+// breaker closes, and otherwise it stays open for another cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	failures  int
+	openUntil time.Time
+	probing   bool
+	sync.Mutex
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Call calls fn unless the breaker is open, in which case it returns a
+// models.RetryError for ErrStorageUnavailable. Errors returned by fn count as
+// failures of the backend, unless they were caused by the client.
+func (cb *circuitBreaker) Call(fn func() error) error {
+	if err := cb.allow(time.Now()); err != nil {
+		return err
+	}
+
+	err := fn()
+	switch err.(type) {
+	case nil, models.ClientError, models.NotFoundError:
+		cb.record(true, time.Now())
+	default:
+		cb.record(false, time.Now())
+	}
+	return err
+}
+
+// allow returns an error if a request must not reach the backend.
+func (cb *circuitBreaker) allow(now time.Time) error {
+	cb.Lock()
+	defer cb.Unlock()
+
+	if cb.failures < cb.threshold {
+		return nil
+	}
+	if cb.probing || now.Before(cb.openUntil) {
+		retryIn := cb.openUntil.Sub(now)
+		if retryIn < time.Second {
+			retryIn = time.Second
+		}
+		return models.RetryError{Err: models.ErrStorageUnavailable, RetryIn: retryIn}
+	}
+
+	cb.probing = true
+	return nil
+}
+
+// record updates the breaker with the outcome of a request.
+func (cb *circuitBreaker) record(ok bool, now time.Time) {
+	cb.Lock()
+	defer cb.Unlock()
+
+	wasOpen := cb.failures >= cb.threshold
+	cb.probing = false
+
+	if ok {
+		if wasOpen {
+			glog.Info("Backend recovered, closing circuit breaker")
+		}
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		if !wasOpen {
+			glog.Errorf("Backend failed %d times in a row, opening circuit breaker", cb.failures)
+		}
+		cb.openUntil = now.Add(cb.cooldown)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// dedupPeer identifies a peer of a torrent.
+type dedupPeer struct {
+	pk       models.PeerKey
+	infohash string
+}
+
+// dedupKey identifies announces that are retries of one another.
+type dedupKey struct {
+	dedupPeer
+	event   string
+	left    uint64
+	compact bool
+}
+
+type dedupEntry struct {
+	res     *models.AnnounceResponse
+	expires time.Time
+}
+
+// dedupCache remembers the response to each announce for a short window, so
+// that a client retrying an announce is given the same response rather than
+// updating the swarm and backend again.
+type dedupCache struct {
+	window time.Duration
+
+	entries   map[dedupPeer]map[dedupKey]*dedupEntry
+	lastSweep time.Time
+	sync.Mutex
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{
+		window:    window,
+		entries:   make(map[dedupPeer]map[dedupKey]*dedupEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// newDedupKey returns the key of an announce, and false if the announce must
+// never be deduplicated. Stopped and completed events change the swarm and
+// the backend's records, so they are always handled.
+func newDedupKey(ann *models.Announce) (dedupKey, bool) {
+	if ann.Event == "stopped" || ann.Event == "completed" {
+		return dedupKey{}, false
+	}
+
+	return dedupKey{
+		dedupPeer: dedupPeer{pk: announceKey(ann), infohash: ann.Infohash},
+		event:     ann.Event,
+		left:      ann.Left,
+		compact:   ann.Compact,
+	}, true
+}
+
+// Get returns the response cached for an announce, if it is still within the
+// window.
+func (dc *dedupCache) Get(key dedupKey, now time.Time) (*models.AnnounceResponse, bool) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	entry, exists := dc.entries[key.dedupPeer][key]
+	if !exists || now.After(entry.expires) {
+		return nil, false
+	}
+	return entry.res, true
+}
+
+// Put caches the response to an announce.
+func (dc *dedupCache) Put(key dedupKey, res *models.AnnounceResponse, now time.Time) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	entries, exists := dc.entries[key.dedupPeer]
+	if !exists {
+		entries = make(map[dedupKey]*dedupEntry)
+		dc.entries[key.dedupPeer] = entries
+	}
+	entries[key] = &dedupEntry{res: res, expires: now.Add(dc.window)}
+	dc.sweep(now)
+}
+
+// Forget deletes the responses cached for a peer of a torrent, which no
+// longer reflect the swarm once the peer has stopped or completed.
+func (dc *dedupCache) Forget(pk models.PeerKey, infohash string) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	delete(dc.entries, dedupPeer{pk: pk, infohash: infohash})
+}
+
+// sweep deletes expired entries, at most once per window.
+func (dc *dedupCache) sweep(now time.Time) {
+	if now.Sub(dc.lastSweep) < dc.window {
+		return
+	}
+
+	for peer, entries := range dc.entries {
+		for key, entry := range entries {
+			if now.After(entry.expires) {
+				delete(entries, key)
+			}
+		}
+		if len(entries) == 0 {
+			delete(dc.entries, peer)
+		}
+	}
+	dc.lastSweep = now
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// maxDepartedPerTorrent bounds the number of departed peers remembered for
+// each torrent, dropping the oldest first.
+const maxDepartedPerTorrent = 50
+
+type departedPeer struct {
+	peer    models.Peer
+	expires time.Time
+}
+
+// departedCache remembers the peers that recently left each swarm with a
+// stopped event. They may be restarted soon after, so they are better than
+// nothing for padding the peer lists of sparse swarms, but they are
+// forgotten after ttl so that long-dead peers are never handed out.
+type departedCache struct {
+	ttl time.Duration
+
+	torrents  map[string][]departedPeer
+	lastSweep time.Time
+	sync.Mutex
+}
+
+func newDepartedCache(ttl time.Duration) *departedCache {
+	return &departedCache{
+		ttl:       ttl,
+		torrents:  make(map[string][]departedPeer),
+		lastSweep: time.Now(),
+	}
+}
+
+// Put remembers a peer that has left a torrent's swarm, replacing any earlier
+// departure of the same peer.
+func (dc *departedCache) Put(infohash string, p *models.Peer, now time.Time) {
+	dc.Lock()
+	defer dc.Unlock()
+
+	departed := withoutDeparted(dc.torrents[infohash], p.Key())
+	if len(departed) >= maxDepartedPerTorrent {
+		departed = departed[1:]
+	}
+	dc.torrents[infohash] = append(departed, departedPeer{peer: p.Clone(), expires: now.Add(dc.ttl)})
+	dc.sweep(now)
+}
+
+// Get returns copies of the peers that left a torrent's swarm within the
+// ttl, most recent first.
+func (dc *departedCache) Get(infohash string, now time.Time) models.PeerList {
+	dc.Lock()
+	defer dc.Unlock()
+
+	departed := dc.torrents[infohash]
+	peers := make(models.PeerList, 0, len(departed))
+	for i := len(departed) - 1; i >= 0; i-- {
+		if now.After(departed[i].expires) {
+			break
+		}
+		peers = append(peers, departed[i].peer.Clone())
+	}
+	return peers
+}
+
+// sweep forgets expired departures, at most once per ttl.
+func (dc *departedCache) sweep(now time.Time) {
+	if now.Sub(dc.lastSweep) < dc.ttl {
+		return
+	}
+
+	for infohash, departed := range dc.torrents {
+		i := 0
+		for i < len(departed) && now.After(departed[i].expires) {
+			i++
+		}
+		if i == len(departed) {
+			delete(dc.torrents, infohash)
+		} else {
+			dc.torrents[infohash] = departed[i:]
+		}
+	}
+	dc.lastSweep = now
+}
+
+// withoutDeparted removes a peer from a list of departures.
+func withoutDeparted(departed []departedPeer, pk models.PeerKey) []departedPeer {
+	for i := range departed {
+		if departed[i].peer.Key() == pk {
+			return append(departed[:i:i], departed[i+1:]...)
+		}
+	}
+	return departed
+}
+
+// departedPeers pads peer lists with the peers that recently left the
+// announcer's swarm, until they hold NumWant peers. Departed peers that have
+// since rejoined the swarm are skipped, as are any that the announcer would
+// not be given if they were still in it, and seeders beyond
+// MaxSeedersReturned.
+func (tkr *Tracker) departedPeers(ann *models.Announce, ipv4s, ipv6s models.PeerList) (models.PeerList, models.PeerList) {
+	t := ann.Torrent
+
+	seeders := 0
+	for _, list := range []models.PeerList{ipv4s, ipv6s} {
+		for i := range list {
+			if t.Seeders.Contains(list[i].Key()) {
+				seeders++
+			}
+		}
+	}
+	maxSeeders := maxSeeders(ann, ann.NumWant)
+
+	count := len(ipv4s) + len(ipv6s)
+	for _, peer := range tkr.departed.Get(t.Infohash, time.Now()) {
+		if count >= ann.NumWant {
+			break
+		}
+
+		pk := peer.Key()
+		switch {
+		case t.Seeders.Contains(pk), t.Leechers.Contains(pk):
+			continue
+		case peer.Paused, models.PeersEquivalent(&peer, ann.Peer), t.Seeders.Excluded(ann, &peer):
+			continue
+		case peer.Seeding() && seeders >= maxSeeders:
+			continue
+		}
+
+		added := count
+		models.AppendPeer(&ipv4s, &ipv6s, ann, &peer, &count)
+		if count > added && peer.Seeding() {
+			seeders++
+		}
+	}
+	return ipv4s, ipv6s
+}
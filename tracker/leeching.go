@@ -0,0 +1,122 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"sync"
+	"time"
+)
+
+// activeLeeches tracks the torrents that each user is leeching, so that the
+// number of torrents a user downloads at once can be capped. Each of a user's
+// peers is tracked separately, and a torrent is forgotten once all of them
+// have stopped leeching it, or have not announced it for the ttl given when
+// they last did, by which time they have been purged from the swarm as
+// inactive.
+type activeLeeches struct {
+	// interval is how often expired peers are swept.
+	interval time.Duration
+
+	users     map[uint64]map[string]map[string]time.Time
+	lastSweep time.Time
+	sync.Mutex
+}
+
+func newActiveLeeches(interval time.Duration) *activeLeeches {
+	return &activeLeeches{
+		interval:  interval,
+		users:     make(map[uint64]map[string]map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow returns true if a user may leech a torrent, because they are already
+// leeching it or are leeching fewer than max other torrents.
+func (al *activeLeeches) Allow(userID uint64, infohash string, max int, now time.Time) bool {
+	al.Lock()
+	defer al.Unlock()
+
+	al.sweep(now)
+
+	torrents := al.unexpired(userID, now)
+	if _, leeching := torrents[infohash]; leeching {
+		return true
+	}
+	return len(torrents) < max
+}
+
+// Start records that one of a user's peers is leeching a torrent, until it
+// stops or ttl passes without it announcing again.
+func (al *activeLeeches) Start(userID uint64, infohash, peerID string, now time.Time, ttl time.Duration) {
+	al.Lock()
+	defer al.Unlock()
+
+	torrents, exists := al.users[userID]
+	if !exists {
+		torrents = make(map[string]map[string]time.Time)
+		al.users[userID] = torrents
+	}
+
+	peers, exists := torrents[infohash]
+	if !exists {
+		peers = make(map[string]time.Time)
+		torrents[infohash] = peers
+	}
+	peers[peerID] = now.Add(ttl)
+}
+
+// Stop forgets that one of a user's peers is leeching a torrent. The torrent
+// is still counted while any of the user's other peers are leeching it.
+func (al *activeLeeches) Stop(userID uint64, infohash, peerID string) {
+	al.Lock()
+	defer al.Unlock()
+
+	torrents, exists := al.users[userID]
+	if !exists {
+		return
+	}
+
+	if peers, exists := torrents[infohash]; exists {
+		delete(peers, peerID)
+		if len(peers) == 0 {
+			delete(torrents, infohash)
+		}
+	}
+	if len(torrents) == 0 {
+		delete(al.users, userID)
+	}
+}
+
+// unexpired forgets the expired peers of a single user, which the periodic
+// sweep may not have reached yet, and returns the torrents they are still
+// leeching.
+func (al *activeLeeches) unexpired(userID uint64, now time.Time) map[string]map[string]time.Time {
+	torrents := al.users[userID]
+	for infohash, peers := range torrents {
+		for peerID, expires := range peers {
+			if now.After(expires) {
+				delete(peers, peerID)
+			}
+		}
+		if len(peers) == 0 {
+			delete(torrents, infohash)
+		}
+	}
+	return torrents
+}
+
+// sweep forgets expired peers, at most once per interval.
+func (al *activeLeeches) sweep(now time.Time) {
+	if now.Sub(al.lastSweep) < al.interval {
+		return
+	}
+
+	for userID := range al.users {
+		if len(al.unexpired(userID, now)) == 0 {
+			delete(al.users, userID)
+		}
+	}
+	al.lastSweep = now
+}
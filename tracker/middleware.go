@@ -0,0 +1,25 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import "github.com/chihaya/chihaya/tracker/models"
+
+// AnnounceHandler handles an announce, writing its response to w.
+type AnnounceHandler func(*models.Announce, Writer) error
+
+// AnnounceMiddleware wraps an AnnounceHandler with additional logic, such as
+// logging or authorization. It may handle the announce itself, or call next
+// to pass it on down the chain.
+type AnnounceMiddleware func(next AnnounceHandler) AnnounceHandler
+
+// announceChain composes the tracker's AnnounceMiddleware around its core
+// announce handler. The first middleware is the outermost.
+func (tkr *Tracker) announceChain() AnnounceHandler {
+	handler := AnnounceHandler(tkr.handleAnnounce)
+	for i := len(tkr.AnnounceMiddleware) - 1; i >= 0; i-- {
+		handler = tkr.AnnounceMiddleware[i](handler)
+	}
+	return handler
+}
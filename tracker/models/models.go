@@ -7,6 +7,8 @@
 package models
 
 import (
+	"encoding/json"
+	"errors"
 	"net"
 	"strings"
 	"time"
@@ -30,11 +32,73 @@ var (
 	// ErrTorrentDNE is returned when a torrent does not exist.
 	ErrTorrentDNE = NotFoundError("torrent does not exist")
 
+	// ErrPeerDNE is returned when a peer is not in a torrent's swarm.
+	ErrPeerDNE = NotFoundError("peer does not exist")
+
 	// ErrClientUnapproved is returned when a clientID is not in the whitelist.
 	ErrClientUnapproved = ClientError("client is not approved")
 
+	// ErrClientBlacklisted is returned when a clientID matches the blacklist.
+	ErrClientBlacklisted = ClientError("client is blacklisted")
+
 	// ErrInvalidPasskey is returned when a passkey is not properly formatted.
 	ErrInvalidPasskey = ClientError("passkey is invalid")
+
+	// ErrAnnounceTooFrequent is returned when a peer announces more often than
+	// the configured rate limit allows.
+	ErrAnnounceTooFrequent = ClientError("announcing too frequently")
+
+	// ErrUnauthorizedTorrent is returned when a user's group is not allowed to
+	// access a torrent.
+	ErrUnauthorizedTorrent = ClientError("user is not allowed to access torrent")
+
+	// ErrLeechingDisabled is returned when a leecher announces on a torrent
+	// that only accepts seeders.
+	ErrLeechingDisabled = ClientError("leeching is disabled for this torrent")
+
+	// ErrBlockedInfohash is returned when a torrent has been blocked by the
+	// tracker operator.
+	ErrBlockedInfohash = ClientError("torrent is blocked")
+
+	// ErrTooManyPeers is returned when a user already has the maximum number
+	// of active peers on a torrent.
+	ErrTooManyPeers = ClientError("too many active peers for user")
+
+	// ErrTooManyPeersFromIP is returned when an IP address already has the
+	// maximum number of active peers on a torrent.
+	ErrTooManyPeersFromIP = ClientError("too many active peers from ip address")
+
+	// ErrTooManyLeeches is returned when a user is already leeching the
+	// maximum number of torrents at once.
+	ErrTooManyLeeches = ClientError("too many torrents being leeched at once")
+
+	// ErrInvalidSignalToken is returned when a browser client polls for
+	// signals without the token it was given when it announced.
+	ErrInvalidSignalToken = ClientError("signal token is invalid")
+
+	// ErrInvalidTrackerID is returned when a client echoes a tracker ID that
+	// was not issued by this tracker.
+	ErrInvalidTrackerID = ClientError("tracker id is invalid")
+
+	// ErrCompactRequired is returned when a client asks for a non-compact
+	// response from a tracker that only serves compact ones.
+	ErrCompactRequired = ClientError("only compact responses are supported")
+
+	// ErrInvalidIP is returned when none of the addresses of an announce can
+	// be reached by other peers.
+	ErrInvalidIP = ClientError("ip address is invalid")
+
+	// ErrMismatchedIPv6 is returned when a client connecting over IPv6
+	// announces another IPv6 address and StrictIPv6Param is enabled.
+	ErrMismatchedIPv6 = ClientError("ipv6 address does not match connection")
+
+	// ErrRequestTooLarge is returned when the body of a request is larger
+	// than the tracker is willing to read.
+	ErrRequestTooLarge = ClientError("request is too large")
+
+	// ErrStorageUnavailable is returned while requests to a failing backend
+	// are refused without being attempted.
+	ErrStorageUnavailable = errors.New("storage is unavailable")
 )
 
 type ClientError string
@@ -43,6 +107,15 @@ type NotFoundError ClientError
 func (e ClientError) Error() string   { return string(e) }
 func (e NotFoundError) Error() string { return string(e) }
 
+// RetryError is a temporary failure of the tracker, which is reported to the
+// client along with how long to wait before announcing again.
+type RetryError struct {
+	Err     error
+	RetryIn time.Duration
+}
+
+func (e RetryError) Error() string { return e.Err.Error() }
+
 type PeerList []Peer
 type PeerKey string
 
@@ -50,16 +123,19 @@ func NewPeerKey(peerID string, ip net.IP) PeerKey {
 	return PeerKey(peerID + "//" + ip.String())
 }
 
+// IP returns the IP address of a PeerKey. Peer IDs are arbitrary bytes and may
+// contain the separator, so the key is split on its last occurrence.
 func (pk PeerKey) IP() net.IP {
-	ip := net.ParseIP(strings.Split(string(pk), "//")[1])
+	ip := net.ParseIP(string(pk[strings.LastIndex(string(pk), "//")+2:]))
 	if rval := ip.To4(); rval != nil {
 		return rval
 	}
 	return ip
 }
 
+// PeerID returns the peer ID of a PeerKey.
 func (pk PeerKey) PeerID() string {
-	return strings.Split(string(pk), "//")[0]
+	return string(pk[:strings.LastIndex(string(pk), "//")])
 }
 
 // Peer is a participant in a swarm.
@@ -77,6 +153,52 @@ type Peer struct {
 	Downloaded   uint64 `json:"downloaded"`
 	Left         uint64 `json:"left"`
 	LastAnnounce int64  `json:"last_announce"`
+
+	// Corrupt is the number of bytes the peer reported discarding because
+	// they failed hash checks.
+	Corrupt uint64 `json:"corrupt,omitempty"`
+
+	// Paused peers remain in the swarm but are not returned to other peers.
+	Paused bool `json:"paused"`
+
+	// Completed is set once a peer has finished downloading while in the
+	// swarm, so that repeated completed events are not counted again.
+	Completed bool `json:"completed"`
+
+	// ClientKey is the optional key sent by the client, which identifies it
+	// across changes of IP address.
+	ClientKey string `json:"key,omitempty"`
+
+	// WebRTC peers are browser clients that can only be reached through
+	// signals relayed by the tracker, and are only given to each other.
+	WebRTC bool `json:"webrtc,omitempty"`
+
+	// UploadCapacityHint estimates how fast the peer is able to upload, in
+	// bytes per second, from the uploaded totals of its last two announces.
+	UploadCapacityHint uint64 `json:"upload_capacity_hint,omitempty"`
+
+	// PartialSeed peers (BEP 21) have stopped downloading with data left, but
+	// are still able to upload what they have to leechers.
+	PartialSeed bool `json:"partial_seed,omitempty"`
+
+	// SupportsCrypto peers accept connections using BitTorrent protocol
+	// encryption.
+	SupportsCrypto bool `json:"supports_crypto,omitempty"`
+}
+
+// Clone returns a copy of a Peer that shares no memory with it, so that it can
+// be used after the lock of the PeerMap it came from is released.
+func (p *Peer) Clone() Peer {
+	cp := *p
+	cp.IP = append(net.IP(nil), p.IP...)
+	return cp
+}
+
+// FetchingMetadata returns true if the peer is leeching but has never
+// transferred anything, which is typical of clients started from a magnet link
+// that are still fetching the torrent's metadata from other peers.
+func (p *Peer) FetchingMetadata() bool {
+	return p.Left > 0 && p.Uploaded == 0 && p.Downloaded == 0
 }
 
 func (p *Peer) HasIPv4() bool {
@@ -91,6 +213,12 @@ func (p *Peer) Key() PeerKey {
 	return NewPeerKey(p.ID, p.IP)
 }
 
+// Seeding returns true if the peer is not downloading, either because it has
+// the complete data or because it is a partial seed.
+func (p *Peer) Seeding() bool {
+	return p.Left == 0 || p.PartialSeed
+}
+
 // Torrent is a swarm for a given torrent file.
 type Torrent struct {
 	ID       uint64 `json:"id"`
@@ -103,6 +231,152 @@ type Torrent struct {
 	UpMultiplier   float64 `json:"up_multiplier"`
 	DownMultiplier float64 `json:"down_multiplier"`
 	LastAction     int64   `json:"last_action"`
+
+	// AllowedUserGroups restricts access to users in the listed groups when
+	// torrent ACLs are enforced. An empty list allows every user.
+	AllowedUserGroups []uint64 `json:"allowed_user_groups,omitempty"`
+
+	// SeedOnly torrents only accept peers that already have the complete data.
+	SeedOnly bool `json:"seed_only"`
+
+	// Freeleech torrents do not count downloads against users' ratios.
+	Freeleech bool `json:"freeleech,omitempty"`
+
+	// Category and Tags classify the torrent for admin tooling, and the
+	// category may select rules of its own in the tracker's configuration.
+	Category string   `json:"category,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+
+	// MetadataSize is the size in bytes of the torrent's info dictionary, if
+	// known, which clients joining from a magnet link fetch from peers
+	// (BEP 9).
+	MetadataSize int `json:"metadata_size,omitempty"`
+
+	// DownloadRate is the estimated aggregate download speed of the swarm in
+	// bytes per second, averaged over the last completed window.
+	DownloadRate float64 `json:"download_rate"`
+
+	// TotalUploaded and TotalDownloaded are the sums of the bytes its peers
+	// have reported transferring since the tracker started tracking it.
+	TotalUploaded   uint64 `json:"total_uploaded"`
+	TotalDownloaded uint64 `json:"total_downloaded"`
+
+	// AnnounceInterval overrides the configured announce interval for this
+	// torrent when non-zero, e.g. to spread out the load of a large swarm.
+	AnnounceInterval time.Duration `json:"announce_interval,omitempty"`
+
+	// CreatedAt is the Unix time at which the tracker started tracking the
+	// torrent. PeersJoined and PeersLeft count the peers that have joined and
+	// left its swarm since then, including those reaped or evicted. Peers
+	// that finish downloading remain in the swarm, so they are not counted.
+	CreatedAt   int64  `json:"created_at"`
+	PeersJoined uint64 `json:"peers_joined"`
+	PeersLeft   uint64 `json:"peers_left"`
+
+	rateWindowStart int64
+	rateWindowBytes uint64
+
+	// active is true if the torrent had peers when Emptied was last called.
+	active bool
+
+	// metadataReports holds the metadata size last reported by each peer
+	// until enough of them agree for MetadataSize to be set.
+	metadataReports map[string]int
+}
+
+// MetadataSizeQuorum is the number of peers that must report the same
+// metadata size before it is trusted, so that a single client cannot set it.
+const MetadataSizeQuorum = 2
+
+// maxMetadataReports bounds the reports kept for a torrent whose peers do not
+// agree on the size of its metadata.
+const maxMetadataReports = 32
+
+// Copy returns a deep copy of a Torrent, including its swarm. The PeerMaps are
+// locked while copied, but the caller must prevent concurrent modification of
+// the Torrent's other fields.
+func (t *Torrent) Copy() *Torrent {
+	cp := *t
+	cp.Seeders = t.Seeders.Copy()
+	cp.Leechers = t.Leechers.Copy()
+	cp.AllowedUserGroups = append([]uint64(nil), t.AllowedUserGroups...)
+	cp.Tags = append([]string(nil), t.Tags...)
+	cp.metadataReports = nil
+	return &cp
+}
+
+// RecordDownload accumulates downloaded bytes into the current rate window.
+// Once the window has lasted at least the provided length, DownloadRate is
+// updated and a new window is started. It is not thread-safe.
+func (t *Torrent) RecordDownload(bytes uint64, now time.Time, window time.Duration) {
+	if t.rateWindowStart == 0 {
+		t.rateWindowStart = now.UnixNano()
+	}
+	t.rateWindowBytes += bytes
+
+	elapsed := time.Duration(now.UnixNano() - t.rateWindowStart)
+	if elapsed >= window && elapsed > 0 {
+		t.DownloadRate = float64(t.rateWindowBytes) / elapsed.Seconds()
+		t.rateWindowStart = now.UnixNano()
+		t.rateWindowBytes = 0
+	}
+}
+
+// Emptied returns true if the torrent has no peers, but had some when Emptied
+// was last called, so that each transition to empty is only reported once. It
+// is not thread-safe.
+func (t *Torrent) Emptied() bool {
+	if t.PeerCount() > 0 {
+		t.active = true
+		return false
+	}
+
+	emptied := t.active
+	t.active = false
+	return emptied
+}
+
+// ReportMetadataSize records the size of the torrent's metadata reported by a
+// peer, and sets MetadataSize once MetadataSizeQuorum peers agree on it. A
+// size that is already known is kept. It is not thread-safe.
+func (t *Torrent) ReportMetadataSize(reporter string, size int) {
+	if t.MetadataSize != 0 {
+		return
+	}
+
+	if t.metadataReports == nil {
+		t.metadataReports = make(map[string]int)
+	}
+	if _, reported := t.metadataReports[reporter]; !reported && len(t.metadataReports) >= maxMetadataReports {
+		return
+	}
+	t.metadataReports[reporter] = size
+
+	agreeing := 0
+	for _, reported := range t.metadataReports {
+		if reported == size {
+			agreeing++
+		}
+	}
+	if agreeing >= MetadataSizeQuorum {
+		t.MetadataSize = size
+		t.metadataReports = nil
+	}
+}
+
+// UserAllowed returns true if the user may access this Torrent according to
+// its AllowedUserGroups.
+func (t *Torrent) UserAllowed(u *User) bool {
+	if len(t.AllowedUserGroups) == 0 {
+		return true
+	}
+
+	for _, group := range t.AllowedUserGroups {
+		if u.GroupID == group {
+			return true
+		}
+	}
+	return false
 }
 
 // PeerCount returns the total number of peers connected on this Torrent.
@@ -113,10 +387,29 @@ func (t *Torrent) PeerCount() int {
 // User is a registered user for private trackers.
 type User struct {
 	ID      uint64 `json:"id"`
+	GroupID uint64 `json:"group_id"`
 	Passkey string `json:"passkey"`
 
 	UpMultiplier   float64 `json:"up_multiplier"`
 	DownMultiplier float64 `json:"down_multiplier"`
+
+	// Uploaded and Downloaded are the user's totals across all torrents, as
+	// provided by the backend.
+	Uploaded   uint64 `json:"uploaded"`
+	Downloaded uint64 `json:"downloaded"`
+
+	// FreeleechUntil is the Unix time until which the user's downloads do
+	// not count against their ratio, on every torrent.
+	FreeleechUntil int64 `json:"freeleech_until,omitempty"`
+}
+
+// Ratio returns the ratio of a user's uploaded to downloaded bytes, and false
+// if the user has not downloaded anything yet.
+func (u *User) Ratio() (float64, bool) {
+	if u.Downloaded == 0 {
+		return 0, false
+	}
+	return float64(u.Uploaded) / float64(u.Downloaded), true
 }
 
 // Announce is an Announce by a Peer.
@@ -124,18 +417,42 @@ type Announce struct {
 	Config *config.Config `json:"config"`
 
 	Compact    bool   `json:"compact"`
+	Corrupt    uint64 `json:"corrupt"`
 	Downloaded uint64 `json:"downloaded"`
 	Event      string `json:"event"`
 	IPv4       net.IP `json:"ipv4"`
 	IPv6       net.IP `json:"ipv6"`
 	Infohash   string `json:"infohash"`
+	Key        string `json:"key"`
 	Left       uint64 `json:"left"`
+	NoIPv4     bool   `json:"no_ipv4"`
+	NoIPv6     bool   `json:"no_ipv6"`
+	NoPeerID   bool   `json:"no_peer_id"`
 	NumWant    int    `json:"numwant"`
 	Passkey    string `json:"passkey"`
 	PeerID     string `json:"peer_id"`
 	Port       uint64 `json:"port"`
+	TrackerID  string `json:"trackerid"`
 	Uploaded   uint64 `json:"uploaded"`
 
+	// WebRTC is true if the announce is from a browser client, which can only
+	// connect to other WebRTC peers.
+	WebRTC bool `json:"webrtc"`
+
+	// SupportCrypto is true if the client is able to use protocol encryption,
+	// and RequireCrypto if it refuses to connect to peers without it.
+	SupportCrypto bool `json:"supportcrypto"`
+	RequireCrypto bool `json:"requirecrypto"`
+
+	// MetadataSize is the size of the torrent's metadata as reported by a
+	// client that has it, or 0 if it was not reported.
+	MetadataSize int `json:"metadata_size"`
+
+	// NumWantProvided is false if the client did not request a number of
+	// peers, in which case the tracker's default is used. An explicit
+	// numwant of 0 is honored.
+	NumWantProvided bool `json:"numwant_provided"`
+
 	Torrent *Torrent `json:"-"`
 	User    *User    `json:"-"`
 	Peer    *Peer    `json:"-"`
@@ -168,11 +485,69 @@ func (a *Announce) HasIPv6() bool {
 	return a.IPv6 != nil
 }
 
+// WantsIPv4 is true if IPv4 peers may be returned in response to the Announce.
+func (a *Announce) WantsIPv4() bool {
+	return !a.NoIPv4
+}
+
+// WantsIPv6 is true if IPv6 peers may be returned in response to the Announce.
+func (a *Announce) WantsIPv6() bool {
+	return !a.NoIPv6
+}
+
+// GetsIPv4Peers is true if IPv4 peers are returned to the announcer, given its
+// addresses and the PeerFamilyPreference.
+func (a *Announce) GetsIPv4Peers() bool {
+	if !a.WantsIPv4() {
+		return false
+	}
+
+	switch a.Config.PeerFamilyPreference {
+	case config.PeerFamilyBoth:
+		return true
+	case "":
+		return a.HasIPv4() || !a.Config.RespectAF
+	default:
+		return a.HasIPv4()
+	}
+}
+
+// GetsIPv6Peers is true if IPv6 peers are returned to the announcer, given its
+// addresses and the PeerFamilyPreference.
+func (a *Announce) GetsIPv6Peers() bool {
+	if !a.WantsIPv6() {
+		return false
+	}
+	return a.HasIPv6() || a.Config.PeerFamilyPreference == config.PeerFamilyBoth
+}
+
+// PreferredFamily returns true for ipv6 if IPv6 peers are to be given before
+// IPv4 peers, and false if the reverse. ok is false if neither is preferred,
+// which is always the case unless the announcer gets peers of both families.
+func (a *Announce) PreferredFamily() (ipv6, ok bool) {
+	if !a.GetsIPv4Peers() || !a.GetsIPv6Peers() {
+		return false, false
+	}
+
+	switch a.Config.PeerFamilyPreference {
+	case config.PeerFamilyPreferIPv4:
+		return false, true
+	case config.PeerFamilyPreferIPv6:
+		return true, true
+	}
+	return false, false
+}
+
 // BuildPeer creates the Peer representation of an Announce. When provided nil
 // for the user or torrent parameter, it creates a Peer{UserID: 0} or
 // Peer{TorrentID: 0}, respectively. BuildPeer creates one peer for each IP
 // in the announce, and panics if there are none.
+//
+// A paused announce with data left is from a partial seed when
+// TreatPartialSeedsSpecially is enabled, and the peer is not paused.
 func (a *Announce) BuildPeer(u *User, t *Torrent) {
+	partialSeed := a.Event == "paused" && a.Left > 0 && a.Config.TreatPartialSeedsSpecially
+
 	a.Peer = &Peer{
 		ID:           a.PeerID,
 		Port:         a.Port,
@@ -180,6 +555,13 @@ func (a *Announce) BuildPeer(u *User, t *Torrent) {
 		Downloaded:   a.Downloaded,
 		Left:         a.Left,
 		LastAnnounce: time.Now().Unix(),
+		Corrupt:      a.Corrupt,
+		Paused:       a.Event == "paused" && !partialSeed,
+		PartialSeed:  partialSeed,
+		ClientKey:    a.Key,
+		WebRTC:       a.WebRTC,
+
+		SupportsCrypto: a.SupportCrypto || a.RequireCrypto,
 	}
 
 	if t != nil {
@@ -193,9 +575,10 @@ func (a *Announce) BuildPeer(u *User, t *Torrent) {
 	}
 
 	if a.HasIPv4() && a.HasIPv6() {
+		peerV6 := *a.Peer
 		a.PeerV4 = a.Peer
 		a.PeerV4.IP = a.IPv4
-		a.PeerV6 = &*a.Peer
+		a.PeerV6 = &peerV6
 		a.PeerV6.IP = a.IPv6
 	} else if a.HasIPv4() {
 		a.PeerV4 = a.Peer
@@ -221,6 +604,9 @@ type AnnounceDelta struct {
 	Created bool
 	// Snatched is true if this announce completed the download
 	Snatched bool
+	// Suspicious is true if the reported deltas exceeded MaxBytesPerAnnounce
+	// and were clamped
+	Suspicious bool
 
 	// Uploaded contains the upload delta for this announce, in bytes
 	Uploaded    uint64
@@ -229,6 +615,19 @@ type AnnounceDelta struct {
 	// Downloaded contains the download delta for this announce, in bytes
 	Downloaded    uint64
 	RawDownloaded uint64
+
+	// Corrupt contains the delta of bytes discarded for failing hash checks
+	Corrupt uint64
+}
+
+// Snatch records a user completing the download of a torrent, for auditing.
+type Snatch struct {
+	UserID    uint64    `json:"user_id"`
+	TorrentID uint64    `json:"torrent_id"`
+	Infohash  string    `json:"infohash"`
+	PeerID    string    `json:"peer_id"`
+	IP        net.IP    `json:"ip"`
+	Time      time.Time `json:"time"`
 }
 
 // AnnounceResponse contains the information needed to fulfill an announce.
@@ -237,7 +636,24 @@ type AnnounceResponse struct {
 	Interval, MinInterval time.Duration
 	IPv4Peers, IPv6Peers  PeerList
 
-	Compact bool
+	// ExternalIP is the address of the announcing peer as seen by the
+	// tracker (BEP 24).
+	ExternalIP net.IP
+
+	// TrackerID identifies the tracker, and is echoed by clients on their
+	// next announce.
+	TrackerID string
+
+	// WarningMessage is shown to the user by clients without failing the
+	// announce.
+	WarningMessage string
+
+	// MetadataSize is the size of the torrent's metadata (BEP 9), or 0 if it
+	// is unknown.
+	MetadataSize int
+
+	Compact  bool
+	NoPeerID bool
 }
 
 // Scrape is a Scrape by a Peer.
@@ -251,4 +667,47 @@ type Scrape struct {
 // ScrapeResponse contains the information needed to fulfill a scrape.
 type ScrapeResponse struct {
 	Files []*Torrent
+
+	// ExcludeMetadataPeers leaves peers that are only fetching metadata out
+	// of the leecher counts.
+	ExcludeMetadataPeers bool
+}
+
+// Complete returns the number of seeders to report for a torrent.
+func (r *ScrapeResponse) Complete(t *Torrent) int {
+	return t.Seeders.Len()
+}
+
+// Incomplete returns the number of leechers to report for a torrent.
+func (r *ScrapeResponse) Incomplete(t *Torrent) int {
+	if r.ExcludeMetadataPeers {
+		return t.Leechers.Len() - t.Leechers.MetadataLen()
+	}
+	return t.Leechers.Len()
+}
+
+// Downloaded returns the number of completed downloads to report for a
+// torrent, which is the number of times it has been snatched.
+func (r *ScrapeResponse) Downloaded(t *Torrent) uint64 {
+	return t.Snatches
+}
+
+// TrackerStats is a snapshot of the size of every swarm on a tracker.
+type TrackerStats struct {
+	Torrents int `json:"torrents"`
+	Peers    int `json:"peers"`
+	Seeders  int `json:"seeders"`
+	Leechers int `json:"leechers"`
+}
+
+// Signal is a WebRTC signaling message relayed by the tracker between browser
+// peers, which cannot be contacted directly. It carries either an offer from
+// a peer looking for connections or the answer to one.
+type Signal struct {
+	PeerID  string          `json:"peer_id"`
+	OfferID string          `json:"offer_id"`
+	Offer   json.RawMessage `json:"offer,omitempty"`
+	Answer  json.RawMessage `json:"answer,omitempty"`
+
+	Sent time.Time `json:"-"`
 }
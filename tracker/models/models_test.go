@@ -4,7 +4,12 @@
 
 package models
 
-import "testing"
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
 
 type PeerClientPair struct {
 	announce Announce
@@ -62,3 +67,72 @@ func TestClientID(t *testing.T) {
 		}
 	}
 }
+
+func TestPeerKey(t *testing.T) {
+	peerID := "\xff\xfe//\x00-binary-id"
+	ip := net.ParseIP("10.0.0.1").To4()
+
+	pk := NewPeerKey(peerID, ip)
+	if got := pk.PeerID(); got != peerID {
+		t.Errorf("expected peer ID %q, got %q", peerID, got)
+	}
+	if got := pk.IP(); !got.Equal(ip) {
+		t.Errorf("expected IP %s, got %s", ip, got)
+	}
+}
+
+func TestRecordDownload(t *testing.T) {
+	var torrent Torrent
+	start := time.Unix(1000, 0)
+
+	torrent.RecordDownload(1000, start, 10*time.Second)
+	torrent.RecordDownload(4000, start.Add(5*time.Second), 10*time.Second)
+	if torrent.DownloadRate != 0 {
+		t.Fatalf("expected no rate before the window closes, got %f", torrent.DownloadRate)
+	}
+
+	torrent.RecordDownload(5000, start.Add(10*time.Second), 10*time.Second)
+	if torrent.DownloadRate != 1000 {
+		t.Fatalf("expected a rate of 1000 B/s, got %f", torrent.DownloadRate)
+	}
+
+	torrent.RecordDownload(0, start.Add(20*time.Second), 10*time.Second)
+	if torrent.DownloadRate != 0 {
+		t.Fatalf("expected the rate to drop to 0 B/s, got %f", torrent.DownloadRate)
+	}
+}
+
+func TestReportMetadataSize(t *testing.T) {
+	var torrent Torrent
+
+	torrent.ReportMetadataSize("10.0.0.1", 1000)
+	torrent.ReportMetadataSize("10.0.0.1", 1000)
+	if torrent.MetadataSize != 0 {
+		t.Fatalf("expected a single reporter not to set the size, got %d", torrent.MetadataSize)
+	}
+
+	torrent.ReportMetadataSize("10.0.0.2", 2000)
+	if torrent.MetadataSize != 0 {
+		t.Fatalf("expected disagreeing reporters not to set the size, got %d", torrent.MetadataSize)
+	}
+
+	torrent.ReportMetadataSize("10.0.0.1", 2000)
+	if torrent.MetadataSize != 2000 {
+		t.Fatalf("expected agreeing reporters to set the size to 2000, got %d", torrent.MetadataSize)
+	}
+
+	torrent.ReportMetadataSize("10.0.0.3", 3000)
+	torrent.ReportMetadataSize("10.0.0.4", 3000)
+	if torrent.MetadataSize != 2000 {
+		t.Fatalf("expected the learned size to be kept, got %d", torrent.MetadataSize)
+	}
+
+	// Reports are bounded while reporters disagree.
+	torrent = Torrent{}
+	for i := 0; i < 2*maxMetadataReports; i++ {
+		torrent.ReportMetadataSize(strconv.Itoa(i), i+1)
+	}
+	if len(torrent.metadataReports) != maxMetadataReports {
+		t.Fatalf("expected %d reports to be kept, got %d", maxMetadataReports, len(torrent.metadataReports))
+	}
+}
@@ -5,9 +5,17 @@
 package models
 
 import (
+	"bytes"
+	"container/heap"
+	"hash/crc32"
+	"hash/fnv"
+	"math/rand"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/chihaya/chihaya/config"
 	"github.com/chihaya/chihaya/stats"
@@ -20,6 +28,21 @@ type PeerMap struct {
 	Seeders bool                        `json:"seeders"`
 	Config  config.SubnetConfig         `json:"config"`
 	Size    int32                       `json:"size"`
+	version uint64
+
+	// metadata is the number of peers that are fetching metadata.
+	metadata int32
+
+	// ids indexes the keys of the peers by their peer IDs, and users counts
+	// the peers of each user by their peer IDs. Peers without a user are not
+	// counted.
+	ids   map[string][]PeerKey
+	users map[uint64]map[string]int
+
+	// ages orders the peers by when they last announced, and agesByKey finds
+	// their entries in it.
+	ages      peerAges
+	agesByKey map[PeerKey]*peerAge
 	sync.RWMutex
 }
 
@@ -29,6 +52,10 @@ func NewPeerMap(seeders bool, cfg *config.Config) *PeerMap {
 		Peers:   make(map[string]map[PeerKey]Peer),
 		Seeders: seeders,
 		Config:  cfg.NetConfig.SubnetConfig,
+		ids:     make(map[string][]PeerKey),
+		users:   make(map[uint64]map[string]int),
+
+		agesByKey: make(map[PeerKey]*peerAge),
 	}
 
 	if !pm.Config.PreferredSubnet {
@@ -38,6 +65,49 @@ func NewPeerMap(seeders bool, cfg *config.Config) *PeerMap {
 	return pm
 }
 
+// Copy returns a deep copy of a PeerMap that shares no state with it.
+func (pm *PeerMap) Copy() *PeerMap {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	cp := &PeerMap{
+		Peers:   make(map[string]map[PeerKey]Peer, len(pm.Peers)),
+		Seeders: pm.Seeders,
+		Config:  pm.Config,
+		Size:    atomic.LoadInt32(&pm.Size),
+		version: atomic.LoadUint64(&pm.version),
+
+		metadata: atomic.LoadInt32(&pm.metadata),
+		ids:      make(map[string][]PeerKey, len(pm.ids)),
+		users:    make(map[uint64]map[string]int, len(pm.users)),
+
+		ages:      make(peerAges, len(pm.ages)),
+		agesByKey: make(map[PeerKey]*peerAge, len(pm.agesByKey)),
+	}
+	for id, keys := range pm.ids {
+		cp.ids[id] = append([]PeerKey(nil), keys...)
+	}
+	for userID, ids := range pm.users {
+		cp.users[userID] = make(map[string]int, len(ids))
+		for id, count := range ids {
+			cp.users[userID][id] = count
+		}
+	}
+	for i, age := range pm.ages {
+		cpAge := *age
+		cp.ages[i] = &cpAge
+		cp.agesByKey[age.key] = &cpAge
+	}
+	for subnet, peers := range pm.Peers {
+		cp.Peers[subnet] = make(map[PeerKey]Peer, len(peers))
+		for pk, peer := range peers {
+			cp.Peers[subnet][pk] = peer.Clone()
+		}
+	}
+
+	return cp
+}
+
 // Contains is true if a peer is contained with a PeerMap.
 func (pm *PeerMap) Contains(pk PeerKey) bool {
 	pm.RLock()
@@ -88,7 +158,8 @@ func (pm *PeerMap) LookUp(pk PeerKey) (peer Peer, exists bool) {
 	return
 }
 
-// Put is a thread-safe write to a PeerMap.
+// Put is a thread-safe write to a PeerMap. The PeerMap stores a clone of the
+// peer, so it shares no memory with the caller's.
 func (pm *PeerMap) Put(p Peer) {
 	pm.Lock()
 	defer pm.Unlock()
@@ -98,11 +169,36 @@ func (pm *PeerMap) Put(p Peer) {
 	if !exists {
 		pm.Peers[maskedIP] = make(map[PeerKey]Peer)
 	}
-	_, exists = pm.Peers[maskedIP][p.Key()]
+	old, exists := pm.Peers[maskedIP][p.Key()]
 	if !exists {
 		atomic.AddInt32(&(pm.Size), 1)
+		atomic.AddUint64(&pm.version, 1)
+		pm.ids[p.ID] = append(pm.ids[p.ID], p.Key())
+		pm.countUser(&p, 1)
+
+		age := &peerAge{key: p.Key(), lastAnnounce: p.LastAnnounce}
+		heap.Push(&pm.ages, age)
+		pm.agesByKey[age.key] = age
+	} else {
+		if old.FetchingMetadata() {
+			atomic.AddInt32(&pm.metadata, -1)
+		}
+		if selectionChanged(&old, &p) {
+			atomic.AddUint64(&pm.version, 1)
+		}
+		if old.UserID != p.UserID {
+			pm.countUser(&old, -1)
+			pm.countUser(&p, 1)
+		}
+		if age := pm.agesByKey[p.Key()]; age.lastAnnounce != p.LastAnnounce {
+			age.lastAnnounce = p.LastAnnounce
+			heap.Fix(&pm.ages, age.index)
+		}
+	}
+	if p.FetchingMetadata() {
+		atomic.AddInt32(&pm.metadata, 1)
 	}
-	pm.Peers[maskedIP][p.Key()] = p
+	pm.Peers[maskedIP][p.Key()] = p.Clone()
 }
 
 // Delete is a thread-safe delete from a PeerMap.
@@ -111,18 +207,219 @@ func (pm *PeerMap) Delete(pk PeerKey) {
 	defer pm.Unlock()
 
 	maskedIP := pm.mask(pk.IP())
-	_, exists := pm.Peers[maskedIP][pk]
+	peer, exists := pm.Peers[maskedIP][pk]
 	if exists {
 		atomic.AddInt32(&(pm.Size), -1)
+		atomic.AddUint64(&pm.version, 1)
+		if peer.FetchingMetadata() {
+			atomic.AddInt32(&pm.metadata, -1)
+		}
+		pm.unindex(&peer)
 		delete(pm.Peers[maskedIP], pk)
 	}
 }
 
+// countUser adds delta to the number of peers with a peer's ID that belong to
+// its user. The lock must be held.
+func (pm *PeerMap) countUser(p *Peer, delta int) {
+	if p.UserID == 0 {
+		return
+	}
+
+	ids, exists := pm.users[p.UserID]
+	if !exists {
+		ids = make(map[string]int)
+		pm.users[p.UserID] = ids
+	}
+	ids[p.ID] += delta
+
+	if ids[p.ID] <= 0 {
+		delete(ids, p.ID)
+		if len(ids) == 0 {
+			delete(pm.users, p.UserID)
+		}
+	}
+}
+
+// unindex removes a peer from the index of peer IDs, the counts of its user's
+// peers and the order of their ages. The lock must be held.
+func (pm *PeerMap) unindex(p *Peer) {
+	pk := p.Key()
+	pm.countUser(p, -1)
+	if age, exists := pm.agesByKey[pk]; exists {
+		heap.Remove(&pm.ages, age.index)
+		delete(pm.agesByKey, pk)
+	}
+
+	keys := pm.ids[p.ID]
+	for i := range keys {
+		if keys[i] == pk {
+			keys = append(keys[:i:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(keys) == 0 {
+		delete(pm.ids, p.ID)
+	} else {
+		pm.ids[p.ID] = keys
+	}
+}
+
+// ContainsID is true if a PeerMap contains a peer with the provided peer ID,
+// at any address.
+func (pm *PeerMap) ContainsID(peerID string) bool {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	return len(pm.ids[peerID]) > 0
+}
+
+// LookUpMoved finds a peer with the same peer ID and client key as p, but a
+// different IP address of the same family. Peers without a client key never
+// match.
+func (pm *PeerMap) LookUpMoved(p *Peer) (peer Peer, exists bool) {
+	if p.ClientKey == "" {
+		return Peer{}, false
+	}
+
+	pm.RLock()
+	defer pm.RUnlock()
+
+	for _, pk := range pm.ids[p.ID] {
+		peer, exists := pm.Peers[pm.mask(pk.IP())][pk]
+		if exists && peer.ClientKey == p.ClientKey &&
+			peer.HasIPv6() == p.HasIPv6() && !peer.IP.Equal(p.IP) {
+			return peer, true
+		}
+	}
+
+	return Peer{}, false
+}
+
+// Oldest returns the peer within a PeerMap that has gone the longest without
+// announcing.
+func (pm *PeerMap) Oldest() (oldest Peer, exists bool) {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	if len(pm.ages) == 0 {
+		return Peer{}, false
+	}
+	pk := pm.ages[0].key
+	oldest, exists = pm.Peers[pm.mask(pk.IP())][pk]
+	return
+}
+
+// CountIP returns the number of peers within a PeerMap that have the provided
+// IP address.
+func (pm *PeerMap) CountIP(ip net.IP) int {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	count := 0
+	for _, peer := range pm.Peers[pm.mask(ip)] {
+		if peer.IP.Equal(ip) {
+			count++
+		}
+	}
+	return count
+}
+
+// CollectUserPeerIDs adds the IDs of all peers within a PeerMap that belong to
+// the provided user to ids. Peers without a user are never collected.
+func (pm *PeerMap) CollectUserPeerIDs(userID uint64, ids map[string]bool) {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	for id := range pm.users[userID] {
+		ids[id] = true
+	}
+}
+
+// PeersBefore returns the peers within a PeerMap that have not announced since
+// the provided time.
+func (pm *PeerMap) PeersBefore(unixtime int64) (peers PeerList) {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	for _, subnetmap := range pm.Peers {
+		for _, peer := range subnetmap {
+			if peer.LastAnnounce < unixtime {
+				peers = append(peers, peer)
+			}
+		}
+	}
+
+	return
+}
+
+// Version returns a counter that changes whenever a peer joins or leaves the
+// PeerMap, or an existing peer changes in a way that affects which peers are
+// selected for announces, such as pausing. Other updates do not change it.
+func (pm *PeerMap) Version() uint64 {
+	return atomic.LoadUint64(&pm.version)
+}
+
+// Subnet returns the subnet that an IP is grouped into within the PeerMap, or
+// "" if PreferredSubnet is disabled.
+func (pm *PeerMap) Subnet(ip net.IP) string {
+	return pm.mask(ip)
+}
+
+// ExcludedSubnets returns the subnets of an announcer whose peers are not
+// returned to it, or "" if ExcludeSameSubnet is disabled.
+func (pm *PeerMap) ExcludedSubnets(ann *Announce) string {
+	if !pm.Config.ExcludeSameSubnet {
+		return ""
+	}
+
+	var subnets []string
+	if ann.HasIPv4() {
+		subnets = append(subnets, ann.IPv4.Mask(pm.excludedMask(ann.IPv4)).String())
+	}
+	if ann.HasIPv6() {
+		subnets = append(subnets, ann.IPv6.Mask(pm.excludedMask(ann.IPv6)).String())
+	}
+	return strings.Join(subnets, ",")
+}
+
+// Excluded returns true if ExcludeSameSubnet is enabled and a peer is in the
+// excluded subnet of the announcer's address of the same family.
+func (pm *PeerMap) Excluded(ann *Announce, peer *Peer) bool {
+	if !pm.Config.ExcludeSameSubnet {
+		return false
+	}
+
+	ip := ann.IPv4
+	if len(peer.IP) == net.IPv6len {
+		ip = ann.IPv6
+	}
+	if ip == nil {
+		return false
+	}
+
+	mask := pm.excludedMask(peer.IP)
+	return peer.IP.Mask(mask).Equal(ip.Mask(mask))
+}
+
+func (pm *PeerMap) excludedMask(ip net.IP) net.IPMask {
+	if len(ip) == net.IPv6len {
+		return net.CIDRMask(pm.Config.ExcludedIPv6Subnet, 128)
+	}
+	return net.CIDRMask(pm.Config.ExcludedIPv4Subnet, 32)
+}
+
 // Len returns the number of peers within a PeerMap.
 func (pm *PeerMap) Len() int {
 	return int(atomic.LoadInt32(&pm.Size))
 }
 
+// MetadataLen returns the number of peers within a PeerMap that are fetching
+// metadata.
+func (pm *PeerMap) MetadataLen() int {
+	return int(atomic.LoadInt32(&pm.metadata))
+}
+
 // Purge iterates over all of the peers within a PeerMap and deletes them if
 // they are older than the provided time.
 func (pm *PeerMap) Purge(unixtime int64) {
@@ -133,6 +430,11 @@ func (pm *PeerMap) Purge(unixtime int64) {
 		for key, peer := range subnetmap {
 			if peer.LastAnnounce <= unixtime {
 				atomic.AddInt32(&(pm.Size), -1)
+				atomic.AddUint64(&pm.version, 1)
+				if peer.FetchingMetadata() {
+					atomic.AddInt32(&pm.metadata, -1)
+				}
+				pm.unindex(&peer)
 				delete(subnetmap, key)
 				if pm.Seeders {
 					stats.RecordPeerEvent(stats.ReapedSeed, peer.HasIPv6())
@@ -144,60 +446,447 @@ func (pm *PeerMap) Purge(unixtime int64) {
 	}
 }
 
-// AppendPeers adds peers to given IPv4 or IPv6 lists.
-func (pm *PeerMap) AppendPeers(ipv4s, ipv6s PeerList, ann *Announce, wanted int) (PeerList, PeerList) {
+// peerAge is the entry of a peer in the order of when peers last announced.
+type peerAge struct {
+	key          PeerKey
+	lastAnnounce int64
+	index        int
+}
+
+// peerAges is a min-heap of peers by when they last announced, so that the
+// peer that has gone the longest without announcing is found without scanning
+// the whole PeerMap.
+type peerAges []*peerAge
+
+func (a peerAges) Len() int           { return len(a) }
+func (a peerAges) Less(i, j int) bool { return a[i].lastAnnounce < a[j].lastAnnounce }
+
+func (a peerAges) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+	a[i].index = i
+	a[j].index = j
+}
+
+func (a *peerAges) Push(x interface{}) {
+	age := x.(*peerAge)
+	age.index = len(*a)
+	*a = append(*a, age)
+}
+
+func (a *peerAges) Pop() interface{} {
+	old := *a
+	age := old[len(old)-1]
+	old[len(old)-1] = nil
+	*a = old[:len(old)-1]
+	return age
+}
+
+// GeoLocator maps IP addresses to geographic regions so that peers near the
+// announcer can be preferred. Region returns "" if the region is unknown.
+type GeoLocator interface {
+	Region(ip net.IP) string
+}
+
+// AppendPeers adds peers to given IPv4 or IPv6 lists. Peers are chosen in a
+// uniformly random order, preferring those in the announcer's subnet and then,
+// if a GeoLocator is provided, those in the announcer's region. Peers that have
+// not announced within PeerStaleAge are skipped, but remain in the PeerMap.
+//
+// If PreferCapableSeeders is enabled, seeders are instead chosen in order of
+// their UploadCapacityHint within each of those groups. Otherwise, if
+// BEP40Ordering is enabled, peers are chosen in order of their BEP 40 priority
+// to the announcer. If the announcer prefers an address family, peers of that
+// family are chosen first within each group.
+//
+// If StablePeerSelection is enabled, the random order is seeded by the
+// announcer and the current StablePeerEpoch, so that a reannouncing peer is
+// given the same peers until the swarm changes or the epoch rotates.
+func (pm *PeerMap) AppendPeers(ipv4s, ipv6s PeerList, ann *Announce, wanted int, locator GeoLocator) (PeerList, PeerList) {
 	maskedIP := pm.mask(ann.Peer.IP)
 
+	var rng *rand.Rand
+	if ann.Config.StablePeerSelection {
+		rng = rand.New(rand.NewSource(stableSeed(ann.Peer, time.Now(), ann.Config.StablePeerEpoch.Duration)))
+	} else {
+		rng = shuffleRands.Get().(*rand.Rand)
+		defer shuffleRands.Put(rng)
+	}
+
+	appendCandidates := appendShuffled
+	if pm.Seeders && ann.Config.PreferCapableSeeders {
+		appendCandidates = appendByCapacity
+	} else if !pm.Seeders && ann.Peer.Left > 0 && ann.Config.ReturnNewestPeers {
+		appendCandidates = appendNewest
+	} else if ann.Config.BEP40Ordering {
+		appendCandidates = appendByPriority
+	}
+
+	if ipv6, ok := ann.PreferredFamily(); ok {
+		appendUnordered := appendCandidates
+		appendCandidates = func(ipv4s, ipv6s *PeerList, ann *Announce, candidates PeerList, rng *rand.Rand, count, wanted int) int {
+			preferred, others := partitionByFamily(candidates, ipv6)
+			count = appendUnordered(ipv4s, ipv6s, ann, preferred, rng, count, wanted)
+			return appendUnordered(ipv4s, ipv6s, ann, others, rng, count, wanted)
+		}
+	}
+
+	// The candidates are gathered from maps, so they must be put in a fixed
+	// order for a seeded shuffle to be repeatable.
+	if ann.Config.StablePeerSelection {
+		appendUnsorted := appendCandidates
+		appendCandidates = func(ipv4s, ipv6s *PeerList, ann *Announce, candidates PeerList, rng *rand.Rand, count, wanted int) int {
+			sortByKey(candidates)
+			return appendUnsorted(ipv4s, ipv6s, ann, candidates, rng, count, wanted)
+		}
+	}
+
+	var staleBefore int64
+	if age := ann.Config.PeerStaleAge.Duration; age > 0 {
+		staleBefore = time.Now().Add(-age).Unix()
+	}
+
+	var region string
+	if locator != nil {
+		region = locator.Region(ann.Peer.IP)
+	}
+
 	pm.RLock()
-	defer pm.RUnlock()
 
-	count := 0
 	// Attempt to append all the peers in the same subnet.
+	var candidates PeerList
 	for _, peer := range pm.Peers[maskedIP] {
-		if count >= wanted {
-			break
-		} else if peersEquivalent(&peer, ann.Peer) {
-			continue
-		} else {
-			appendPeer(&ipv4s, &ipv6s, ann, &peer, &count)
+		if peer.LastAnnounce >= staleBefore && !pm.Excluded(ann, &peer) {
+			candidates = append(candidates, peer)
 		}
 	}
+	count := appendCandidates(&ipv4s, &ipv6s, ann, candidates, rng, 0, wanted)
+	if count >= wanted {
+		pm.RUnlock()
+		return ipv4s, ipv6s
+	}
 
-	// Add any more peers out of the other subnets.
+	// Add any more peers out of the other subnets, starting with those in the
+	// same region. Looking up regions may be slow, so the candidates are
+	// copied out of the PeerMap first.
+	candidates = candidates[:0]
 	for subnet, peers := range pm.Peers {
 		if subnet == maskedIP {
 			continue
-		} else {
-			for _, peer := range peers {
-				if count >= wanted {
-					break
-				} else if peersEquivalent(&peer, ann.Peer) {
-					continue
-				} else {
-					appendPeer(&ipv4s, &ipv6s, ann, &peer, &count)
-				}
+		}
+		for _, peer := range peers {
+			if peer.LastAnnounce >= staleBefore && !pm.Excluded(ann, &peer) {
+				candidates = append(candidates, peer)
+			}
+		}
+	}
+	pm.RUnlock()
+
+	if region != "" {
+		var regional, others PeerList
+		for _, peer := range candidates {
+			if locator.Region(peer.IP) == region {
+				regional = append(regional, peer)
+			} else {
+				others = append(others, peer)
 			}
 		}
+		count = appendCandidates(&ipv4s, &ipv6s, ann, regional, rng, count, wanted)
+		candidates = others
 	}
+	appendCandidates(&ipv4s, &ipv6s, ann, candidates, rng, count, wanted)
 
 	return ipv4s, ipv6s
 }
 
-// appendPeer adds a peer to its corresponding peerlist.
-func appendPeer(ipv4s, ipv6s *PeerList, ann *Announce, peer *Peer, count *int) {
-	if ann.HasIPv6() && peer.HasIPv6() {
-		*ipv6s = append(*ipv6s, *peer)
-		*count++
-	} else if ann.Config.RespectAF && ann.HasIPv4() && peer.HasIPv4() {
-		*ipv4s = append(*ipv4s, *peer)
-		*count++
-	} else if !ann.Config.RespectAF && peer.HasIPv4() {
-		*ipv4s = append(*ipv4s, *peer)
-		*count++
+// appendShuffled appends candidates to the peerlists in a random order until
+// wanted peers have been added, returning the updated count. The shuffle is
+// performed lazily so that only the peers actually considered are swapped.
+func appendShuffled(ipv4s, ipv6s *PeerList, ann *Announce, candidates PeerList, rng *rand.Rand, count, wanted int) int {
+	for i := range candidates {
+		if count >= wanted {
+			break
+		}
+
+		j := i + rng.Intn(len(candidates)-i)
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+
+		peer := &candidates[i]
+		if peer.Paused || PeersEquivalent(peer, ann.Peer) {
+			continue
+		}
+		AppendPeer(ipv4s, ipv6s, ann, peer, &count)
+	}
+	return count
+}
+
+// appendByCapacity appends candidates to the peerlists in descending order of
+// UploadCapacityHint until wanted peers have been added, returning the updated
+// count. Peers with equal hints are appended in a random order.
+func appendByCapacity(ipv4s, ipv6s *PeerList, ann *Announce, candidates PeerList, rng *rand.Rand, count, wanted int) int {
+	for i := len(candidates) - 1; i > 0; i-- {
+		j := rng.Intn(i + 1)
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	sort.Stable(byCapacity(candidates))
+
+	for i := range candidates {
+		if count >= wanted {
+			break
+		}
+
+		peer := &candidates[i]
+		if peer.Paused || PeersEquivalent(peer, ann.Peer) {
+			continue
+		}
+		AppendPeer(ipv4s, ipv6s, ann, peer, &count)
+	}
+	return count
+}
+
+// appendNewest appends candidates to the peerlists in descending order of
+// LastAnnounce until wanted peers have been added, returning the updated count.
+// Only the peers actually considered are sorted, by selecting the newest of
+// the remaining candidates on each iteration.
+func appendNewest(ipv4s, ipv6s *PeerList, ann *Announce, candidates PeerList, rng *rand.Rand, count, wanted int) int {
+	for i := range candidates {
+		if count >= wanted {
+			break
+		}
+
+		newest := i
+		for j := i + 1; j < len(candidates); j++ {
+			if candidates[j].LastAnnounce > candidates[newest].LastAnnounce {
+				newest = j
+			}
+		}
+		candidates[i], candidates[newest] = candidates[newest], candidates[i]
+
+		peer := &candidates[i]
+		if peer.Paused || PeersEquivalent(peer, ann.Peer) {
+			continue
+		}
+		AppendPeer(ipv4s, ipv6s, ann, peer, &count)
+	}
+	return count
+}
+
+// appendByPriority appends candidates to the peerlists in descending order of
+// their BEP 40 priority to the announcer until wanted peers have been added,
+// returning the updated count.
+func appendByPriority(ipv4s, ipv6s *PeerList, ann *Announce, candidates PeerList, rng *rand.Rand, count, wanted int) int {
+	ordered := byPriority{
+		peers:      candidates,
+		priorities: make([]uint32, len(candidates)),
+	}
+	for i := range candidates {
+		announcerIP := ann.IPv4
+		if candidates[i].HasIPv6() {
+			announcerIP = ann.IPv6
+		}
+		ordered.priorities[i] = peerPriority(announcerIP, candidates[i].IP)
+	}
+	sort.Stable(ordered)
+
+	for i := range candidates {
+		if count >= wanted {
+			break
+		}
+
+		peer := &candidates[i]
+		if peer.Paused || PeersEquivalent(peer, ann.Peer) {
+			continue
+		}
+		AppendPeer(ipv4s, ipv6s, ann, peer, &count)
+	}
+	return count
+}
+
+// byPriority sorts a PeerList by descending BEP 40 priority, given in the
+// parallel priorities slice.
+type byPriority struct {
+	peers      PeerList
+	priorities []uint32
+}
+
+func (bp byPriority) Len() int { return len(bp.peers) }
+func (bp byPriority) Swap(i, j int) {
+	bp.peers[i], bp.peers[j] = bp.peers[j], bp.peers[i]
+	bp.priorities[i], bp.priorities[j] = bp.priorities[j], bp.priorities[i]
+}
+func (bp byPriority) Less(i, j int) bool { return bp.priorities[i] > bp.priorities[j] }
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	// priorityMasks are applied to addresses before their BEP 40 priority is
+	// computed, keeping more of them the longer the prefix they share: for
+	// IPv4, fewer than 2, exactly 2, or at least 3 bytes, and for IPv6, fewer
+	// than 4, exactly 4, or at least 5 bytes.
+	priorityMasksV4 = [3][]byte{
+		{0xff, 0xff, 0x55, 0x55},
+		{0xff, 0xff, 0xff, 0x55},
+		{0xff, 0xff, 0xff, 0xff},
+	}
+	priorityMasksV6 = [3][]byte{
+		{0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55, 0x55},
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0x55, 0x55, 0x55},
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+)
+
+// peerPriority returns the BEP 40 priority of a connection between two
+// addresses as libtorrent computes it: the CRC32-C of both masked addresses,
+// in ascending order of the unmasked ones. Only the first 8 bytes of IPv6
+// addresses are masked, but all 16 are hashed. Addresses of different
+// families have no priority.
+func peerPriority(a, b net.IP) uint32 {
+	masks, prefix := priorityMasksV4, 2
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		a, b = a4, b4
+	} else if a4 == nil && b4 == nil && a != nil && b != nil {
+		a, b = a.To16(), b.To16()
+		masks, prefix = priorityMasksV6, 4
+	} else {
+		return 0
+	}
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+
+	mask := masks[0]
+	if bytes.Equal(a[:prefix], b[:prefix]) {
+		mask = masks[1]
+		if a[prefix] == b[prefix] {
+			mask = masks[2]
+		}
+	}
+
+	n := len(a)
+	buf := make([]byte, 2*n)
+	copy(buf, a)
+	copy(buf[n:], b)
+	for i := range mask {
+		buf[i] &= mask[i]
+		buf[n+i] &= mask[i]
+	}
+	return crc32.Checksum(buf, castagnoli)
+}
+
+// shuffleRands holds the generators used to order peers randomly, so that
+// announces neither allocate their own nor contend for the lock of the global
+// one. Each is seeded from the global generator, so no two share a sequence.
+var shuffleRands = sync.Pool{
+	New: func() interface{} {
+		return rand.New(rand.NewSource(rand.Int63()))
+	},
+}
+
+// stableSeed returns a seed for the peers given to an announcer, which only
+// changes once per epoch. Epochs start at different times for each announcer,
+// so that the whole swarm does not rotate its connections at once.
+func stableSeed(announcer *Peer, now time.Time, epoch time.Duration) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(announcer.Key()))
+	sum := h.Sum64()
+
+	var n int64
+	if epoch > 0 {
+		offset := time.Duration(sum % uint64(epoch))
+		n = int64(now.Add(offset).UnixNano() / int64(epoch))
+	}
+	return int64(sum) ^ n
+}
+
+// partitionByFamily splits candidates into new lists of the peers of the
+// preferred address family and the others.
+func partitionByFamily(candidates PeerList, ipv6 bool) (preferred, others PeerList) {
+	for _, peer := range candidates {
+		if peer.HasIPv6() == ipv6 {
+			preferred = append(preferred, peer)
+		} else {
+			others = append(others, peer)
+		}
+	}
+	return
+}
+
+// byCapacity sorts a PeerList by descending UploadCapacityHint.
+type byCapacity PeerList
+
+func (pl byCapacity) Len() int           { return len(pl) }
+func (pl byCapacity) Swap(i, j int)      { pl[i], pl[j] = pl[j], pl[i] }
+func (pl byCapacity) Less(i, j int) bool { return pl[i].UploadCapacityHint > pl[j].UploadCapacityHint }
+
+// sortByKey sorts a PeerList by PeerKey.
+func sortByKey(peers PeerList) {
+	ordered := byKey{
+		peers: peers,
+		keys:  make([]PeerKey, len(peers)),
+	}
+	for i := range peers {
+		ordered.keys[i] = peers[i].Key()
+	}
+	sort.Sort(ordered)
+}
+
+// byKey sorts a PeerList by the keys given in the parallel keys slice.
+type byKey struct {
+	peers PeerList
+	keys  []PeerKey
+}
+
+func (bk byKey) Len() int { return len(bk.peers) }
+func (bk byKey) Swap(i, j int) {
+	bk.peers[i], bk.peers[j] = bk.peers[j], bk.peers[i]
+	bk.keys[i], bk.keys[j] = bk.keys[j], bk.keys[i]
+}
+func (bk byKey) Less(i, j int) bool { return bk.keys[i] < bk.keys[j] }
+
+// AppendPeer adds a clone of a peer to its corresponding peerlist, so that the
+// peerlists share no memory with the PeerMap. Peers of an address
+// family the announcer does not get, peers that cannot connect to the
+// announcer because only one of them uses WebRTC or because the announcer
+// requires encryption that they do not support, and partial seeds when the
+// announcer is not downloading are skipped entirely.
+func AppendPeer(ipv4s, ipv6s *PeerList, ann *Announce, peer *Peer, count *int) {
+	if peer.HasIPv6() && !ann.GetsIPv6Peers() || peer.HasIPv4() && !ann.GetsIPv4Peers() {
+		return
 	}
+	if peer.WebRTC != ann.WebRTC {
+		return
+	}
+	if ann.RequireCrypto && !peer.SupportsCrypto {
+		return
+	}
+	if peer.PartialSeed && ann.Peer.Seeding() {
+		return
+	}
+
+	if peer.HasIPv6() {
+		*ipv6s = append(*ipv6s, peer.Clone())
+	} else {
+		*ipv4s = append(*ipv4s, peer.Clone())
+	}
+	*count++
+}
+
+// selectionChanged returns true if an update to a peer changes whether or how
+// it is returned in peer lists.
+func selectionChanged(old, p *Peer) bool {
+	return old.Port != p.Port ||
+		old.Paused != p.Paused ||
+		old.PartialSeed != p.PartialSeed ||
+		old.WebRTC != p.WebRTC ||
+		old.SupportsCrypto != p.SupportsCrypto ||
+		old.UserID != p.UserID ||
+		old.ClientKey != p.ClientKey ||
+		old.FetchingMetadata() != p.FetchingMetadata()
 }
 
-// peersEquivalent checks if two peers represent the same entity.
-func peersEquivalent(a, b *Peer) bool {
-	return a.ID == b.ID || a.UserID != 0 && a.UserID == b.UserID
+// PeersEquivalent checks if two peers represent the same entity, either by
+// sharing a peer ID, a user or a client key.
+func PeersEquivalent(a, b *Peer) bool {
+	return a.ID == b.ID ||
+		a.UserID != 0 && a.UserID == b.UserID ||
+		a.ClientKey != "" && a.ClientKey == b.ClientKey
 }
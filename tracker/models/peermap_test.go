@@ -0,0 +1,608 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package models
+
+import (
+	"hash/crc32"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/config"
+)
+
+func TestAppendPeersRandomized(t *testing.T) {
+	cfg := config.DefaultConfig
+	pm := NewPeerMap(true, &cfg)
+
+	for i := 0; i < 10; i++ {
+		pm.Put(Peer{
+			ID:   "peer" + strconv.Itoa(i),
+			IP:   net.ParseIP("10.0.0.1").To4(),
+			Port: uint64(1000 + i),
+		})
+	}
+
+	ann := &Announce{
+		Config: &cfg,
+		IPv4:   net.ParseIP("10.0.0.2").To4(),
+		Peer:   &Peer{ID: "announcer", IP: net.ParseIP("10.0.0.2").To4()},
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		ipv4s, _ := pm.AppendPeers(PeerList{}, PeerList{}, ann, 1, nil)
+		if len(ipv4s) != 1 {
+			t.Fatalf("expected 1 peer, got %d", len(ipv4s))
+		}
+		seen[ipv4s[0].ID] = true
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("expected peers to be returned in a random order, only saw %v", seen)
+	}
+}
+
+type prefixLocator struct{}
+
+// Region uses the first octet of an IPv4 address as its region.
+func (prefixLocator) Region(ip net.IP) string {
+	return strconv.Itoa(int(ip.To4()[0]))
+}
+
+func TestAppendPeersRegional(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PreferredSubnet = true
+	cfg.PreferredIPv4Subnet = 24
+	pm := NewPeerMap(true, &cfg)
+
+	for i := 0; i < 10; i++ {
+		pm.Put(Peer{
+			ID: "far" + strconv.Itoa(i),
+			IP: net.IPv4(45, 0, byte(i), 1).To4(),
+		})
+	}
+	pm.Put(Peer{ID: "near", IP: net.ParseIP("44.0.1.1").To4()})
+
+	ann := &Announce{
+		Config: &cfg,
+		IPv4:   net.ParseIP("44.0.0.1").To4(),
+		Peer:   &Peer{ID: "announcer", IP: net.ParseIP("44.0.0.1").To4()},
+	}
+
+	for i := 0; i < 20; i++ {
+		ipv4s, _ := pm.AppendPeers(PeerList{}, PeerList{}, ann, 1, prefixLocator{})
+		if len(ipv4s) != 1 || ipv4s[0].ID != "near" {
+			t.Fatalf("expected the peer in the same region, got %v", ipv4s)
+		}
+	}
+}
+
+// lockCheckingLocator records whether its PeerMap could be written to while
+// regions were being looked up.
+type lockCheckingLocator struct {
+	pm     *PeerMap
+	locked bool
+}
+
+func (l *lockCheckingLocator) Region(ip net.IP) string {
+	acquired := make(chan struct{})
+	go func() {
+		l.pm.Lock()
+		l.pm.Unlock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		l.locked = true
+	}
+	return prefixLocator{}.Region(ip)
+}
+
+func TestAppendPeersRegionalUnlocked(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PreferredSubnet = true
+	cfg.PreferredIPv4Subnet = 24
+	pm := NewPeerMap(true, &cfg)
+	pm.Put(Peer{ID: "peer", IP: net.ParseIP("44.0.1.1").To4()})
+
+	ann := &Announce{
+		Config: &cfg,
+		IPv4:   net.ParseIP("44.0.0.1").To4(),
+		Peer:   &Peer{ID: "announcer", IP: net.ParseIP("44.0.0.1").To4()},
+	}
+
+	locator := &lockCheckingLocator{pm: pm}
+	if ipv4s, _ := pm.AppendPeers(PeerList{}, PeerList{}, ann, 1, locator); len(ipv4s) != 1 {
+		t.Fatalf("expected 1 peer, got %v", ipv4s)
+	}
+	if locator.locked {
+		t.Error("expected regions to be looked up without holding the lock")
+	}
+}
+
+func TestAppendPeersStale(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PeerStaleAge = config.Duration{Duration: time.Hour}
+	pm := NewPeerMap(true, &cfg)
+
+	now := time.Now()
+	pm.Put(Peer{ID: "fresh", IP: net.ParseIP("10.0.0.1").To4(), LastAnnounce: now.Unix()})
+	pm.Put(Peer{ID: "stale", IP: net.ParseIP("10.0.0.3").To4(), LastAnnounce: now.Add(-2 * time.Hour).Unix()})
+
+	ann := &Announce{
+		Config: &cfg,
+		IPv4:   net.ParseIP("10.0.0.2").To4(),
+		Peer:   &Peer{ID: "announcer", IP: net.ParseIP("10.0.0.2").To4()},
+	}
+
+	ipv4s, _ := pm.AppendPeers(PeerList{}, PeerList{}, ann, 50, nil)
+	if len(ipv4s) != 1 || ipv4s[0].ID != "fresh" {
+		t.Errorf("expected only the fresh peer, got %v", ipv4s)
+	}
+
+	if pm.Len() != 2 {
+		t.Errorf("expected stale peers to be kept, got %d peers", pm.Len())
+	}
+}
+
+func TestAppendPeersByCapacity(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PreferCapableSeeders = true
+	pm := NewPeerMap(true, &cfg)
+
+	for i := 0; i < 10; i++ {
+		pm.Put(Peer{
+			ID:                 "peer" + strconv.Itoa(i),
+			IP:                 net.IPv4(10, 0, 1, byte(i)).To4(),
+			UploadCapacityHint: uint64(i * 1000),
+		})
+	}
+
+	ann := &Announce{
+		Config: &cfg,
+		IPv4:   net.ParseIP("10.0.0.2").To4(),
+		Peer:   &Peer{ID: "announcer", IP: net.ParseIP("10.0.0.2").To4()},
+	}
+
+	ipv4s, _ := pm.AppendPeers(PeerList{}, PeerList{}, ann, 3, nil)
+	if len(ipv4s) != 3 {
+		t.Fatalf("expected 3 peers, got %d", len(ipv4s))
+	}
+	for i, id := range []string{"peer9", "peer8", "peer7"} {
+		if ipv4s[i].ID != id {
+			t.Errorf("expected %s at position %d, got %s", id, i, ipv4s[i].ID)
+		}
+	}
+}
+
+func TestAppendPeersNewest(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.ReturnNewestPeers = true
+	pm := NewPeerMap(false, &cfg)
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		pm.Put(Peer{
+			ID:           "peer" + strconv.Itoa(i),
+			IP:           net.IPv4(10, 0, 1, byte(i)).To4(),
+			Left:         1,
+			LastAnnounce: now.Add(time.Duration(i) * time.Minute).Unix(),
+		})
+	}
+
+	ann := &Announce{
+		Config: &cfg,
+		IPv4:   net.ParseIP("10.0.0.2").To4(),
+		Peer:   &Peer{ID: "announcer", IP: net.ParseIP("10.0.0.2").To4(), Left: 1},
+	}
+
+	ipv4s, _ := pm.AppendPeers(PeerList{}, PeerList{}, ann, 3, nil)
+	if len(ipv4s) != 3 {
+		t.Fatalf("expected 3 peers, got %d", len(ipv4s))
+	}
+	for i, id := range []string{"peer9", "peer8", "peer7"} {
+		if ipv4s[i].ID != id {
+			t.Errorf("expected %s at position %d, got %s", id, i, ipv4s[i].ID)
+		}
+	}
+}
+
+func TestPeerPriority(t *testing.T) {
+	var table = []struct {
+		a, b     string
+		expected uint32
+	}{
+		// The examples given by BEP 40.
+		{"123.213.32.10", "98.76.54.32", 0xec2d7224},
+		{"123.213.32.10", "123.213.32.234", 0x99568189},
+
+		{"98.76.54.32", "123.213.32.10", 0xec2d7224},
+		{"123.213.32.10", "::1", 0},
+	}
+
+	for _, tt := range table {
+		got := peerPriority(net.ParseIP(tt.a), net.ParseIP(tt.b))
+		if got != tt.expected {
+			t.Errorf("expected priority of %s and %s to be %#x, got %#x", tt.a, tt.b, tt.expected, got)
+		}
+	}
+}
+
+// TestPeerPriorityIPv6 checks IPv6 priorities against libtorrent's
+// peer_priority, giving the bytes that it hashes rather than the priority,
+// as its own tests do.
+func TestPeerPriorityIPv6(t *testing.T) {
+	var table = []struct {
+		a, b   string
+		hashed string
+	}{
+		// The first 5 bytes match, so the whole addresses are hashed.
+		{"ffff:ffff:ffff:ffff::1", "ffff:ffff:ffff:ffff::2",
+			"\xff\xff\xff\xff\xff\xff\xff\xff\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xff\xff\xff\xff\xff\xff\xff\xff\x00\x00\x00\x00\x00\x00\x00\x02"},
+
+		// The first 4 bytes match, so bytes 5 to 7 are masked.
+		{"ffff:ffff:0fff:ffff::1", "ffff:ffff:ffff:ffff::2",
+			"\xff\xff\xff\xff\x0f\x55\x55\x55\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xff\xff\xff\xff\xff\x55\x55\x55\x00\x00\x00\x00\x00\x00\x00\x02"},
+
+		// Otherwise, bytes 4 to 7 are masked.
+		{"ffff:0fff:ffff:ffff::1", "ffff:ffff:ffff:ffff::2",
+			"\xff\xff\x0f\xff\x55\x55\x55\x55\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xff\xff\xff\xff\x55\x55\x55\x55\x00\x00\x00\x00\x00\x00\x00\x02"},
+	}
+
+	for _, tt := range table {
+		expected := crc32.Checksum([]byte(tt.hashed), castagnoli)
+		for _, pair := range [][2]string{{tt.a, tt.b}, {tt.b, tt.a}} {
+			got := peerPriority(net.ParseIP(pair[0]), net.ParseIP(pair[1]))
+			if got != expected {
+				t.Errorf("expected priority of %s and %s to be %#x, got %#x", pair[0], pair[1], expected, got)
+			}
+		}
+	}
+}
+
+func TestAppendPeersByPriority(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.BEP40Ordering = true
+	pm := NewPeerMap(false, &cfg)
+
+	announcerIP := net.ParseIP("10.0.0.2").To4()
+	for i := 0; i < 10; i++ {
+		pm.Put(Peer{ID: "peer" + strconv.Itoa(i), IP: net.IPv4(10, byte(i), 1, 1).To4(), Left: 1})
+	}
+
+	ann := &Announce{
+		Config: &cfg,
+		IPv4:   announcerIP,
+		Peer:   &Peer{ID: "announcer", IP: announcerIP, Left: 1},
+	}
+
+	ipv4s, _ := pm.AppendPeers(PeerList{}, PeerList{}, ann, 10, nil)
+	if len(ipv4s) != 10 {
+		t.Fatalf("expected 10 peers, got %d", len(ipv4s))
+	}
+	for i := 1; i < len(ipv4s); i++ {
+		prev := peerPriority(announcerIP, ipv4s[i-1].IP)
+		if cur := peerPriority(announcerIP, ipv4s[i].IP); cur > prev {
+			t.Errorf("expected descending priorities, got %#x after %#x", cur, prev)
+		}
+	}
+}
+
+func TestAppendPeersStable(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.StablePeerSelection = true
+	pm := NewPeerMap(false, &cfg)
+
+	for i := 0; i < 50; i++ {
+		pm.Put(Peer{ID: "peer" + strconv.Itoa(i), IP: net.IPv4(10, byte(i), 1, 1).To4(), Left: 1})
+	}
+
+	announcerIP := net.ParseIP("10.0.0.2").To4()
+	ann := &Announce{
+		Config: &cfg,
+		IPv4:   announcerIP,
+		Peer:   &Peer{ID: "announcer", IP: announcerIP, Left: 1},
+	}
+
+	first, _ := pm.AppendPeers(PeerList{}, PeerList{}, ann, 10, nil)
+	for i := 0; i < 5; i++ {
+		again, _ := pm.AppendPeers(PeerList{}, PeerList{}, ann, 10, nil)
+		if !reflect.DeepEqual(first, again) {
+			t.Fatalf("expected the same peers on every announce, got %v and then %v", first, again)
+		}
+	}
+
+	now := time.Now()
+	if stableSeed(ann.Peer, now, time.Hour) == stableSeed(ann.Peer, now.Add(time.Hour), time.Hour) {
+		t.Error("expected the seed to change in the next epoch")
+	}
+	other := &Peer{ID: "other", IP: announcerIP}
+	if stableSeed(ann.Peer, now, time.Hour) == stableSeed(other, now, time.Hour) {
+		t.Error("expected announcers to be given different seeds")
+	}
+}
+
+func TestAppendPeersExcludeSameSubnet(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.ExcludeSameSubnet = true
+	cfg.ExcludedIPv4Subnet = 24
+	pm := NewPeerMap(true, &cfg)
+
+	pm.Put(Peer{ID: "nat", IP: net.ParseIP("10.0.0.3").To4()})
+	pm.Put(Peer{ID: "remote", IP: net.ParseIP("10.0.1.3").To4()})
+
+	ann := &Announce{
+		Config: &cfg,
+		IPv4:   net.ParseIP("10.0.0.2").To4(),
+		Peer:   &Peer{ID: "announcer", IP: net.ParseIP("10.0.0.2").To4()},
+	}
+
+	ipv4s, _ := pm.AppendPeers(PeerList{}, PeerList{}, ann, 50, nil)
+	if len(ipv4s) != 1 || ipv4s[0].ID != "remote" {
+		t.Errorf("expected only the peer in another subnet, got %v", ipv4s)
+	}
+}
+
+func TestAppendPeersFamilyPreference(t *testing.T) {
+	cfg := config.DefaultConfig
+	pm := NewPeerMap(true, &cfg)
+
+	for i := 0; i < 3; i++ {
+		pm.Put(Peer{ID: "v4peer" + strconv.Itoa(i), IP: net.IPv4(10, 0, 0, byte(i+1)).To4()})
+		pm.Put(Peer{ID: "v6peer" + strconv.Itoa(i), IP: net.ParseIP("fc00::" + strconv.Itoa(i+1))})
+	}
+
+	v4 := net.ParseIP("10.0.1.1").To4()
+	v6 := net.ParseIP("fc00::100")
+
+	var table = []struct {
+		preference string
+		ipv4, ipv6 net.IP
+		wanted     int
+		v4s, v6s   int
+	}{
+		{"", v4, nil, 6, 3, 0},
+		{"", nil, v6, 6, 3, 3},
+		{config.PeerFamilyMatchAnnouncer, nil, v6, 6, 0, 3},
+		{config.PeerFamilyBoth, v4, nil, 6, 3, 3},
+		{config.PeerFamilyPreferIPv4, v4, v6, 4, 3, 1},
+		{config.PeerFamilyPreferIPv6, v4, v6, 4, 1, 3},
+		{config.PeerFamilyPreferIPv6, v4, nil, 4, 3, 0},
+	}
+
+	for _, tt := range table {
+		cfg.PeerFamilyPreference = tt.preference
+		ip := tt.ipv4
+		if ip == nil {
+			ip = tt.ipv6
+		}
+		ann := &Announce{
+			Config: &cfg,
+			IPv4:   tt.ipv4,
+			IPv6:   tt.ipv6,
+			Peer:   &Peer{ID: "announcer", IP: ip},
+		}
+
+		ipv4s, ipv6s := pm.AppendPeers(PeerList{}, PeerList{}, ann, tt.wanted, nil)
+		if len(ipv4s) != tt.v4s || len(ipv6s) != tt.v6s {
+			t.Errorf("expected %d IPv4 and %d IPv6 peers with %q, got %d and %d",
+				tt.v4s, tt.v6s, tt.preference, len(ipv4s), len(ipv6s))
+		}
+	}
+}
+
+func TestPeerMapMetadataLen(t *testing.T) {
+	cfg := config.DefaultConfig
+	pm := NewPeerMap(false, &cfg)
+
+	magnet := Peer{ID: "magnet", IP: net.ParseIP("10.0.0.1").To4(), Left: 100}
+	leecher := Peer{ID: "leecher", IP: net.ParseIP("10.0.0.2").To4(), Left: 100, Downloaded: 1}
+	stale := Peer{ID: "stale", IP: net.ParseIP("10.0.0.3").To4(), Left: 100}
+
+	pm.Put(magnet)
+	pm.Put(magnet)
+	pm.Put(leecher)
+	pm.Put(stale)
+	if pm.MetadataLen() != 2 {
+		t.Fatalf("expected 2 peers fetching metadata, got %d", pm.MetadataLen())
+	}
+
+	magnet.Downloaded = 1
+	pm.Put(magnet)
+	if pm.MetadataLen() != 1 {
+		t.Errorf("expected a peer that started downloading to be counted as leeching, got %d", pm.MetadataLen())
+	}
+
+	pm.Delete(stale.Key())
+	if pm.MetadataLen() != 0 || pm.Len() != 2 {
+		t.Errorf("expected deleting the last peer fetching metadata to reset the count, got %d", pm.MetadataLen())
+	}
+}
+
+func TestLookUpMoved(t *testing.T) {
+	cfg := config.DefaultConfig
+	pm := NewPeerMap(false, &cfg)
+
+	moved := Peer{ID: "peer", ClientKey: "key", IP: net.ParseIP("10.0.0.1").To4()}
+	pm.Put(moved)
+	pm.Put(Peer{ID: "peer", ClientKey: "other", IP: net.ParseIP("10.0.0.2").To4()})
+	pm.Put(Peer{ID: "peer", ClientKey: "key", IP: net.ParseIP("fc00::1")})
+	pm.Put(Peer{ID: "stranger", ClientKey: "key", IP: net.ParseIP("10.0.0.4").To4()})
+
+	p := &Peer{ID: "peer", ClientKey: "key", IP: net.ParseIP("10.0.0.3").To4()}
+	if peer, exists := pm.LookUpMoved(p); !exists || peer.Key() != moved.Key() {
+		t.Fatalf("expected to find %s, got %s", moved.Key(), peer.Key())
+	}
+
+	pm.Delete(moved.Key())
+	if peer, exists := pm.LookUpMoved(p); exists {
+		t.Errorf("expected no moved peer, got %s", peer.Key())
+	}
+
+	p.ClientKey = ""
+	pm.Put(moved)
+	if peer, exists := pm.LookUpMoved(p); exists {
+		t.Errorf("expected a peer without a client key not to match, got %s", peer.Key())
+	}
+}
+
+func TestPeerMapOldest(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PreferredSubnet = true
+	cfg.PreferredIPv4Subnet = 24
+	pm := NewPeerMap(false, &cfg)
+
+	if _, exists := pm.Oldest(); exists {
+		t.Fatal("expected an empty PeerMap to have no oldest peer")
+	}
+
+	peers := make([]Peer, 10)
+	for i := range peers {
+		peers[i] = Peer{
+			ID:           "peer" + strconv.Itoa(i),
+			IP:           net.IPv4(10, 0, byte(i%3), byte(i)).To4(),
+			LastAnnounce: int64(100 + i),
+		}
+		pm.Put(peers[i])
+	}
+
+	checkOldest := func(expected Peer) {
+		if oldest, exists := pm.Oldest(); !exists || oldest.Key() != expected.Key() {
+			t.Fatalf("expected %s to be the oldest peer, got %s", expected.Key(), oldest.Key())
+		}
+	}
+	checkOldest(peers[0])
+
+	// Reannouncing moves a peer to the back of the order.
+	peers[0].LastAnnounce = 200
+	pm.Put(peers[0])
+	checkOldest(peers[1])
+
+	pm.Delete(peers[1].Key())
+	checkOldest(peers[2])
+
+	for _, peer := range peers[2:6] {
+		pm.Delete(peer.Key())
+	}
+	checkOldest(peers[6])
+
+	cp := pm.Copy()
+	pm.Delete(peers[6].Key())
+	if oldest, _ := cp.Oldest(); oldest.Key() != peers[6].Key() {
+		t.Errorf("expected the copy to keep its own order, got %s", oldest.Key())
+	}
+	checkOldest(peers[7])
+}
+
+func TestCollectUserPeerIDs(t *testing.T) {
+	cfg := config.DefaultConfig
+	pm := NewPeerMap(false, &cfg)
+
+	// A dual-stacked peer is counted once.
+	pm.Put(Peer{ID: "peer1", UserID: 1, IP: net.ParseIP("10.0.0.1").To4()})
+	pm.Put(Peer{ID: "peer1", UserID: 1, IP: net.ParseIP("fc00::1")})
+	pm.Put(Peer{ID: "peer2", UserID: 1, IP: net.ParseIP("10.0.0.2").To4()})
+	pm.Put(Peer{ID: "peer3", UserID: 2, IP: net.ParseIP("10.0.0.3").To4()})
+	pm.Put(Peer{ID: "public", IP: net.ParseIP("10.0.0.4").To4()})
+
+	collect := func(userID uint64) map[string]bool {
+		ids := make(map[string]bool)
+		pm.CollectUserPeerIDs(userID, ids)
+		return ids
+	}
+
+	if ids := collect(1); !reflect.DeepEqual(ids, map[string]bool{"peer1": true, "peer2": true}) {
+		t.Errorf("expected the peers of user 1, got %v", ids)
+	}
+
+	pm.Delete(NewPeerKey("peer1", net.ParseIP("10.0.0.1").To4()))
+	pm.Delete(NewPeerKey("peer2", net.ParseIP("10.0.0.2").To4()))
+	if ids := collect(1); !reflect.DeepEqual(ids, map[string]bool{"peer1": true}) {
+		t.Errorf("expected only the remaining peer of user 1, got %v", ids)
+	}
+
+	// A peer taken over by another user moves to that user.
+	pm.Put(Peer{ID: "peer3", UserID: 1, IP: net.ParseIP("10.0.0.3").To4()})
+	if ids := collect(2); len(ids) != 0 {
+		t.Errorf("expected user 2 to have no peers, got %v", ids)
+	}
+	if ids := collect(0); len(ids) != 0 {
+		t.Errorf("expected peers without a user not to be collected, got %v", ids)
+	}
+
+	cp := pm.Copy()
+	pm.Delete(NewPeerKey("peer3", net.ParseIP("10.0.0.3").To4()))
+	ids := make(map[string]bool)
+	cp.CollectUserPeerIDs(1, ids)
+	if !reflect.DeepEqual(ids, map[string]bool{"peer1": true, "peer3": true}) {
+		t.Errorf("expected the copy to keep its own counts, got %v", ids)
+	}
+}
+
+func TestPeerClone(t *testing.T) {
+	peer := Peer{ID: "peer1", IP: net.ParseIP("10.0.0.1").To4(), Port: 1234}
+	cp := peer.Clone()
+	peer.IP[3] = 2
+
+	if !cp.IP.Equal(net.ParseIP("10.0.0.1")) || cp.ID != peer.ID || cp.Port != peer.Port {
+		t.Errorf("expected the clone to be independent, got %+v", cp)
+	}
+}
+
+func TestAppendPeersConcurrentMutation(t *testing.T) {
+	cfg := config.DefaultConfig
+	pm := NewPeerMap(true, &cfg)
+
+	ips := make([]net.IP, 50)
+	for i := range ips {
+		ips[i] = net.IPv4(10, 0, 0, byte(i)).To4()
+		pm.Put(Peer{ID: "peer" + strconv.Itoa(i), IP: ips[i], Port: 1234})
+	}
+
+	ann := &Announce{
+		Config: &cfg,
+		IPv4:   net.ParseIP("10.0.1.1").To4(),
+		Peer:   &Peer{ID: "announcer", IP: net.ParseIP("10.0.1.1").To4()},
+	}
+	ipv4s, _ := pm.AppendPeers(PeerList{}, PeerList{}, ann, 50, nil)
+
+	// Mutate the swarm, including the memory its peers were created from,
+	// while responses are being built.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i, ip := range ips {
+			ip[0] = 192
+			pm.Delete(NewPeerKey("peer"+strconv.Itoa(i), ip))
+			pm.Put(Peer{ID: "peer" + strconv.Itoa(i), IP: ip, Port: 5678})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			pm.AppendPeers(PeerList{}, PeerList{}, ann, 50, nil)
+		}
+	}()
+	wg.Wait()
+
+	if len(ipv4s) != 50 {
+		t.Fatalf("expected 50 peers, got %d", len(ipv4s))
+	}
+	for _, peer := range ipv4s {
+		if peer.IP[0] != 10 || peer.Port != 1234 {
+			t.Errorf("expected returned peers to be unaffected by the swarm, got %s:%d", peer.IP, peer.Port)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket for a single key.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits how often each key, such as a peer announcing a torrent,
+// may be used with a token bucket per key. Each bucket holds up to burst
+// tokens and regains one token every interval. Full buckets are forgotten as
+// keys are used, so that the buckets of peers that stop announcing do not pile
+// up.
+type rateLimiter struct {
+	burst    float64
+	interval time.Duration
+
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	sync.Mutex
+}
+
+func newRateLimiter(burst int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{
+		burst:     float64(burst),
+		interval:  interval,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// refill adds the tokens a bucket has regained since it was last used.
+func (rl *rateLimiter) refill(b *bucket, now time.Time) {
+	b.tokens += float64(now.Sub(b.last)) / float64(rl.interval)
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+}
+
+// Allow takes a token from a key's bucket, returning false if there are none
+// left.
+func (rl *rateLimiter) Allow(key string, now time.Time) bool {
+	rl.Lock()
+	defer rl.Unlock()
+
+	rl.sweep(now)
+
+	b, exists := rl.buckets[key]
+	if !exists {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	rl.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Purge forgets the buckets that have completely refilled, since they are
+// indistinguishable from new ones.
+func (rl *rateLimiter) Purge(now time.Time) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	rl.purge(now)
+}
+
+// sweep purges full buckets at most once per time it takes an empty bucket to
+// refill. The lock must be held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Duration(rl.burst*float64(rl.interval)) {
+		return
+	}
+	rl.purge(now)
+}
+
+// purge forgets the buckets that have completely refilled. The lock must be
+// held.
+func (rl *rateLimiter) purge(now time.Time) {
+	for key, b := range rl.buckets {
+		rl.refill(b, now)
+		if b.tokens >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
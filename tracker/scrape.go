@@ -8,23 +8,61 @@ import "github.com/chihaya/chihaya/tracker/models"
 
 // HandleScrape encapsulates all the logic of handling a BitTorrent client's
 // scrape without being coupled to any transport protocol.
-func (tkr *Tracker) HandleScrape(scrape *models.Scrape, w Writer) (err error) {
+//
+// Errors caused by the client are written using w.WriteError rather than
+// returned. Infohashes that are not tracked are omitted from the response
+// rather than failing the entire scrape.
+func (tkr *Tracker) HandleScrape(scrape *models.Scrape, w Writer) error {
+	if err := tkr.begin(); err != nil {
+		return err
+	}
+	defer tkr.end()
+
+	return handleError(tkr.handleScrape(scrape, w), w)
+}
+
+func (tkr *Tracker) handleScrape(scrape *models.Scrape, w Writer) (err error) {
 	if tkr.Config.PrivateEnabled {
 		if _, err = tkr.FindUser(scrape.Passkey); err != nil {
 			return err
 		}
 	}
 
-	var torrents []*models.Torrent
 	for _, infohash := range scrape.Infohashes {
-		torrent, err := tkr.FindTorrent(infohash)
-		if err != nil {
+		if err = tkr.checkInfohash(infohash); err != nil {
 			return err
 		}
+	}
+
+	linked := make([]string, len(scrape.Infohashes))
+	for i, infohash := range scrape.Infohashes {
+		linked[i] = tkr.LinkedTorrent(infohash)
+	}
+
+	found, err := tkr.ScrapeTorrents(linked)
+	if err != nil {
+		return err
+	}
+
+	var torrents []*models.Torrent
+	for i, infohash := range scrape.Infohashes {
+		torrent, exists := found[linked[i]]
+		if !exists {
+			continue
+		}
+
+		// Linked torrents are reported under the infohash that was asked for.
+		if linked[i] != infohash {
+			cp := *torrent
+			cp.Infohash = infohash
+			torrent = &cp
+		}
 		torrents = append(torrents, torrent)
 	}
 
 	return w.WriteScrape(&models.ScrapeResponse{
 		Files: torrents,
+
+		ExcludeMetadataPeers: tkr.Config.ExcludeMetadataPeers,
 	})
 }
@@ -0,0 +1,253 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// PeerSelector chooses which peers of a swarm are returned in response to an
+// announce.
+//
+// Implementations must be safe for concurrent use and must not return the
+// announcer itself.
+type PeerSelector interface {
+	SelectPeers(ann *models.Announce, announcer *models.Peer, t *models.Torrent, wanted int) (ipv4s, ipv6s models.PeerList)
+}
+
+// DefaultPeerSelector is the PeerSelector used by a Tracker unless another is
+// provided. Seeders are given only leechers, unless SeedersGetSeeders is
+// enabled, in which case they are given leechers first and then seeders.
+// Leechers are given seeders first and then leechers, or a mix with about
+// SeederLeecherRatio seeders if it is below 1, but never more than
+// MaxSeedersReturned seeders if it is set. Peers in the announcer's subnet are
+// preferred.
+var DefaultPeerSelector = NewPeerSelector(nil)
+
+type defaultPeerSelector struct {
+	locator models.GeoLocator
+}
+
+// NewPeerSelector returns a PeerSelector that behaves like DefaultPeerSelector
+// but, when locator is non-nil, also prefers peers in the announcer's region
+// after those in its subnet.
+func NewPeerSelector(locator models.GeoLocator) PeerSelector {
+	return defaultPeerSelector{locator}
+}
+
+func (ps defaultPeerSelector) SelectPeers(ann *models.Announce, announcer *models.Peer, t *models.Torrent, wanted int) (ipv4s, ipv6s models.PeerList) {
+	ipv4s, ipv6s = models.PeerList{}, models.PeerList{}
+
+	if announcer.Seeding() {
+		// If they're seeding, give them only leechers, unless they may also
+		// connect to other seeders.
+		ipv4s, ipv6s = t.Leechers.AppendPeers(ipv4s, ipv6s, ann, wanted, ps.locator)
+		if !ann.Config.SeedersGetSeeders {
+			return
+		}
+		return t.Seeders.AppendPeers(ipv4s, ipv6s, ann, wanted-len(ipv4s)-len(ipv6s), ps.locator)
+	}
+
+	if ann.Config.SeederLeecherRatio < 1 {
+		return ps.mixPeers(ann, t, wanted, ann.Config.SeederLeecherRatio)
+	}
+
+	// If they're leeching, prioritize giving them seeders.
+	ipv4s, ipv6s = t.Seeders.AppendPeers(ipv4s, ipv6s, ann, maxSeeders(ann, wanted), ps.locator)
+	return t.Leechers.AppendPeers(ipv4s, ipv6s, ann, wanted-len(ipv4s)-len(ipv6s), ps.locator)
+}
+
+// mixPeers returns seeders making up about ratio of wanted peers, and leechers
+// for the rest. If either pool is too small, more peers of the other are
+// returned instead.
+func (ps defaultPeerSelector) mixPeers(ann *models.Announce, t *models.Torrent, wanted int, ratio float64) (ipv4s, ipv6s models.PeerList) {
+	seedV4, seedV6 := t.Seeders.AppendPeers(models.PeerList{}, models.PeerList{}, ann, wanted, ps.locator)
+	leechV4, leechV6 := t.Leechers.AppendPeers(models.PeerList{}, models.PeerList{}, ann, wanted, ps.locator)
+	seeders, leechers := len(seedV4)+len(seedV6), len(leechV4)+len(leechV6)
+
+	numSeeders := int(float64(wanted)*ratio + 0.5)
+	if numSeeders < wanted-leechers {
+		numSeeders = wanted - leechers
+	}
+	if numSeeders > seeders {
+		numSeeders = seeders
+	}
+	if max := maxSeeders(ann, wanted); numSeeders > max {
+		numSeeders = max
+	}
+
+	ipv4s, ipv6s = truncatePeers(seedV4, seedV6, numSeeders)
+	leechV4, leechV6 = truncatePeers(leechV4, leechV6, wanted-numSeeders)
+	return append(ipv4s, leechV4...), append(ipv6s, leechV6...)
+}
+
+// maxSeeders returns the number of seeders that may be given to a leecher
+// wanting peers, which is capped by MaxSeedersReturned if it is set. The rest
+// must be leechers, even if there are too few of them, since more connections
+// to seeders would mostly be redundant.
+func maxSeeders(ann *models.Announce, wanted int) int {
+	if max := ann.Config.MaxSeedersReturned; max > 0 && max < wanted {
+		return max
+	}
+	return wanted
+}
+
+// truncatePeers keeps up to n peers of a pair of peer lists, taking from each
+// in turn so that neither address family is crowded out.
+func truncatePeers(ipv4s, ipv6s models.PeerList, n int) (models.PeerList, models.PeerList) {
+	v4, v6 := 0, 0
+	for v4+v6 < n {
+		if v4 < len(ipv4s) && (v4 <= v6 || v6 == len(ipv6s)) {
+			v4++
+		} else if v6 < len(ipv6s) {
+			v6++
+		} else {
+			break
+		}
+	}
+	return ipv4s[:v4], ipv6s[:v6]
+}
+
+// peerListKey identifies announces that would be given the same peer list.
+type peerListKey struct {
+	infohash string
+	subnet   string
+	excluded string
+	seeding  bool
+	wanted   int
+
+	ipv4, ipv6     bool
+	noIPv4, noIPv6 bool
+	webRTC         bool
+	requireCrypto  bool
+
+	// priorityIP is the announcer's address when peers are ordered by their
+	// BEP 40 priority to it, which differs even within a subnet.
+	priorityIP string
+
+	// announcer is the announcer's key when peers are chosen by a shuffle
+	// seeded for each announcer.
+	announcer models.PeerKey
+}
+
+type peerListEntry struct {
+	ipv4s, ipv6s models.PeerList
+
+	seedersVersion  uint64
+	leechersVersion uint64
+	expires         time.Time
+}
+
+// CachingPeerSelector memoizes the peer lists chosen by another PeerSelector
+// for similar announces. Entries expire after a TTL or as soon as a peer joins
+// or leaves the swarm. Announces are considered similar regardless of their
+// region, so regional preference is only approximate when cached.
+type CachingPeerSelector struct {
+	selector PeerSelector
+	ttl      time.Duration
+
+	entries   map[peerListKey]*peerListEntry
+	lastSweep time.Time
+	sync.Mutex
+}
+
+// NewCachingPeerSelector wraps a PeerSelector with a cache whose entries live
+// for at most ttl.
+func NewCachingPeerSelector(selector PeerSelector, ttl time.Duration) *CachingPeerSelector {
+	return &CachingPeerSelector{
+		selector:  selector,
+		ttl:       ttl,
+		entries:   make(map[peerListKey]*peerListEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// SelectPeers returns a cached peer list if one is still valid, and otherwise
+// asks the wrapped PeerSelector for a new one. Since cached lists may have
+// been chosen for another peer, one extra peer is requested so that the
+// announcer and peers equivalent to it can be removed from the list.
+func (cs *CachingPeerSelector) SelectPeers(ann *models.Announce, announcer *models.Peer, t *models.Torrent, wanted int) (ipv4s, ipv6s models.PeerList) {
+	key := peerListKey{
+		infohash: t.Infohash,
+		subnet:   t.Seeders.Subnet(announcer.IP),
+		excluded: t.Seeders.ExcludedSubnets(ann),
+		seeding:  announcer.Seeding(),
+		wanted:   wanted,
+		ipv4:     ann.HasIPv4(),
+		ipv6:     ann.HasIPv6(),
+		noIPv4:   ann.NoIPv4,
+		noIPv6:   ann.NoIPv6,
+		webRTC:   ann.WebRTC,
+
+		requireCrypto: ann.RequireCrypto,
+	}
+	if ann.Config.BEP40Ordering {
+		key.priorityIP = announcer.IP.String()
+	}
+	if ann.Config.StablePeerSelection {
+		key.announcer = announcer.Key()
+	}
+	now := time.Now()
+
+	cs.Lock()
+	entry, exists := cs.entries[key]
+	cs.Unlock()
+
+	if !exists || now.After(entry.expires) ||
+		entry.seedersVersion != t.Seeders.Version() ||
+		entry.leechersVersion != t.Leechers.Version() {
+
+		entry = &peerListEntry{
+			seedersVersion:  t.Seeders.Version(),
+			leechersVersion: t.Leechers.Version(),
+			expires:         now.Add(cs.ttl),
+		}
+		entry.ipv4s, entry.ipv6s = cs.selector.SelectPeers(ann, announcer, t, wanted+1)
+
+		cs.Lock()
+		cs.entries[key] = entry
+		cs.sweep(now)
+		cs.Unlock()
+	}
+
+	count := 0
+	ipv4s = withoutPeer(entry.ipv4s, announcer, &count, wanted)
+	ipv6s = withoutPeer(entry.ipv6s, announcer, &count, wanted)
+	return
+}
+
+// sweep removes expired entries at most once per TTL. The lock must be held.
+func (cs *CachingPeerSelector) sweep(now time.Time) {
+	if now.Sub(cs.lastSweep) < cs.ttl {
+		return
+	}
+
+	for key, entry := range cs.entries {
+		if now.After(entry.expires) {
+			delete(cs.entries, key)
+		}
+	}
+	cs.lastSweep = now
+}
+
+// withoutPeer copies a PeerList, leaving out peers equivalent to the provided
+// peer and stopping once count reaches wanted.
+func withoutPeer(peers models.PeerList, p *models.Peer, count *int, wanted int) models.PeerList {
+	list := models.PeerList{}
+	for _, peer := range peers {
+		if *count >= wanted {
+			break
+		}
+		if models.PeersEquivalent(&peer, p) {
+			continue
+		}
+		list = append(list, peer)
+		*count++
+	}
+	return list
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+type countingSelector struct {
+	calls int
+}
+
+func (cs *countingSelector) SelectPeers(ann *models.Announce, announcer *models.Peer, t *models.Torrent, wanted int) (ipv4s, ipv6s models.PeerList) {
+	cs.calls++
+	return DefaultPeerSelector.SelectPeers(ann, announcer, t, wanted)
+}
+
+func testAnnounce(cfg *config.Config, peerID string, left uint64) *models.Announce {
+	ip := net.ParseIP("10.0.0.1").To4()
+	return &models.Announce{
+		Config: cfg,
+		IPv4:   ip,
+		Left:   left,
+		PeerID: peerID,
+		Peer:   &models.Peer{ID: peerID, IP: ip, Left: left},
+	}
+}
+
+func TestCachingPeerSelector(t *testing.T) {
+	cfg := config.DefaultConfig
+	torrent := &models.Torrent{
+		Infohash: "infohash",
+		Seeders:  models.NewPeerMap(true, &cfg),
+		Leechers: models.NewPeerMap(false, &cfg),
+	}
+	torrent.Seeders.Put(models.Peer{ID: "seeder1", IP: net.ParseIP("10.0.0.2").To4()})
+
+	counter := &countingSelector{}
+	cs := NewCachingPeerSelector(counter, time.Hour)
+
+	ann := testAnnounce(&cfg, "leecher1", 1)
+	ipv4s, _ := cs.SelectPeers(ann, ann.Peer, torrent, 50)
+	if len(ipv4s) != 1 || counter.calls != 1 {
+		t.Fatalf("expected 1 peer from 1 call, got %d peers from %d calls", len(ipv4s), counter.calls)
+	}
+
+	ann = testAnnounce(&cfg, "leecher2", 1)
+	ipv4s, _ = cs.SelectPeers(ann, ann.Peer, torrent, 50)
+	if len(ipv4s) != 1 || counter.calls != 1 {
+		t.Fatalf("expected a cached peer list, got %d peers from %d calls", len(ipv4s), counter.calls)
+	}
+
+	// A new peer joining the swarm invalidates the cache.
+	torrent.Seeders.Put(models.Peer{ID: "seeder2", IP: net.ParseIP("10.0.0.3").To4()})
+	ipv4s, _ = cs.SelectPeers(ann, ann.Peer, torrent, 50)
+	if len(ipv4s) != 2 || counter.calls != 2 {
+		t.Fatalf("expected a fresh peer list, got %d peers from %d calls", len(ipv4s), counter.calls)
+	}
+
+	// The announcer is never returned to itself.
+	ann = testAnnounce(&cfg, "seeder1", 1)
+	ipv4s, _ = cs.SelectPeers(ann, ann.Peer, torrent, 50)
+	if len(ipv4s) != 1 || ipv4s[0].ID != "seeder2" {
+		t.Fatalf("expected only seeder2, got %v", ipv4s)
+	}
+
+	// Nor are peers of the same user, even from a list cached for another.
+	torrent.Seeders.Put(models.Peer{ID: "seeder3", UserID: 7, IP: net.ParseIP("10.0.0.4").To4()})
+	calls := counter.calls
+	ann = testAnnounce(&cfg, "leecher1", 1)
+	ipv4s, _ = cs.SelectPeers(ann, ann.Peer, torrent, 50)
+	if len(ipv4s) != 3 || counter.calls != calls+1 {
+		t.Fatalf("expected 3 peers from a fresh list, got %v from %d calls", ipv4s, counter.calls-calls)
+	}
+
+	ann = testAnnounce(&cfg, "leecher3", 1)
+	ann.Peer.UserID = 7
+	ipv4s, _ = cs.SelectPeers(ann, ann.Peer, torrent, 50)
+	if len(ipv4s) != 2 || counter.calls != calls+1 {
+		t.Fatalf("expected 2 cached peers, got %v from %d calls", ipv4s, counter.calls-calls)
+	}
+	for _, peer := range ipv4s {
+		if peer.ID == "seeder3" {
+			t.Fatalf("expected the announcer's own seeder to be left out, got %v", ipv4s)
+		}
+	}
+
+	// Pausing a peer invalidates the cache.
+	torrent.Seeders.Put(models.Peer{ID: "seeder2", IP: net.ParseIP("10.0.0.3").To4(), Paused: true})
+	ann = testAnnounce(&cfg, "leecher1", 1)
+	ipv4s, _ = cs.SelectPeers(ann, ann.Peer, torrent, 50)
+	if len(ipv4s) != 2 || counter.calls != calls+2 {
+		t.Fatalf("expected a fresh peer list without seeder2, got %v from %d calls", ipv4s, counter.calls-calls)
+	}
+	for _, peer := range ipv4s {
+		if peer.ID == "seeder2" {
+			t.Fatalf("expected the paused seeder2 to be left out, got %v", ipv4s)
+		}
+	}
+}
+
+func TestSeederLeecherRatio(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.SeederLeecherRatio = 0.7
+
+	torrent := &models.Torrent{
+		Infohash: "infohash",
+		Seeders:  models.NewPeerMap(true, &cfg),
+		Leechers: models.NewPeerMap(false, &cfg),
+	}
+	for i := 0; i < 20; i++ {
+		torrent.Seeders.Put(models.Peer{ID: "seeder" + strconv.Itoa(i), IP: net.IPv4(10, 0, 1, byte(i)).To4(), Left: 0})
+		torrent.Leechers.Put(models.Peer{ID: "leecher" + strconv.Itoa(i), IP: net.IPv4(10, 0, 2, byte(i)).To4(), Left: 1})
+	}
+
+	countSeeders := func(peers models.PeerList) (seeders int) {
+		for _, peer := range peers {
+			if peer.Left == 0 {
+				seeders++
+			}
+		}
+		return
+	}
+
+	ann := testAnnounce(&cfg, "announcer", 1)
+	ipv4s, _ := DefaultPeerSelector.SelectPeers(ann, ann.Peer, torrent, 10)
+	if len(ipv4s) != 10 || countSeeders(ipv4s) != 7 {
+		t.Errorf("expected 7 of 10 peers to be seeders, got %d of %d", countSeeders(ipv4s), len(ipv4s))
+	}
+
+	// The leechers run out, so more seeders are returned.
+	ipv4s, _ = DefaultPeerSelector.SelectPeers(ann, ann.Peer, torrent, 35)
+	if len(ipv4s) != 35 || countSeeders(ipv4s) != 20 {
+		t.Errorf("expected all 20 seeders among 35 peers, got %d of %d", countSeeders(ipv4s), len(ipv4s))
+	}
+
+	cfg.SeederLeecherRatio = 0
+	ipv4s, _ = DefaultPeerSelector.SelectPeers(ann, ann.Peer, torrent, 25)
+	if len(ipv4s) != 25 || countSeeders(ipv4s) != 5 {
+		t.Errorf("expected 5 seeders to fill in for missing leechers, got %d of %d", countSeeders(ipv4s), len(ipv4s))
+	}
+}
+
+func TestMaxSeedersReturned(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MaxSeedersReturned = 3
+
+	torrent := &models.Torrent{
+		Infohash: "infohash",
+		Seeders:  models.NewPeerMap(true, &cfg),
+		Leechers: models.NewPeerMap(false, &cfg),
+	}
+	for i := 0; i < 20; i++ {
+		torrent.Seeders.Put(models.Peer{ID: "seeder" + strconv.Itoa(i), IP: net.IPv4(10, 0, 1, byte(i)).To4(), Left: 0})
+	}
+	for i := 0; i < 5; i++ {
+		torrent.Leechers.Put(models.Peer{ID: "leecher" + strconv.Itoa(i), IP: net.IPv4(10, 0, 2, byte(i)).To4(), Left: 1})
+	}
+
+	countSeeders := func(peers models.PeerList) (seeders int) {
+		for _, peer := range peers {
+			if peer.Left == 0 {
+				seeders++
+			}
+		}
+		return
+	}
+
+	ann := testAnnounce(&cfg, "announcer", 1)
+	ipv4s, _ := DefaultPeerSelector.SelectPeers(ann, ann.Peer, torrent, 10)
+	if len(ipv4s) != 8 || countSeeders(ipv4s) != 3 {
+		t.Errorf("expected 3 seeders and 5 leechers, got %d of %d", countSeeders(ipv4s), len(ipv4s))
+	}
+
+	cfg.SeederLeecherRatio = 0.5
+	ipv4s, _ = DefaultPeerSelector.SelectPeers(ann, ann.Peer, torrent, 10)
+	if len(ipv4s) != 8 || countSeeders(ipv4s) != 3 {
+		t.Errorf("expected the ratio to be capped at 3 seeders, got %d of %d", countSeeders(ipv4s), len(ipv4s))
+	}
+
+	// The cap only applies to leechers, so seeders that may be given seeders
+	// still get as many as they want.
+	seeder := testAnnounce(&cfg, "seeder", 0)
+	cfg.SeedersGetSeeders = true
+	ipv4s, _ = DefaultPeerSelector.SelectPeers(seeder, seeder.Peer, torrent, 10)
+	if len(ipv4s) != 10 {
+		t.Errorf("expected seeders to be given 10 peers, got %d", len(ipv4s))
+	}
+}
+
+func TestTruncatePeers(t *testing.T) {
+	ipv4s := make(models.PeerList, 5)
+	ipv6s := make(models.PeerList, 2)
+
+	if v4, v6 := truncatePeers(ipv4s, ipv6s, 3); len(v4) != 2 || len(v6) != 1 {
+		t.Errorf("expected 2 IPv4 and 1 IPv6 peers, got %d and %d", len(v4), len(v6))
+	}
+	if v4, v6 := truncatePeers(ipv4s, ipv6s, 6); len(v4) != 4 || len(v6) != 2 {
+		t.Errorf("expected 4 IPv4 and 2 IPv6 peers, got %d and %d", len(v4), len(v6))
+	}
+	if v4, v6 := truncatePeers(ipv4s, ipv6s, 10); len(v4) != 5 || len(v6) != 2 {
+		t.Errorf("expected every peer to be kept, got %d and %d", len(v4), len(v6))
+	}
+}
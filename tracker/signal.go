@@ -0,0 +1,148 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// maxQueuedSignals is the maximum number of signals waiting to be received by
+// a single peer. The oldest signals are dropped first.
+const maxQueuedSignals = 16
+
+type mailbox struct {
+	signals []models.Signal
+	waiters int
+	notify  chan struct{}
+}
+
+// signalQueue holds the WebRTC signals waiting to be received by browser
+// peers, keyed by infohash and peer ID. Peer IDs are not secret, since they
+// are handed to other peers, so a mailbox can only be read with a token that
+// is given to its peer when it announces, signed with key.
+type signalQueue struct {
+	key       []byte
+	mailboxes map[string]*mailbox
+	sync.Mutex
+}
+
+func newSignalQueue() *signalQueue {
+	key := make([]byte, sha256.Size)
+	if _, err := cryptorand.Read(key); err != nil {
+		panic(err)
+	}
+	return &signalQueue{key: key, mailboxes: make(map[string]*mailbox)}
+}
+
+// token returns the token that allows reading a mailbox.
+func (q *signalQueue) token(mailboxKey string) string {
+	mac := hmac.New(sha256.New, q.key)
+	mac.Write([]byte(mailboxKey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// mailbox returns the mailbox for a key, creating it if necessary. The lock
+// must be held.
+func (q *signalQueue) mailbox(key string) *mailbox {
+	mb, exists := q.mailboxes[key]
+	if !exists {
+		mb = &mailbox{notify: make(chan struct{})}
+		q.mailboxes[key] = mb
+	}
+	return mb
+}
+
+// purge drops signals sent before the provided time, along with any mailboxes
+// left empty that are not being waited on.
+func (q *signalQueue) purge(before time.Time) {
+	q.Lock()
+	defer q.Unlock()
+
+	for key, mb := range q.mailboxes {
+		for len(mb.signals) > 0 && mb.signals[0].Sent.Before(before) {
+			mb.signals = mb.signals[1:]
+		}
+		if len(mb.signals) == 0 && mb.waiters == 0 {
+			delete(q.mailboxes, key)
+		}
+	}
+}
+
+// SignalToken returns the token a peer of a torrent must present to receive
+// its signals.
+func (tkr *Tracker) SignalToken(infohash, peerID string) string {
+	return tkr.signals.token(tkr.LinkedTorrent(infohash) + peerID)
+}
+
+// SendSignal queues a signal to be received by a peer of a torrent. It
+// returns ErrPeerDNE unless the peer is in the torrent's swarm, so that
+// mailboxes are only created for peers that can collect them.
+func (tkr *Tracker) SendSignal(infohash, peerID string, s models.Signal) error {
+	infohash = tkr.LinkedTorrent(infohash)
+	torrent, err := tkr.FindTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	if !torrent.Seeders.ContainsID(peerID) && !torrent.Leechers.ContainsID(peerID) {
+		return models.ErrPeerDNE
+	}
+
+	s.Sent = time.Now()
+
+	tkr.signals.Lock()
+	defer tkr.signals.Unlock()
+
+	mb := tkr.signals.mailbox(infohash + peerID)
+	if len(mb.signals) >= maxQueuedSignals {
+		mb.signals = mb.signals[1:]
+	}
+	mb.signals = append(mb.signals, s)
+
+	close(mb.notify)
+	mb.notify = make(chan struct{})
+	return nil
+}
+
+// ReceiveSignals returns the signals queued for a peer of a torrent. If there
+// are none, it waits until one is sent or the timeout elapses. The token must
+// be the one returned by SignalToken for the peer.
+func (tkr *Tracker) ReceiveSignals(infohash, peerID, token string, timeout time.Duration) ([]models.Signal, error) {
+	key := tkr.LinkedTorrent(infohash) + peerID
+	if !hmac.Equal([]byte(token), []byte(tkr.signals.token(key))) {
+		return nil, models.ErrInvalidSignalToken
+	}
+
+	tkr.signals.Lock()
+	mb := tkr.signals.mailbox(key)
+	if len(mb.signals) == 0 {
+		mb.waiters++
+		notify := mb.notify
+		tkr.signals.Unlock()
+
+		select {
+		case <-notify:
+		case <-time.After(timeout):
+		}
+
+		tkr.signals.Lock()
+		mb.waiters--
+	}
+	defer tkr.signals.Unlock()
+
+	signals := mb.signals
+	mb.signals = nil
+	if mb.waiters == 0 {
+		delete(tkr.signals.mailboxes, key)
+	}
+
+	return signals, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/stats"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// Snapshot writes every torrent and its swarm to w as a stream of JSON
+// objects, one per torrent, which Restore reads back. Each shard is only
+// locked while its torrents are copied, and the copies are serialized after
+// the lock is released, so that announces are not stalled by slow writes.
+func (s *Storage) Snapshot(w io.Writer) error {
+	enc := json.NewEncoder(w)
+
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		torrents := make([]*models.Torrent, 0, len(shard.torrents))
+		for _, torrent := range shard.torrents {
+			torrents = append(torrents, torrent.Copy())
+		}
+		shard.RUnlock()
+
+		for _, torrent := range torrents {
+			if err := enc.Encode(torrent); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Restore reads torrents written by Snapshot from r and puts them into the
+// storage, replacing any torrents with the same infohashes. The swarms are
+// rebuilt peer by peer, so that they are consistent with the current subnet
+// configuration, and recorded in the stats as new.
+func (s *Storage) Restore(r io.Reader, cfg *config.Config) error {
+	dec := json.NewDecoder(r)
+
+	for {
+		var torrent models.Torrent
+		if err := dec.Decode(&torrent); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		torrent.Seeders = restorePeerMap(torrent.Seeders, true, cfg)
+		torrent.Leechers = restorePeerMap(torrent.Leechers, false, cfg)
+		s.PutTorrent(&torrent)
+
+		stats.RecordEvent(stats.NewTorrent)
+		recordPeerEvents(&torrent, stats.NewSeed, stats.NewLeech)
+	}
+}
+
+// restorePeerMap creates a PeerMap holding the peers of one that has been
+// decoded from a snapshot.
+func restorePeerMap(decoded *models.PeerMap, seeders bool, cfg *config.Config) *models.PeerMap {
+	pm := models.NewPeerMap(seeders, cfg)
+	if decoded == nil {
+		return pm
+	}
+
+	for _, peers := range decoded.Peers {
+		for _, peer := range peers {
+			// IPv4 addresses are decoded in their 16-byte form.
+			if ip := peer.IP.To4(); ip != nil {
+				peer.IP = ip
+			}
+			pm.Put(peer)
+		}
+	}
+	return pm
+}
+
+// saveSnapshot writes a snapshot to a temporary file, and then moves it to
+// path, so that a crash while writing never leaves a partial snapshot behind.
+// Saves are serialized, so that the periodic and final saves never write the
+// same temporary file at once.
+func (tkr *Tracker) saveSnapshot(path string) error {
+	tkr.snapshotM.Lock()
+	defer tkr.snapshotM.Unlock()
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	err = tkr.Snapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// loadSnapshot restores the swarms saved at path, if there are any.
+func (tkr *Tracker) loadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return tkr.Restore(bufio.NewReader(f), tkr.Config)
+}
+
+// snapshotPeriodically saves a snapshot to path every interval, until the
+// Tracker is closed.
+func (tkr *Tracker) snapshotPeriodically(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-tkr.stopSnapshots:
+			return
+		}
+
+		start := time.Now()
+		if err := tkr.saveSnapshot(path); err != nil {
+			glog.Errorf("Error saving snapshot: %s", err)
+			continue
+		}
+		glog.V(0).Infof("Saved snapshot of %d torrents in %s", tkr.Len(), time.Since(start))
+	}
+}
@@ -5,6 +5,7 @@
 package tracker
 
 import (
+	"errors"
 	"hash/fnv"
 	"runtime"
 	"sync"
@@ -16,6 +17,9 @@ import (
 	"github.com/chihaya/chihaya/tracker/models"
 )
 
+// ErrSelfLink is returned when a torrent would be linked to itself.
+var ErrSelfLink = errors.New("tracker: cannot link a torrent to itself")
+
 type Torrents struct {
 	torrents map[string]*models.Torrent
 	sync.RWMutex
@@ -28,8 +32,21 @@ type Storage struct {
 	shards []Torrents
 	size   int32
 
+	// seeders and leechers count the peers across every swarm, so that the
+	// totals can be read without visiting each torrent.
+	seeders  int64
+	leechers int64
+
 	clients  map[string]bool
 	clientsM sync.RWMutex
+
+	blocked  map[string]bool
+	blockedM sync.RWMutex
+
+	// links maps the infohashes of linked torrents to the infohash of the
+	// torrent whose swarm they share.
+	links  map[string]string
+	linksM sync.RWMutex
 }
 
 func NewStorage(cfg *config.Config) *Storage {
@@ -37,6 +54,8 @@ func NewStorage(cfg *config.Config) *Storage {
 		users:   make(map[string]*models.User),
 		shards:  make([]Torrents, cfg.TorrentMapShards),
 		clients: make(map[string]bool),
+		blocked: make(map[string]bool),
+		links:   make(map[string]string),
 	}
 	for i := range s.shards {
 		s.shards[i].torrents = make(map[string]*models.Torrent)
@@ -48,6 +67,30 @@ func (s *Storage) Len() int {
 	return int(atomic.LoadInt32(&s.size))
 }
 
+// PeerTotals returns the number of seeders and leechers across every swarm.
+func (s *Storage) PeerTotals() (seeders, leechers int) {
+	return int(atomic.LoadInt64(&s.seeders)), int(atomic.LoadInt64(&s.leechers))
+}
+
+// addPeers adjusts the peer totals by the peers of a torrent, scaled by sign.
+// Swarms that were never initialized count as empty.
+func (s *Storage) addPeers(t *models.Torrent, sign int64) {
+	if t.Seeders != nil {
+		atomic.AddInt64(&s.seeders, sign*int64(t.Seeders.Len()))
+	}
+	if t.Leechers != nil {
+		atomic.AddInt64(&s.leechers, sign*int64(t.Leechers.Len()))
+	}
+}
+
+// trackPeers calls fn, which modifies the swarm of a torrent, and adjusts the
+// peer totals by the change. The torrent's shard must be locked for writing.
+func (s *Storage) trackPeers(t *models.Torrent, fn func()) {
+	s.addPeers(t, -1)
+	fn()
+	s.addPeers(t, 1)
+}
+
 func (s *Storage) getShardIndex(infohash string) uint32 {
 	idx := fnv.New32()
 	idx.Write([]byte(infohash))
@@ -90,24 +133,133 @@ func (s *Storage) FindTorrent(infohash string) (*models.Torrent, error) {
 	return &*torrent, nil
 }
 
+// TorrentSnapshot returns a deep copy of a torrent, taken while holding its
+// shard's lock so that the seeders and leechers are consistent with each
+// other. Unlike FindTorrent, the result may be freely read, e.g. to serialize
+// it, without racing against announces.
+func (s *Storage) TorrentSnapshot(infohash string) (*models.Torrent, error) {
+	shard := s.getTorrentShard(infohash, true)
+	defer shard.RUnlock()
+
+	torrent, exists := shard.torrents[infohash]
+	if !exists {
+		return nil, models.ErrTorrentDNE
+	}
+
+	return torrent.Copy(), nil
+}
+
+// ScrapeTorrents looks up multiple torrents at once, locking each shard only
+// a single time. Infohashes that are not tracked are omitted from the result.
+// The torrents are shallow copies taken under the lock, so that their counters
+// and rates can be read safely, but they share their swarms with the storage.
+func (s *Storage) ScrapeTorrents(infohashes []string) (map[string]*models.Torrent, error) {
+	byShard := make(map[uint32][]string)
+	for _, infohash := range infohashes {
+		idx := s.getShardIndex(infohash)
+		byShard[idx] = append(byShard[idx], infohash)
+	}
+
+	torrents := make(map[string]*models.Torrent, len(infohashes))
+	for idx, shardInfohashes := range byShard {
+		shard := &s.shards[idx]
+		shard.RLock()
+		for _, infohash := range shardInfohashes {
+			if torrent, exists := shard.torrents[infohash]; exists {
+				cp := *torrent
+				torrents[infohash] = &cp
+			}
+		}
+		shard.RUnlock()
+	}
+
+	return torrents, nil
+}
+
+// Torrents calls fn for every torrent in storage, stopping early if fn returns
+// false. Each shard is read-locked while it is being iterated, so fn must not
+// modify the storage.
+func (s *Storage) Torrents(fn func(*models.Torrent) bool) error {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		for _, torrent := range shard.torrents {
+			if !fn(torrent) {
+				shard.RUnlock()
+				return nil
+			}
+		}
+		shard.RUnlock()
+	}
+
+	return nil
+}
+
 func (s *Storage) PutTorrent(torrent *models.Torrent) {
 	shard := s.getTorrentShard(torrent.Infohash, false)
 	defer shard.Unlock()
 
-	_, exists := shard.torrents[torrent.Infohash]
-	if !exists {
+	old, exists := shard.torrents[torrent.Infohash]
+	if exists {
+		s.addPeers(old, -1)
+	} else {
 		atomic.AddInt32(&s.size, 1)
+		if torrent.CreatedAt == 0 {
+			torrent.CreatedAt = time.Now().Unix()
+		}
 	}
 	shard.torrents[torrent.Infohash] = &*torrent
+	s.addPeers(torrent, 1)
 }
 
-func (s *Storage) DeleteTorrent(infohash string) {
+// DeleteTorrent deletes a torrent along with its swarm, whether or not it has
+// any peers, and returns it. Every peer is recorded as having left, and the
+// links of other infohashes to the torrent are dropped.
+func (s *Storage) DeleteTorrent(infohash string) (*models.Torrent, error) {
 	shard := s.getTorrentShard(infohash, false)
-	defer shard.Unlock()
+	torrent, exists := shard.torrents[infohash]
+	if !exists {
+		shard.Unlock()
+		return nil, models.ErrTorrentDNE
+	}
 
-	if _, exists := shard.torrents[infohash]; exists {
-		atomic.AddInt32(&s.size, -1)
-		delete(shard.torrents, infohash)
+	s.removeTorrent(shard, torrent, stats.DeletedSeed, stats.DeletedLeech)
+	shard.Unlock()
+
+	s.unlinkTorrent(infohash)
+	return torrent, nil
+}
+
+// removeTorrent deletes a torrent from its shard, whose lock must be held, and
+// records its peers as having left with the provided events.
+func (s *Storage) removeTorrent(shard *Torrents, t *models.Torrent, seedEvent, leechEvent int) {
+	atomic.AddInt32(&s.size, -1)
+	s.addPeers(t, -1)
+	delete(shard.torrents, t.Infohash)
+	recordPeerEvents(t, seedEvent, leechEvent)
+}
+
+// recordPeerEvents records a peer event for each peer of a torrent that has
+// been added or deleted along with its swarm, so that the peer counts in the
+// stats stay accurate.
+func recordPeerEvents(t *models.Torrent, seedEvent, leechEvent int) {
+	for _, pm := range []*models.PeerMap{t.Seeders, t.Leechers} {
+		if pm == nil {
+			continue
+		}
+
+		event := leechEvent
+		if pm.Seeders {
+			event = seedEvent
+		}
+
+		pm.RLock()
+		for _, peers := range pm.Peers {
+			for _, peer := range peers {
+				stats.RecordPeerEvent(event, peer.HasIPv6())
+			}
+		}
+		pm.RUnlock()
 	}
 }
 
@@ -125,6 +277,199 @@ func (s *Storage) IncrementTorrentSnatches(infohash string) error {
 	return nil
 }
 
+// RecordTorrentDownload adds downloaded bytes to a torrent's download rate
+// estimate, averaged over the provided window.
+func (s *Storage) RecordTorrentDownload(infohash string, bytes uint64, window time.Duration) error {
+	shard := s.getTorrentShard(infohash, false)
+	defer shard.Unlock()
+
+	torrent, exists := shard.torrents[infohash]
+	if !exists {
+		return models.ErrTorrentDNE
+	}
+
+	torrent.RecordDownload(bytes, time.Now(), window)
+
+	return nil
+}
+
+// RecordTorrentTransfer adds the bytes reported by a peer to the totals of a
+// torrent.
+func (s *Storage) RecordTorrentTransfer(infohash string, uploaded, downloaded uint64) error {
+	shard := s.getTorrentShard(infohash, false)
+	defer shard.Unlock()
+
+	torrent, exists := shard.torrents[infohash]
+	if !exists {
+		return models.ErrTorrentDNE
+	}
+
+	torrent.TotalUploaded += uploaded
+	torrent.TotalDownloaded += downloaded
+
+	return nil
+}
+
+// RecordTorrentChurn adds to the counts of peers that have joined and left a
+// torrent's swarm.
+func (s *Storage) RecordTorrentChurn(infohash string, joined, left int) error {
+	shard := s.getTorrentShard(infohash, false)
+	defer shard.Unlock()
+
+	torrent, exists := shard.torrents[infohash]
+	if !exists {
+		return models.ErrTorrentDNE
+	}
+
+	torrent.PeersJoined += uint64(joined)
+	torrent.PeersLeft += uint64(left)
+
+	return nil
+}
+
+// RecordTorrentMetadataSize records the size of a torrent's metadata reported
+// by a peer, and returns the size once enough peers agree on it, or 0.
+func (s *Storage) RecordTorrentMetadataSize(infohash, reporter string, size int) (int, error) {
+	shard := s.getTorrentShard(infohash, false)
+	defer shard.Unlock()
+
+	torrent, exists := shard.torrents[infohash]
+	if !exists {
+		return 0, models.ErrTorrentDNE
+	}
+
+	torrent.ReportMetadataSize(reporter, size)
+	return torrent.MetadataSize, nil
+}
+
+// TorrentMetadataSize returns the size of a torrent's metadata, or 0 if it is
+// not yet known.
+func (s *Storage) TorrentMetadataSize(infohash string) (int, error) {
+	shard := s.getTorrentShard(infohash, true)
+	defer shard.RUnlock()
+
+	torrent, exists := shard.torrents[infohash]
+	if !exists {
+		return 0, models.ErrTorrentDNE
+	}
+
+	return torrent.MetadataSize, nil
+}
+
+// LinkTorrents merges the swarm of secondary into that of primary, such as
+// when the same content is shared under several infohashes. Peers already in
+// primary's swarm are kept as they are, and secondary's snatches are added to
+// primary's. Later announces and scrapes for secondary are handled by primary,
+// as are those for any torrents previously linked to secondary.
+func (s *Storage) LinkTorrents(primary, secondary string) error {
+	primary = s.LinkedTorrent(primary)
+	if primary == secondary {
+		return ErrSelfLink
+	}
+
+	// Both shards are held throughout, locked in index order so that
+	// concurrent links cannot deadlock, so that secondary's swarm is never
+	// removed unless it can be moved into primary's.
+	pi, si := s.getShardIndex(primary), s.getShardIndex(secondary)
+	first, second := pi, si
+	if second < first {
+		first, second = second, first
+	}
+	s.shards[first].Lock()
+	defer s.shards[first].Unlock()
+	if second != first {
+		s.shards[second].Lock()
+		defer s.shards[second].Unlock()
+	}
+
+	torrent, exists := s.shards[pi].torrents[primary]
+	if !exists {
+		return models.ErrTorrentDNE
+	}
+
+	s.linksM.Lock()
+	s.links[secondary] = primary
+	for from, to := range s.links {
+		if to == secondary {
+			s.links[from] = primary
+		}
+	}
+	s.linksM.Unlock()
+
+	// Now that no announce can reach secondary, its swarm can be moved.
+	merged, exists := s.shards[si].torrents[secondary]
+	if !exists {
+		return nil
+	}
+	atomic.AddInt32(&s.size, -1)
+	s.addPeers(merged, -1)
+	delete(s.shards[si].torrents, secondary)
+	stats.RecordEvent(stats.DeletedTorrent)
+
+	s.trackPeers(torrent, func() {
+		mergePeers(torrent, merged.Seeders, true)
+		mergePeers(torrent, merged.Leechers, false)
+	})
+	torrent.Snatches += merged.Snatches
+
+	return nil
+}
+
+// mergePeers puts the peers of a PeerMap into a torrent's swarm, unless it
+// already contains them.
+func mergePeers(t *models.Torrent, pm *models.PeerMap, seeders bool) {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	for _, peers := range pm.Peers {
+		for pk, peer := range peers {
+			if t.Seeders.Contains(pk) || t.Leechers.Contains(pk) {
+				continue
+			}
+			if seeders {
+				t.Seeders.Put(peer)
+			} else {
+				t.Leechers.Put(peer)
+			}
+		}
+	}
+}
+
+// unlinkTorrent drops the links of any infohashes to a deleted torrent, which
+// would otherwise keep redirecting their announces to it.
+func (s *Storage) unlinkTorrent(primary string) {
+	s.linksM.Lock()
+	defer s.linksM.Unlock()
+
+	for from, to := range s.links {
+		if to == primary {
+			delete(s.links, from)
+		}
+	}
+}
+
+// LinkedTorrent returns the infohash of the torrent that handles announces
+// and scrapes for an infohash, which is the infohash itself unless it has
+// been linked to another torrent.
+func (s *Storage) LinkedTorrent(infohash string) string {
+	s.linksM.RLock()
+	defer s.linksM.RUnlock()
+
+	if primary, exists := s.links[infohash]; exists {
+		return primary
+	}
+	return infohash
+}
+
+// PutPeer adds or updates a peer in either the seeders or the leechers of a
+// torrent.
+func (s *Storage) PutPeer(infohash string, p *models.Peer, seeder bool) error {
+	if seeder {
+		return s.PutSeeder(infohash, p)
+	}
+	return s.PutLeecher(infohash, p)
+}
+
 func (s *Storage) PutLeecher(infohash string, p *models.Peer) error {
 	shard := s.getTorrentShard(infohash, false)
 	defer shard.Unlock()
@@ -134,7 +479,7 @@ func (s *Storage) PutLeecher(infohash string, p *models.Peer) error {
 		return models.ErrTorrentDNE
 	}
 
-	torrent.Leechers.Put(*p)
+	s.trackPeers(torrent, func() { torrent.Leechers.Put(*p) })
 
 	return nil
 }
@@ -148,7 +493,7 @@ func (s *Storage) DeleteLeecher(infohash string, p *models.Peer) error {
 		return models.ErrTorrentDNE
 	}
 
-	torrent.Leechers.Delete(p.Key())
+	s.trackPeers(torrent, func() { torrent.Leechers.Delete(p.Key()) })
 
 	return nil
 }
@@ -162,7 +507,7 @@ func (s *Storage) PutSeeder(infohash string, p *models.Peer) error {
 		return models.ErrTorrentDNE
 	}
 
-	torrent.Seeders.Put(*p)
+	s.trackPeers(torrent, func() { torrent.Seeders.Put(*p) })
 
 	return nil
 }
@@ -176,11 +521,21 @@ func (s *Storage) DeleteSeeder(infohash string, p *models.Peer) error {
 		return models.ErrTorrentDNE
 	}
 
-	torrent.Seeders.Delete(p.Key())
+	s.trackPeers(torrent, func() { torrent.Seeders.Delete(p.Key()) })
 
 	return nil
 }
 
+// TorrentEmptied returns true if a torrent has lost its last peer since the
+// previous call for it.
+func (s *Storage) TorrentEmptied(infohash string) bool {
+	shard := s.getTorrentShard(infohash, false)
+	defer shard.Unlock()
+
+	torrent, exists := shard.torrents[infohash]
+	return exists && torrent.Emptied()
+}
+
 func (s *Storage) PurgeInactiveTorrent(infohash string) error {
 	shard := s.getTorrentShard(infohash, false)
 	defer shard.Unlock()
@@ -191,16 +546,53 @@ func (s *Storage) PurgeInactiveTorrent(infohash string) error {
 	}
 
 	if torrent.PeerCount() == 0 {
+		atomic.AddInt32(&s.size, -1)
+		s.addPeers(torrent, -1)
 		delete(shard.torrents, infohash)
 	}
 
 	return nil
 }
 
-func (s *Storage) PurgeInactivePeers(purgeEmptyTorrents bool, before time.Time) error {
-	unixtime := before.Unix()
+// PurgeTorrentsOlderThan deletes every torrent that has not been announced on
+// for longer than d, regardless of any peers that linger in it, and returns
+// the number of torrents deleted. Torrents that were never announced on, such
+// as those loaded from the backend, are kept. The lingering peers are recorded
+// as reaped, and if emptied is non-nil, it is called with the infohash of
+// every torrent that still had peers.
+func (s *Storage) PurgeTorrentsOlderThan(d time.Duration, emptied func(infohash string)) (int, error) {
+	before := time.Now().Add(-d).Unix()
+
+	purged := 0
+	for _, infohash := range s.infohashes() {
+		runtime.Gosched()
+		shard := s.getTorrentShard(infohash, false)
+		torrent := shard.torrents[infohash]
+
+		if torrent == nil || torrent.LastAction == 0 || torrent.LastAction >= before {
+			shard.Unlock()
+			continue
+		}
+
+		s.removeTorrent(shard, torrent, stats.ReapedSeed, stats.ReapedLeech)
+		hadPeers := torrent.PeerCount() > 0
+		shard.Unlock()
 
-	// Build a list of keys to process.
+		s.unlinkTorrent(infohash)
+		stats.RecordEvent(stats.DeletedTorrent)
+		purged++
+
+		if emptied != nil && hadPeers {
+			emptied(infohash)
+		}
+	}
+
+	return purged, nil
+}
+
+// infohashes returns the infohashes of the torrents in the storage, so that
+// they can be processed without holding the locks of entire shards.
+func (s *Storage) infohashes() []string {
 	index := 0
 	maxkeys := s.Len()
 	keys := make([]string, maxkeys)
@@ -219,9 +611,18 @@ func (s *Storage) PurgeInactivePeers(purgeEmptyTorrents bool, before time.Time)
 			break
 		}
 	}
+	return keys[:index]
+}
+
+// PurgeInactivePeers deletes the peers that have not announced since before,
+// and then deletes any torrents left without peers if purgeEmptyTorrents is
+// set. If emptied is non-nil, it is called with the infohash of every torrent
+// that lost its last peer.
+func (s *Storage) PurgeInactivePeers(purgeEmptyTorrents bool, before time.Time, emptied func(infohash string)) error {
+	unixtime := before.Unix()
 
 	// Process the keys while allowing other goroutines to run.
-	for _, infohash := range keys {
+	for _, infohash := range s.infohashes() {
 		runtime.Gosched()
 		shard := s.getTorrentShard(infohash, false)
 		torrent := shard.torrents[infohash]
@@ -232,12 +633,21 @@ func (s *Storage) PurgeInactivePeers(purgeEmptyTorrents bool, before time.Time)
 			continue
 		}
 
-		torrent.Seeders.Purge(unixtime)
-		torrent.Leechers.Purge(unixtime)
+		peersBefore := torrent.PeerCount()
+		s.trackPeers(torrent, func() {
+			torrent.Seeders.Purge(unixtime)
+			torrent.Leechers.Purge(unixtime)
+		})
 
 		peers := torrent.PeerCount()
+		torrent.PeersLeft += uint64(peersBefore - peers)
+		wasEmptied := emptied != nil && torrent.Emptied()
 		shard.Unlock()
 
+		if wasEmptied {
+			emptied(infohash)
+		}
+
 		if purgeEmptyTorrents && peers == 0 {
 			s.PurgeInactiveTorrent(infohash)
 			stats.RecordEvent(stats.ReapedTorrent)
@@ -263,14 +673,46 @@ func (s *Storage) PutUser(user *models.User) {
 	s.usersM.Lock()
 	defer s.usersM.Unlock()
 
+	if _, exists := s.users[user.Passkey]; !exists {
+		stats.RecordEvent(stats.NewUser)
+	}
 	s.users[user.Passkey] = &*user
 }
 
+// IncrementUserUpload adds to the upload total of a stored user.
+func (s *Storage) IncrementUserUpload(passkey string, delta uint64) {
+	s.updateUser(passkey, func(user *models.User) { user.Uploaded += delta })
+}
+
+// IncrementUserDownload adds to the download total of a stored user.
+func (s *Storage) IncrementUserDownload(passkey string, delta uint64) {
+	s.updateUser(passkey, func(user *models.User) { user.Downloaded += delta })
+}
+
+// updateUser applies fn to a copy of a stored user and stores the copy, since
+// the users returned by FindUser must not change underneath their callers.
+func (s *Storage) updateUser(passkey string, fn func(*models.User)) {
+	s.usersM.Lock()
+	defer s.usersM.Unlock()
+
+	user, exists := s.users[passkey]
+	if !exists {
+		return
+	}
+
+	updated := *user
+	fn(&updated)
+	s.users[passkey] = &updated
+}
+
 func (s *Storage) DeleteUser(passkey string) {
 	s.usersM.Lock()
 	defer s.usersM.Unlock()
 
-	delete(s.users, passkey)
+	if _, exists := s.users[passkey]; exists {
+		delete(s.users, passkey)
+		stats.RecordEvent(stats.DeletedUser)
+	}
 }
 
 func (s *Storage) ClientApproved(peerID string) error {
@@ -298,3 +740,37 @@ func (s *Storage) DeleteClient(peerID string) {
 
 	delete(s.clients, peerID)
 }
+
+// InfohashBlocked returns true if an infohash has been blocked.
+func (s *Storage) InfohashBlocked(infohash string) bool {
+	s.blockedM.RLock()
+	defer s.blockedM.RUnlock()
+
+	return s.blocked[infohash]
+}
+
+func (s *Storage) BlockInfohash(infohash string) {
+	s.blockedM.Lock()
+	defer s.blockedM.Unlock()
+
+	s.blocked[infohash] = true
+}
+
+func (s *Storage) UnblockInfohash(infohash string) {
+	s.blockedM.Lock()
+	defer s.blockedM.Unlock()
+
+	delete(s.blocked, infohash)
+}
+
+// BlockedInfohashes returns every blocked infohash.
+func (s *Storage) BlockedInfohashes() []string {
+	s.blockedM.RLock()
+	defer s.blockedM.RUnlock()
+
+	infohashes := make([]string, 0, len(s.blocked))
+	for infohash := range s.blocked {
+		infohashes = append(infohashes, infohash)
+	}
+	return infohashes
+}
@@ -0,0 +1,240 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+func newTestStorage(torrents int) *Storage {
+	cfg := config.DefaultConfig
+	cfg.TorrentMapShards = 4
+
+	s := NewStorage(&cfg)
+	for i := 0; i < torrents; i++ {
+		s.PutTorrent(&models.Torrent{
+			Infohash: "infohash" + strconv.Itoa(i),
+			Seeders:  models.NewPeerMap(true, &cfg),
+			Leechers: models.NewPeerMap(false, &cfg),
+		})
+	}
+	return s
+}
+
+func TestTorrents(t *testing.T) {
+	s := newTestStorage(10)
+
+	seen := make(map[string]bool)
+	s.Torrents(func(torrent *models.Torrent) bool {
+		seen[torrent.Infohash] = true
+		return true
+	})
+	if len(seen) != 10 {
+		t.Errorf("expected to iterate over 10 torrents, got %d", len(seen))
+	}
+
+	count := 0
+	s.Torrents(func(torrent *models.Torrent) bool {
+		count++
+		return count < 3
+	})
+	if count != 3 {
+		t.Errorf("expected iteration to stop after 3 torrents, got %d", count)
+	}
+}
+
+func TestTorrentSnapshot(t *testing.T) {
+	s := newTestStorage(1)
+	s.PutSeeder("infohash0", &models.Peer{ID: "seeder", IP: net.ParseIP("10.0.0.1").To4()})
+
+	snapshot, err := s.TorrentSnapshot("infohash0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.PutLeecher("infohash0", &models.Peer{ID: "leecher", IP: net.ParseIP("10.0.0.2").To4()})
+	s.DeleteSeeder("infohash0", &models.Peer{ID: "seeder", IP: net.ParseIP("10.0.0.1").To4()})
+
+	if snapshot.Seeders.Len() != 1 || snapshot.Leechers.Len() != 0 {
+		t.Errorf("expected the snapshot to be unaffected by later changes, got %d seeders and %d leechers", snapshot.Seeders.Len(), snapshot.Leechers.Len())
+	}
+
+	if _, err = s.TorrentSnapshot("unknown"); err != models.ErrTorrentDNE {
+		t.Errorf("expected ErrTorrentDNE, got %v", err)
+	}
+}
+
+func TestScrapeTorrents(t *testing.T) {
+	s := newTestStorage(2)
+	s.PutSeeder("infohash0", &models.Peer{ID: "seeder", IP: net.ParseIP("10.0.0.1").To4()})
+	s.PutLeecher("infohash0", &models.Peer{ID: "leecher1", IP: net.ParseIP("10.0.0.2").To4()})
+	s.PutLeecher("infohash0", &models.Peer{ID: "leecher2", IP: net.ParseIP("10.0.0.3").To4()})
+	s.IncrementTorrentSnatches("infohash0")
+
+	found, err := s.ScrapeTorrents([]string{"infohash0", "infohash1", "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("expected 2 torrents, got %d", len(found))
+	}
+
+	torrent := found["infohash0"]
+	if torrent.Seeders.Len() != 1 || torrent.Leechers.Len() != 2 || torrent.Snatches != 1 {
+		t.Errorf("expected 1/2/1, got %d/%d/%d", torrent.Seeders.Len(), torrent.Leechers.Len(), torrent.Snatches)
+	}
+
+	// The counters are copied under the lock, so later announces do not
+	// race with writing the scrape.
+	s.RecordTorrentTransfer("infohash0", 100, 200)
+	s.IncrementTorrentSnatches("infohash0")
+	if torrent.TotalUploaded != 0 || torrent.Snatches != 1 {
+		t.Errorf("expected the scraped torrent to be a copy, got %d uploaded and %d snatches", torrent.TotalUploaded, torrent.Snatches)
+	}
+}
+
+func TestPurgeTorrentsOlderThan(t *testing.T) {
+	s := newTestStorage(3)
+
+	s.TouchTorrent("infohash0")
+	torrent, _ := s.FindTorrent("infohash0")
+	torrent.LastAction = time.Now().Add(-2 * time.Hour).Unix()
+
+	s.PutSeeder("infohash0", &models.Peer{ID: "lingering", IP: net.ParseIP("10.0.0.2").To4()})
+
+	s.PutSeeder("infohash1", &models.Peer{ID: "seeder", IP: net.ParseIP("10.0.0.1").To4()})
+	s.TouchTorrent("infohash1")
+
+	var emptied []string
+	purged, err := s.PurgeTorrentsOlderThan(time.Hour, func(infohash string) {
+		emptied = append(emptied, infohash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("expected 1 torrent to be purged, got %d", purged)
+	}
+	if len(emptied) != 1 || emptied[0] != "infohash0" {
+		t.Errorf("expected the purged swarm to be reported empty, got %v", emptied)
+	}
+	if seeders, _ := s.PeerTotals(); seeders != 1 {
+		t.Errorf("expected 1 seeder to remain, got %d", seeders)
+	}
+
+	if _, err = s.FindTorrent("infohash0"); err != models.ErrTorrentDNE {
+		t.Errorf("expected the idle torrent to be purged, got %v", err)
+	}
+	for _, infohash := range []string{"infohash1", "infohash2"} {
+		if _, err = s.FindTorrent(infohash); err != nil {
+			t.Errorf("expected %s to be kept, got %v", infohash, err)
+		}
+	}
+}
+
+func TestLinkTorrents(t *testing.T) {
+	s := newTestStorage(3)
+
+	shared := &models.Peer{ID: "shared", IP: net.ParseIP("10.0.0.1").To4()}
+	s.PutSeeder("infohash0", shared)
+	s.PutLeecher("infohash1", shared)
+	s.PutLeecher("infohash1", &models.Peer{ID: "leecher", IP: net.ParseIP("10.0.0.2").To4()})
+	s.IncrementTorrentSnatches("infohash1")
+
+	if err := s.LinkTorrents("infohash0", "infohash1"); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := s.FindTorrent("infohash0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Seeders.Len() != 1 || torrent.Leechers.Len() != 1 || torrent.Snatches != 1 {
+		t.Errorf("expected the swarms to be merged without duplicates, got %d seeders, %d leechers and %d snatches",
+			torrent.Seeders.Len(), torrent.Leechers.Len(), torrent.Snatches)
+	}
+	if _, err := s.FindTorrent("infohash1"); err != models.ErrTorrentDNE {
+		t.Errorf("expected the secondary torrent to be removed, got %v", err)
+	}
+
+	// Links to a linked torrent follow it to its primary.
+	if err := s.LinkTorrents("infohash2", "infohash0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, infohash := range []string{"infohash0", "infohash1", "infohash2"} {
+		if linked := s.LinkedTorrent(infohash); linked != "infohash2" {
+			t.Errorf("expected %s to be handled by infohash2, got %s", infohash, linked)
+		}
+	}
+
+	if err := s.LinkTorrents("infohash1", "infohash2"); err != ErrSelfLink {
+		t.Errorf("expected a cycle to be refused, got %v", err)
+	}
+
+	// Linking to an unknown torrent leaves the secondary untouched.
+	if err := s.LinkTorrents("unknown", "infohash2"); err != models.ErrTorrentDNE {
+		t.Errorf("expected an unknown primary to be refused, got %v", err)
+	}
+	if linked := s.LinkedTorrent("infohash2"); linked != "infohash2" {
+		t.Errorf("expected infohash2 to remain unlinked, got %s", linked)
+	}
+	if _, err := s.FindTorrent("infohash2"); err != nil {
+		t.Errorf("expected infohash2 to be kept, got %v", err)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	s := newTestStorage(2)
+	s.PutSeeder("infohash0", &models.Peer{ID: "seeder", IP: net.ParseIP("10.0.0.1").To4()})
+	s.PutLeecher("infohash0", &models.Peer{ID: "magnet", IP: net.ParseIP("10.0.0.2").To4(), Left: 1})
+	s.PutLeecher("infohash1", &models.Peer{ID: "leecher", IP: net.ParseIP("::1"), Left: 1, Downloaded: 1})
+	s.IncrementTorrentSnatches("infohash1")
+
+	var buf bytes.Buffer
+	if err := s.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig
+	restored := NewStorage(&cfg)
+	if err := restored.Restore(&buf, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.Len() != 2 {
+		t.Errorf("expected 2 torrents to be restored, got %d", restored.Len())
+	}
+	if seeders, leechers := restored.PeerTotals(); seeders != 1 || leechers != 2 {
+		t.Errorf("expected 1 seeder and 2 leechers, got %d and %d", seeders, leechers)
+	}
+
+	torrent, err := restored.FindTorrent("infohash0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder, exists := torrent.Seeders.LookUp(models.NewPeerKey("seeder", net.ParseIP("10.0.0.1").To4()))
+	if !exists {
+		t.Fatal("expected the seeder to be restored")
+	}
+	if len(seeder.IP) != net.IPv4len {
+		t.Errorf("expected an IPv4 address of length %d, got %d", net.IPv4len, len(seeder.IP))
+	}
+	if torrent.Leechers.MetadataLen() != 1 {
+		t.Errorf("expected 1 leecher fetching metadata, got %d", torrent.Leechers.MetadataLen())
+	}
+
+	if torrent, err = restored.FindTorrent("infohash1"); err != nil {
+		t.Fatal(err)
+	} else if torrent.Snatches != 1 {
+		t.Errorf("expected 1 snatch, got %d", torrent.Snatches)
+	}
+}
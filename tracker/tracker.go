@@ -7,26 +7,95 @@
 package tracker
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 
 	"github.com/chihaya/chihaya/backend"
 	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/stats"
 	"github.com/chihaya/chihaya/tracker/models"
 )
 
+// ErrClosed is returned when a request is handled by a Tracker that has been
+// closed.
+var ErrClosed = errors.New("tracker: closed")
+
 // Tracker represents the logic necessary to service BitTorrent announces,
 // independently of the underlying data transports used.
 type Tracker struct {
 	Config  *config.Config
 	Backend backend.Conn
 	*Storage
+
+	// PeerSelector chooses the peers returned to announcing clients. It
+	// defaults to DefaultPeerSelector and may be replaced before serving.
+	PeerSelector PeerSelector
+
+	// AnnounceMiddleware wraps the handling of every announce, in order from
+	// the outermost. It may be set before serving.
+	AnnounceMiddleware []AnnounceMiddleware
+
+	// ID is the tracker ID returned to announcing clients.
+	ID string
+
+	// OnTorrentEmpty is called with the infohash of a torrent whenever its
+	// last peer leaves or is reaped. It is called synchronously, so it should
+	// return quickly, and may be set before serving.
+	OnTorrentEmpty func(infohash string)
+
+	// OnSnatch is called with every snatch, such as to notify a webhook. It
+	// is called from a separate goroutine so that slow handlers do not delay
+	// announces, and snatches are dropped if it falls too far behind. It may
+	// be set before serving.
+	OnSnatch func(*models.Snatch)
+
+	// AuditLogger is given every announce rejected because of the client,
+	// subject to the audit log rate limit. It defaults to logging through
+	// glog if AuditLogEnabled is set, and may be set before serving.
+	AuditLogger AuditLogger
+
+	limiter      *rateLimiter
+	auditLimiter *rateLimiter
+	dedup        *dedupCache
+	breaker      *circuitBreaker
+	departed     *departedCache
+	leeches      *activeLeeches
+	signals      *signalQueue
+	snatches     chan *models.Snatch
+	fixedPeers   models.PeerList
+
+	snapshotM     sync.Mutex
+	stopSnapshots chan struct{}
+
+	// closed is set once the Tracker refuses new requests, and shutDown once
+	// Close has been called.
+	closed   bool
+	shutDown bool
+	closedM  sync.RWMutex
+	inflight sync.WaitGroup
 }
 
 // New creates a new Tracker, and opens any necessary connections.
 // Maintenance routines are automatically spawned in the background.
 func New(cfg *config.Config) (*Tracker, error) {
+	rand.Seed(time.Now().UnixNano())
+
+	switch cfg.PeerFamilyPreference {
+	case "", config.PeerFamilyBoth, config.PeerFamilyMatchAnnouncer,
+		config.PeerFamilyPreferIPv4, config.PeerFamilyPreferIPv6:
+	default:
+		return nil, fmt.Errorf("tracker: unknown peer family preference %q", cfg.PeerFamilyPreference)
+	}
+
 	bc, err := backend.Open(&cfg.DriverConfig)
 	if err != nil {
 		return nil, err
@@ -36,6 +105,50 @@ func New(cfg *config.Config) (*Tracker, error) {
 		Config:  cfg,
 		Backend: bc,
 		Storage: NewStorage(cfg),
+
+		PeerSelector: DefaultPeerSelector,
+		ID:           cfg.TrackerID,
+
+		signals:       newSignalQueue(),
+		snatches:      make(chan *models.Snatch, snatchQueueSize),
+		stopSnapshots: make(chan struct{}),
+	}
+	go tkr.handleSnatches()
+
+	if tkr.ID == "" {
+		tkr.ID = newTrackerID()
+	}
+
+	if cfg.PeerListCacheTTL.Duration > 0 {
+		tkr.PeerSelector = NewCachingPeerSelector(tkr.PeerSelector, cfg.PeerListCacheTTL.Duration)
+	}
+
+	if cfg.AnnounceRateBurst > 0 {
+		tkr.limiter = newRateLimiter(cfg.AnnounceRateBurst, cfg.AnnounceRateInterval.Duration)
+	}
+
+	if cfg.DedupWindow.Duration > 0 {
+		tkr.dedup = newDedupCache(cfg.DedupWindow.Duration)
+	}
+
+	if cfg.IncludeRecentlyDeparted && cfg.RecentlyDepartedTTL.Duration > 0 {
+		tkr.departed = newDepartedCache(cfg.RecentlyDepartedTTL.Duration)
+	}
+
+	// Expired leeches are swept as often as inactive peers are purged.
+	if cfg.MaxActiveLeechPerUser > 0 {
+		tkr.leeches = newActiveLeeches(cfg.Announce.Duration * 2)
+	}
+
+	if cfg.BackendBreakerThreshold > 0 {
+		tkr.breaker = newCircuitBreaker(cfg.BackendBreakerThreshold, cfg.BackendBreakerCooldown.Duration)
+	}
+
+	if cfg.AuditLogEnabled {
+		tkr.AuditLogger = glogAuditLogger{}
+	}
+	if cfg.AuditLogBurst > 0 {
+		tkr.auditLimiter = newRateLimiter(cfg.AuditLogBurst, cfg.AuditLogInterval.Duration)
 	}
 
 	go tkr.purgeInactivePeers(
@@ -44,18 +157,238 @@ func New(cfg *config.Config) (*Tracker, error) {
 		cfg.Announce.Duration,
 	)
 
+	if cfg.PeerStaleAge.Duration > 0 && cfg.ReapInterval.Duration > 0 {
+		go tkr.purgeStale(cfg.ReapInterval.Duration)
+	}
+
+	if cfg.TorrentMaxIdle.Duration > 0 && cfg.TorrentPurgeInterval.Duration > 0 {
+		go tkr.purgeIdleTorrents(cfg.TorrentMaxIdle.Duration, cfg.TorrentPurgeInterval.Duration)
+	}
+
 	if cfg.ClientWhitelistEnabled {
 		tkr.LoadApprovedClients(cfg.ClientWhitelist)
 	}
 
+	if err := tkr.LoadBlockedInfohashes(cfg.BlockedInfohashes); err != nil {
+		return nil, err
+	}
+
+	if tkr.fixedPeers, err = parseFixedPeers(cfg.FixedPeers); err != nil {
+		return nil, err
+	}
+
+	if cfg.SnapshotPath != "" {
+		if err := tkr.loadSnapshot(cfg.SnapshotPath); err != nil {
+			return nil, err
+		}
+		if cfg.SnapshotInterval.Duration > 0 {
+			go tkr.snapshotPeriodically(cfg.SnapshotPath, cfg.SnapshotInterval.Duration)
+		}
+	}
+
 	return tkr, nil
 }
 
-// Close gracefully shutdowns a Tracker by closing any database connections.
+// Drain stops a Tracker from accepting new requests, and waits for in-flight
+// requests to finish. If ctx is done first, ctx.Err() is returned and the
+// remaining requests are left running.
+func (tkr *Tracker) Drain(ctx context.Context) error {
+	tkr.closedM.Lock()
+	tkr.closed = true
+	tkr.closedM.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		tkr.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close gracefully shutdowns a Tracker by draining it for up to DrainTimeout,
+// saving a final snapshot if SnapshotPath is set, and then closing any
+// database connections. Closing a Tracker again returns ErrClosed.
 func (tkr *Tracker) Close() error {
+	tkr.closedM.Lock()
+	if tkr.shutDown {
+		tkr.closedM.Unlock()
+		return ErrClosed
+	}
+	tkr.shutDown = true
+	tkr.closedM.Unlock()
+
+	ctx := context.Background()
+	if timeout := tkr.Config.DrainTimeout.Duration; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Requests that are still running may yet queue snatches, so the queue
+	// is only closed once they have all finished.
+	if err := tkr.Drain(ctx); err != nil {
+		glog.Errorf("Error draining in-flight requests: %s", err)
+	} else if tkr.snatches != nil {
+		close(tkr.snatches)
+	}
+
+	if tkr.stopSnapshots != nil {
+		close(tkr.stopSnapshots)
+	}
+
+	if path := tkr.Config.SnapshotPath; path != "" {
+		if err := tkr.saveSnapshot(path); err != nil {
+			glog.Errorf("Error saving snapshot: %s", err)
+		}
+	}
 	return tkr.Backend.Close()
 }
 
+// begin registers an in-flight request, failing if the Tracker is closed.
+// Every successful call must be paired with a call to end.
+func (tkr *Tracker) begin() error {
+	tkr.closedM.RLock()
+	defer tkr.closedM.RUnlock()
+
+	if tkr.closed {
+		return ErrClosed
+	}
+	tkr.inflight.Add(1)
+	return nil
+}
+
+// end marks an in-flight request as finished.
+func (tkr *Tracker) end() {
+	tkr.inflight.Done()
+}
+
+// healthCheckInfohash is looked up by Healthy. It is never a valid infohash,
+// so the lookup never finds a torrent.
+const healthCheckInfohash = "healthcheck"
+
+// Healthy returns an error if the tracker is unable to serve requests, either
+// because it has been closed or because its backend cannot be reached.
+func (tkr *Tracker) Healthy() error {
+	if err := tkr.begin(); err != nil {
+		return err
+	}
+	defer tkr.end()
+
+	if err := tkr.Backend.Ping(); err != nil {
+		return err
+	}
+
+	// Looking up a torrent blocks if the storage is wedged, e.g. by a lock
+	// that is never released, in which case the health check times out.
+	if _, err := tkr.FindTorrent(healthCheckInfohash); err != nil && err != models.ErrTorrentDNE {
+		return err
+	}
+	return nil
+}
+
+// Stats returns the number of torrents and peers on the tracker. The totals
+// are kept up to date as swarms change, so taking a snapshot is cheap, but
+// the counts are read independently and may be momentarily inconsistent with
+// each other under load.
+func (tkr *Tracker) Stats() (models.TrackerStats, error) {
+	if err := tkr.begin(); err != nil {
+		return models.TrackerStats{}, err
+	}
+	defer tkr.end()
+
+	seeders, leechers := tkr.PeerTotals()
+	return models.TrackerStats{
+		Torrents: tkr.Len(),
+		Peers:    seeders + leechers,
+		Seeders:  seeders,
+		Leechers: leechers,
+	}, nil
+}
+
+// RemoveTorrent deletes a torrent and drops its entire swarm, such as when it
+// is taken down by a moderator. Unlike the purging of inactive torrents, it
+// removes torrents that still have peers. Those peers are sent no notice, and
+// in public mode recreate the torrent if they announce again, so torrents that
+// must stay down should also be blocked. OnTorrentEmpty is called if the swarm
+// was not already empty.
+func (tkr *Tracker) RemoveTorrent(infohash string) error {
+	if err := tkr.begin(); err != nil {
+		return err
+	}
+	defer tkr.end()
+
+	torrent, err := tkr.DeleteTorrent(infohash)
+	if err != nil {
+		return err
+	}
+	stats.RecordEvent(stats.DeletedTorrent)
+
+	if tkr.OnTorrentEmpty != nil && torrent.PeerCount() > 0 {
+		tkr.OnTorrentEmpty(infohash)
+	}
+	return nil
+}
+
+// PutUser provisions a user in the backend, and then in the tracker's storage.
+func (tkr *Tracker) PutUser(user *models.User) error {
+	if err := tkr.Backend.PutUser(user); err != nil {
+		return err
+	}
+	tkr.Storage.PutUser(user)
+	return nil
+}
+
+// DeleteUser deprovisions a user in the backend, and then in the tracker's
+// storage.
+func (tkr *Tracker) DeleteUser(passkey string) error {
+	if err := tkr.Backend.DeleteUser(passkey); err != nil {
+		return err
+	}
+	tkr.Storage.DeleteUser(passkey)
+	return nil
+}
+
+// checkEmptied calls OnTorrentEmpty if a torrent has lost its last peer.
+func (tkr *Tracker) checkEmptied(infohash string) {
+	if tkr.OnTorrentEmpty != nil && tkr.TorrentEmptied(infohash) {
+		tkr.OnTorrentEmpty(infohash)
+	}
+}
+
+// snatchQueueSize is the number of snatches that may be waiting for OnSnatch
+// before further ones are dropped.
+const snatchQueueSize = 1024
+
+// queueSnatch passes a snatch to OnSnatch without waiting for it to be
+// handled.
+func (tkr *Tracker) queueSnatch(snatch *models.Snatch) {
+	if tkr.OnSnatch == nil || tkr.snatches == nil {
+		return
+	}
+
+	select {
+	case tkr.snatches <- snatch:
+	default:
+		glog.Warningf("Dropped snatch of %x, OnSnatch is falling behind", snatch.Infohash)
+	}
+}
+
+// handleSnatches calls OnSnatch with the queued snatches until the tracker is
+// closed.
+func (tkr *Tracker) handleSnatches() {
+	for snatch := range tkr.snatches {
+		if tkr.OnSnatch != nil {
+			tkr.OnSnatch(snatch)
+		}
+	}
+}
+
 // LoadApprovedClients loads a list of client IDs into the tracker's storage.
 func (tkr *Tracker) LoadApprovedClients(clients []string) {
 	for _, client := range clients {
@@ -63,6 +396,82 @@ func (tkr *Tracker) LoadApprovedClients(clients []string) {
 	}
 }
 
+// LoadBlockedInfohashes decodes a list of hex-encoded infohashes and blocks
+// them in the tracker's storage.
+func (tkr *Tracker) LoadBlockedInfohashes(infohashes []string) error {
+	for _, infohash := range infohashes {
+		decoded, err := hex.DecodeString(infohash)
+		if err != nil || len(decoded) != 20 {
+			return fmt.Errorf("tracker: invalid blocked infohash %q", infohash)
+		}
+		tkr.BlockInfohash(string(decoded))
+	}
+	return nil
+}
+
+// parseFixedPeers parses a list of ip:port addresses into peers.
+func parseFixedPeers(addrs []string) (models.PeerList, error) {
+	var peers models.PeerList
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("tracker: invalid fixed peer %q", addr)
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("tracker: invalid fixed peer %q", addr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("tracker: invalid fixed peer %q", addr)
+		}
+
+		peers = append(peers, models.Peer{IP: ip, Port: portNum})
+	}
+	return peers, nil
+}
+
+// newTrackerID generates a random tracker ID for trackers that are not
+// configured with one.
+func newTrackerID() string {
+	return fmt.Sprintf("%016x", rand.Int63())
+}
+
+// checkInfohash returns ErrBlockedInfohash if an infohash is blocked either in
+// the tracker's storage or by the backend.
+func (tkr *Tracker) checkInfohash(infohash string) error {
+	if tkr.InfohashBlocked(infohash) {
+		return models.ErrBlockedInfohash
+	}
+
+	var blocked bool
+	err := tkr.callBackend(func() (err error) {
+		blocked, err = tkr.Backend.IsInfohashBlocked(infohash)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return models.ErrBlockedInfohash
+	}
+	return nil
+}
+
+// callBackend calls fn, which makes requests to the backend, through the
+// circuit breaker if one is configured.
+func (tkr *Tracker) callBackend(fn func() error) error {
+	if tkr.breaker == nil {
+		return fn()
+	}
+	return tkr.breaker.Call(fn)
+}
+
 // Writer serializes a tracker's responses, and is implemented for each
 // response transport used by the tracker.
 //
@@ -74,6 +483,20 @@ type Writer interface {
 	WriteScrape(*models.ScrapeResponse) error
 }
 
+// handleError writes errors caused by the client as a failure response, so
+// that every transport reports them consistently. Any other error is returned
+// to the transport.
+func handleError(err error, w Writer) error {
+	switch err.(type) {
+	case models.ClientError, models.NotFoundError:
+		stats.RecordEvent(stats.ClientError)
+		return w.WriteError(err)
+	case models.RetryError:
+		return w.WriteError(err)
+	}
+	return err
+}
+
 // purgeInactivePeers periodically walks the torrent database and removes
 // peers that haven't announced recently.
 //
@@ -88,9 +511,102 @@ func (tkr *Tracker) purgeInactivePeers(purgeEmptyTorrents bool, threshold, inter
 		before := time.Now().Add(-threshold)
 		glog.V(0).Infof("Purging peers with no announces since %s", before)
 
-		err := tkr.PurgeInactivePeers(purgeEmptyTorrents, before)
+		err := tkr.PurgeInactivePeers(purgeEmptyTorrents, before, tkr.OnTorrentEmpty)
 		if err != nil {
 			glog.Errorf("Error purging torrents: %s", err)
 		}
+
+		if tkr.limiter != nil {
+			tkr.limiter.Purge(time.Now())
+		}
+
+		// Signals are only useful while their sender is still looking for
+		// connections, so they are dropped along with inactive peers.
+		tkr.signals.purge(before)
+	}
+}
+
+// purgeStale periodically removes peers that have not announced within
+// PeerStaleAge, which are already hidden from peer lists.
+func (tkr *Tracker) purgeStale(interval time.Duration) {
+	for _ = range time.NewTicker(interval).C {
+		before := time.Now().Add(-tkr.Config.PeerStaleAge.Duration)
+		glog.V(0).Infof("Reaping peers with no announces since %s", before)
+
+		if err := tkr.reapStalePeers(before); err != nil {
+			glog.Errorf("Error reaping peers: %s", err)
+		}
+	}
+}
+
+// purgeIdleTorrents periodically deletes torrents that have not been announced
+// on for longer than maxIdle.
+func (tkr *Tracker) purgeIdleTorrents(maxIdle, interval time.Duration) {
+	for _ = range time.NewTicker(interval).C {
+		purged, err := tkr.PurgeTorrentsOlderThan(maxIdle, tkr.OnTorrentEmpty)
+		if err != nil {
+			glog.Errorf("Error purging idle torrents: %s", err)
+			continue
+		}
+		glog.V(0).Infof("Purged %d torrents with no announces in %s", purged, maxIdle)
+	}
+}
+
+// reapStalePeers deletes every peer that has not announced since the provided
+// time, as well as any torrents left empty if PurgeInactiveTorrents is set.
+func (tkr *Tracker) reapStalePeers(before time.Time) error {
+	type stalePeers struct {
+		seeders, leechers models.PeerList
 	}
+
+	// The Torrents iterator holds shard locks, so the peers are deleted once
+	// it has finished.
+	unixtime := before.Unix()
+	stale := make(map[string]stalePeers)
+	err := tkr.Torrents(func(torrent *models.Torrent) bool {
+		peers := stalePeers{
+			seeders:  torrent.Seeders.PeersBefore(unixtime),
+			leechers: torrent.Leechers.PeersBefore(unixtime),
+		}
+		if len(peers.seeders) > 0 || len(peers.leechers) > 0 {
+			stale[torrent.Infohash] = peers
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for infohash, peers := range stale {
+		reaped := 0
+		for i := range peers.seeders {
+			if tkr.DeleteSeeder(infohash, &peers.seeders[i]) == nil {
+				stats.RecordPeerEvent(stats.ReapedSeed, peers.seeders[i].HasIPv6())
+				reaped++
+			}
+		}
+		for i := range peers.leechers {
+			if tkr.DeleteLeecher(infohash, &peers.leechers[i]) == nil {
+				stats.RecordPeerEvent(stats.ReapedLeech, peers.leechers[i].HasIPv6())
+				reaped++
+			}
+		}
+		tkr.RecordTorrentChurn(infohash, 0, reaped)
+
+		tkr.checkEmptied(infohash)
+
+		if !tkr.Config.PurgeInactiveTorrents {
+			continue
+		}
+
+		torrent, err := tkr.FindTorrent(infohash)
+		if err != nil || torrent.PeerCount() > 0 {
+			continue
+		}
+		if tkr.PurgeInactiveTorrent(infohash) == nil {
+			stats.RecordEvent(stats.ReapedTorrent)
+		}
+	}
+
+	return nil
 }
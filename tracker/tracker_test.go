@@ -0,0 +1,465 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package tracker
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/chihaya/chihaya/backend/noop"
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/stats"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+func init() {
+	stats.DefaultStats = stats.New(config.StatsConfig{})
+}
+
+func TestReapStalePeers(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.PurgeInactiveTorrents = true
+	tkr := &Tracker{Config: &cfg, Storage: newTestStorage(2)}
+
+	now := time.Now()
+	stale := &models.Peer{ID: "stale", IP: net.ParseIP("10.0.0.1").To4(), LastAnnounce: now.Add(-time.Hour).Unix()}
+	fresh := &models.Peer{ID: "fresh", IP: net.ParseIP("10.0.0.2").To4(), LastAnnounce: now.Unix()}
+
+	tkr.PutSeeder("infohash0", stale)
+	tkr.PutLeecher("infohash0", fresh)
+	tkr.PutLeecher("infohash1", stale)
+
+	if err := tkr.reapStalePeers(now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	torrent, err := tkr.FindTorrent("infohash0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Seeders.Len() != 0 || torrent.Leechers.Len() != 1 {
+		t.Errorf("expected only the fresh peer to remain, got %d seeders and %d leechers", torrent.Seeders.Len(), torrent.Leechers.Len())
+	}
+	if torrent.PeersLeft != 1 {
+		t.Errorf("expected the reaped peer to have left, got %d", torrent.PeersLeft)
+	}
+
+	if _, err := tkr.FindTorrent("infohash1"); err != models.ErrTorrentDNE {
+		t.Errorf("expected the emptied torrent to be purged, got %v", err)
+	}
+	if tkr.Len() != 1 {
+		t.Errorf("expected 1 torrent to remain, got %d", tkr.Len())
+	}
+}
+
+func TestTrackerStats(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := &Tracker{Config: &cfg, Storage: newTestStorage(3)}
+
+	now := time.Now()
+	stale := &models.Peer{ID: "stale", IP: net.ParseIP("10.0.0.1").To4(), LastAnnounce: now.Add(-time.Hour).Unix()}
+	fresh := &models.Peer{ID: "fresh", IP: net.ParseIP("10.0.0.2").To4(), LastAnnounce: now.Unix()}
+
+	tkr.PutSeeder("infohash0", stale)
+	tkr.PutLeecher("infohash0", fresh)
+	tkr.PutLeecher("infohash1", fresh)
+	tkr.PutSeeder("infohash2", fresh)
+
+	checkStats := func(expected models.TrackerStats) {
+		got, err := tkr.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != expected {
+			t.Errorf("expected stats %+v, got %+v", expected, got)
+		}
+	}
+	checkStats(models.TrackerStats{Torrents: 3, Peers: 4, Seeders: 2, Leechers: 2})
+
+	// Updating a peer leaves the totals unchanged.
+	tkr.PutLeecher("infohash1", fresh)
+	checkStats(models.TrackerStats{Torrents: 3, Peers: 4, Seeders: 2, Leechers: 2})
+
+	tkr.DeleteLeecher("infohash0", fresh)
+	checkStats(models.TrackerStats{Torrents: 3, Peers: 3, Seeders: 2, Leechers: 1})
+
+	tkr.PurgeInactivePeers(false, now.Add(-time.Minute), nil)
+	checkStats(models.TrackerStats{Torrents: 3, Peers: 2, Seeders: 1, Leechers: 1})
+
+	if _, err := tkr.DeleteTorrent("infohash2"); err != nil {
+		t.Fatal(err)
+	}
+	checkStats(models.TrackerStats{Torrents: 2, Peers: 1, Seeders: 0, Leechers: 1})
+
+	tkr.closed = true
+	if _, err := tkr.Stats(); err != ErrClosed {
+		t.Errorf("expected %v after closing, got %v", ErrClosed, err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := newCircuitBreaker(2, time.Minute)
+	now := time.Now()
+
+	// Failures caused by clients do not count.
+	for i := 0; i < 3; i++ {
+		cb.Call(func() error { return models.ErrTorrentDNE })
+	}
+	if err := cb.allow(now); err != nil {
+		t.Fatalf("expected the breaker to be closed after client errors, got %v", err)
+	}
+	cb.record(true, now)
+
+	cb.record(false, now)
+	if err := cb.allow(now); err != nil {
+		t.Fatalf("expected the breaker to be closed after one failure, got %v", err)
+	}
+	cb.record(false, now)
+
+	err := cb.allow(now.Add(time.Second))
+	retry, ok := err.(models.RetryError)
+	if !ok || retry.Err != models.ErrStorageUnavailable {
+		t.Fatalf("expected the breaker to be open, got %v", err)
+	}
+	if retry.RetryIn != time.Minute-time.Second {
+		t.Errorf("expected to retry in %s, got %s", time.Minute-time.Second, retry.RetryIn)
+	}
+
+	// Only one probe is let through once the cooldown has passed, and the
+	// breaker reopens if it fails.
+	now = now.Add(time.Minute)
+	if err := cb.allow(now); err != nil {
+		t.Fatalf("expected a probe to be allowed, got %v", err)
+	}
+	if err := cb.allow(now); err == nil {
+		t.Fatal("expected a second probe to be refused")
+	}
+	cb.record(false, now)
+	if err := cb.allow(now); err == nil {
+		t.Fatal("expected the breaker to reopen after a failed probe")
+	}
+
+	now = now.Add(time.Minute)
+	if err := cb.allow(now); err != nil {
+		t.Fatalf("expected a probe to be allowed, got %v", err)
+	}
+	cb.record(true, now)
+	if err := cb.allow(now); err != nil {
+		t.Errorf("expected the breaker to close after a successful probe, got %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, time.Second)
+	now := time.Now()
+
+	peer1 := "peer1"
+	if !rl.Allow(peer1, now) || !rl.Allow(peer1, now) {
+		t.Fatal("expected the burst to be allowed")
+	}
+	if rl.Allow(peer1, now) {
+		t.Error("expected the bucket to be empty")
+	}
+	if !rl.Allow(peer1, now.Add(time.Second)) {
+		t.Error("expected a token to be regained")
+	}
+
+	// The full buckets of peers that stopped announcing are forgotten.
+	for i := 0; i < 100; i++ {
+		rl.Allow("peer"+strconv.Itoa(i), now)
+	}
+	rl.Allow(peer1, now.Add(time.Minute))
+	if len(rl.buckets) != 1 {
+		t.Errorf("expected only the announcing peer's bucket to be kept, got %d", len(rl.buckets))
+	}
+}
+
+func TestDepartedCache(t *testing.T) {
+	dc := newDepartedCache(time.Minute)
+	now := time.Now()
+
+	peer1 := &models.Peer{ID: "peer1", IP: net.ParseIP("10.0.0.1").To4()}
+	peer2 := &models.Peer{ID: "peer2", IP: net.ParseIP("10.0.0.2").To4()}
+
+	dc.Put("infohash0", peer1, now)
+	dc.Put("infohash0", peer2, now.Add(30*time.Second))
+	dc.Put("infohash0", peer1, now.Add(40*time.Second))
+
+	peers := dc.Get("infohash0", now.Add(50*time.Second))
+	if len(peers) != 2 || peers[0].ID != "peer1" || peers[1].ID != "peer2" {
+		t.Errorf("expected both peers, most recent first, got %v", peers)
+	}
+
+	peers = dc.Get("infohash0", now.Add(95*time.Second))
+	if len(peers) != 1 || peers[0].ID != "peer1" {
+		t.Errorf("expected only the unexpired peer, got %v", peers)
+	}
+
+	if peers = dc.Get("infohash1", now); len(peers) != 0 {
+		t.Errorf("expected no peers for another torrent, got %v", peers)
+	}
+
+	for i := 0; i < maxDepartedPerTorrent+10; i++ {
+		dc.Put("infohash2", &models.Peer{ID: "peer" + strconv.Itoa(i), IP: peer1.IP}, now)
+	}
+	if peers = dc.Get("infohash2", now); len(peers) != maxDepartedPerTorrent {
+		t.Errorf("expected %d peers to be kept, got %d", maxDepartedPerTorrent, len(peers))
+	}
+}
+
+func TestDepartedPeers(t *testing.T) {
+	cfg := config.DefaultConfig
+	cfg.MaxSeedersReturned = 2
+	cfg.ExcludeSameSubnet = true
+	cfg.ExcludedIPv4Subnet = 24
+
+	tkr := &Tracker{Config: &cfg, Storage: NewStorage(&cfg), departed: newDepartedCache(time.Minute)}
+	torrent := &models.Torrent{
+		Infohash: "infohash0",
+		Seeders:  models.NewPeerMap(true, &cfg),
+		Leechers: models.NewPeerMap(false, &cfg),
+	}
+	tkr.PutTorrent(torrent)
+
+	now := time.Now()
+	for _, peer := range []*models.Peer{
+		{ID: "seeder1", IP: net.ParseIP("10.0.1.1").To4()},
+		{ID: "seeder2", IP: net.ParseIP("10.0.2.1").To4()},
+		{ID: "sibling", ClientKey: "key", IP: net.ParseIP("10.0.3.1").To4(), Left: 1},
+		{ID: "neighbour", IP: net.ParseIP("10.0.0.2").To4(), Left: 1},
+		{ID: "partial", IP: net.ParseIP("10.0.4.1").To4(), Left: 1, PartialSeed: true},
+		{ID: "leecher", IP: net.ParseIP("10.0.5.1").To4(), Left: 1},
+	} {
+		tkr.departed.Put(torrent.Infohash, peer, now)
+	}
+
+	ann := testAnnounce(&cfg, "announcer", 1)
+	ann.Torrent = torrent
+	ann.Peer.ClientKey = "key"
+	ann.NumWant = 50
+
+	ipv4s, _ := tkr.departedPeers(ann, models.PeerList{}, models.PeerList{})
+	ids := make(map[string]bool)
+	for _, peer := range ipv4s {
+		ids[peer.ID] = true
+	}
+
+	// The partial seed counts towards MaxSeedersReturned, so only one of the
+	// other seeders is returned, and never the announcer's other client or
+	// peers in its subnet.
+	if len(ipv4s) != 3 || !ids["leecher"] || !ids["partial"] || ids["seeder1"] == ids["seeder2"] {
+		t.Errorf("expected the leecher, the partial seed and one seeder, got %v", ipv4s)
+	}
+
+	// Partial seeds are not given to seeders.
+	ann = testAnnounce(&cfg, "announcer", 0)
+	ann.Torrent = torrent
+	ann.NumWant = 50
+	ipv4s, _ = tkr.departedPeers(ann, models.PeerList{}, models.PeerList{})
+	for _, peer := range ipv4s {
+		if peer.ID == "partial" {
+			t.Errorf("expected the partial seed to be left out, got %v", ipv4s)
+		}
+	}
+}
+
+func TestActiveLeeches(t *testing.T) {
+	al := newActiveLeeches(time.Minute)
+	now := time.Now()
+
+	for _, infohash := range []string{"infohash0", "infohash1"} {
+		if !al.Allow(1, infohash, 2, now) {
+			t.Fatalf("expected %s to be allowed", infohash)
+		}
+		al.Start(1, infohash, "peer1", now, time.Minute)
+	}
+	if al.Allow(1, "infohash2", 2, now) {
+		t.Error("expected a third torrent to be refused")
+	}
+	if !al.Allow(1, "infohash0", 2, now) {
+		t.Error("expected a torrent already being leeched to be allowed")
+	}
+	if !al.Allow(2, "infohash2", 2, now) {
+		t.Error("expected other users to be unaffected")
+	}
+
+	// The torrent is still leeched by peer1 when peer2 stops.
+	al.Start(1, "infohash1", "peer2", now, time.Minute)
+	al.Stop(1, "infohash1", "peer2")
+	if al.Allow(1, "infohash2", 2, now) {
+		t.Error("expected a torrent to be refused while another peer leeches")
+	}
+
+	al.Stop(1, "infohash1", "peer1")
+	if !al.Allow(1, "infohash2", 2, now) {
+		t.Error("expected a torrent to be allowed after another was stopped")
+	}
+	al.Start(1, "infohash2", "peer1", now, time.Minute)
+
+	// infohash0 was last announced at now, but infohash2 was refreshed, and
+	// infohash3 uses a longer ttl.
+	al.Start(1, "infohash2", "peer1", now.Add(30*time.Second), time.Minute)
+	if !al.Allow(1, "infohash3", 2, now.Add(90*time.Second)) {
+		t.Error("expected expired torrents to be forgotten")
+	}
+	al.Start(1, "infohash3", "peer1", now.Add(90*time.Second), time.Hour)
+	if al.Allow(1, "infohash4", 1, now.Add(10*time.Minute)) {
+		t.Error("expected a torrent with a longer ttl to still be leeched")
+	}
+}
+
+func TestSignals(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := &Tracker{Config: &cfg, Storage: newTestStorage(1), signals: newSignalQueue()}
+	tkr.PutLeecher("infohash0", &models.Peer{ID: "webpeer", IP: net.ParseIP("10.0.0.1").To4()})
+
+	if err := tkr.SendSignal("infohash0", "absent", models.Signal{PeerID: "webpeer"}); err != models.ErrPeerDNE {
+		t.Errorf("expected signals to absent peers to be refused, got %v", err)
+	}
+	if len(tkr.signals.mailboxes) != 0 {
+		t.Errorf("expected no mailbox to be created, got %d", len(tkr.signals.mailboxes))
+	}
+
+	if err := tkr.SendSignal("infohash0", "webpeer", models.Signal{PeerID: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tkr.ReceiveSignals("infohash0", "webpeer", "forged", 0); err != models.ErrInvalidSignalToken {
+		t.Errorf("expected a forged token to be refused, got %v", err)
+	}
+
+	token := tkr.SignalToken("infohash0", "webpeer")
+	signals, err := tkr.ReceiveSignals("infohash0", "webpeer", token, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signals) != 1 || signals[0].PeerID != "other" {
+		t.Errorf("expected the queued signal, got %v", signals)
+	}
+}
+
+func TestRemoveTorrent(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr := &Tracker{Config: &cfg, Storage: newTestStorage(3)}
+
+	var emptied []string
+	tkr.OnTorrentEmpty = func(infohash string) { emptied = append(emptied, infohash) }
+
+	tkr.PutSeeder("infohash0", &models.Peer{ID: "seeder", IP: net.ParseIP("10.0.0.1").To4()})
+	if err := tkr.LinkTorrents("infohash0", "infohash1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tkr.RemoveTorrent("infohash0"); err != nil {
+		t.Fatal(err)
+	}
+	if len(emptied) != 1 || emptied[0] != "infohash0" {
+		t.Errorf("expected the removed swarm to be reported empty, got %v", emptied)
+	}
+	if linked := tkr.LinkedTorrent("infohash1"); linked != "infohash1" {
+		t.Errorf("expected the link to the removed torrent to be dropped, got %s", linked)
+	}
+
+	// Torrents without peers were not emptied by their removal.
+	if err := tkr.RemoveTorrent("infohash2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(emptied) != 1 {
+		t.Errorf("expected only swarms with peers to be reported empty, got %v", emptied)
+	}
+	if err := tkr.RemoveTorrent("infohash2"); err != models.ErrTorrentDNE {
+		t.Errorf("expected removing a missing torrent to fail, got %v", err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr, err := New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tkr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tkr.Close(); err != ErrClosed {
+		t.Fatalf("expected closing again to return ErrClosed, got %v", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	cfg := config.DefaultConfig
+	tkr, err := New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tkr.begin(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tkr.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected draining to time out, got %v", err)
+	}
+	if err := tkr.begin(); err != ErrClosed {
+		t.Fatalf("expected a draining tracker to refuse requests, got %v", err)
+	}
+
+	tkr.end()
+	if err := tkr.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tkr.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.DefaultConfig
+	tkr := &Tracker{Config: &cfg, Storage: newTestStorage(64)}
+	path := filepath.Join(dir, "snapshot")
+
+	// Concurrent saves must not write or move the same temporary file.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- tkr.saveSnapshot(path)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored := NewStorage(&cfg)
+	tkr = &Tracker{Config: &cfg, Storage: restored}
+	if err := tkr.loadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Len() != 64 {
+		t.Errorf("expected 64 torrents to be restored, got %d", restored.Len())
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+const (
+	connectActionID uint32 = iota
+	announceActionID
+	scrapeActionID
+	errorActionID
+)
+
+// connectionIDRotation is the length of the time buckets that connection IDs
+// are generated for. IDs are accepted during their bucket and the next one, so
+// for at least two minutes, since clients may use one for a minute and servers
+// should accept them for two.
+const connectionIDRotation = 2 * time.Minute
+
+// maxScrapeInfohashes is the maximum number of infohashes in a single scrape.
+const maxScrapeInfohashes = 74
+
+var (
+	// byteOrder is the byte order used for every integer in the protocol.
+	byteOrder = binary.BigEndian
+
+	// initialConnectionID is the magic value sent with connect requests.
+	initialConnectionID = []byte{0, 0, 0x04, 0x17, 0x27, 0x10, 0x19, 0x80}
+
+	// announceEvents maps the event IDs of an announce to their names.
+	announceEvents = []string{"", "completed", "started", "stopped"}
+)
+
+var (
+	errMalformedPacket = models.ClientError("malformed packet")
+	errMalformedIP     = models.ClientError("malformed IP address")
+	errMalformedEvent  = models.ClientError("malformed event ID")
+	errUnknownAction   = models.ClientError("unknown action ID")
+
+	// errInternal replaces errors that are not the client's fault, so that
+	// no internal details are leaked.
+	errInternal = errors.New("internal server error")
+)
+
+// connectionIDs generates and validates the connection IDs used to prevent
+// spoofing the source address of announces and scrapes, which would otherwise
+// allow the tracker to be used to flood a victim with responses. IDs are an
+// HMAC of the client's IP address and the current time bucket under a random
+// secret, so no state is kept for each client.
+type connectionIDs struct {
+	secret []byte
+}
+
+func newConnectionIDs() *connectionIDs {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		panic("udp: failed to generate connection ID secret: " + err.Error())
+	}
+
+	return &connectionIDs{secret: secret}
+}
+
+// New generates the connection ID for an IP address at the provided time.
+func (c *connectionIDs) New(ip net.IP, now time.Time) []byte {
+	return c.generate(ip, connectionIDBucket(now))
+}
+
+// Valid returns true if a connection ID was generated for the IP address
+// during the current or previous time bucket.
+func (c *connectionIDs) Valid(id []byte, ip net.IP, now time.Time) bool {
+	bucket := connectionIDBucket(now)
+	return hmac.Equal(id, c.generate(ip, bucket)) || hmac.Equal(id, c.generate(ip, bucket-1))
+}
+
+func (c *connectionIDs) generate(ip net.IP, bucket int64) []byte {
+	buf := make([]byte, 8)
+	byteOrder.PutUint64(buf, uint64(bucket))
+
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(ip.To16())
+	mac.Write(buf)
+	return mac.Sum(nil)[:8]
+}
+
+func connectionIDBucket(now time.Time) int64 {
+	return now.UnixNano() / int64(connectionIDRotation)
+}
+
+// newAnnounce parses a UDP announce packet and generates a models.Announce.
+func newAnnounce(cfg *config.Config, packet []byte, remote net.IP) (*models.Announce, error) {
+	if len(packet) < 98 {
+		return nil, errMalformedPacket
+	}
+
+	eventID := byteOrder.Uint32(packet[80:84])
+	if eventID >= uint32(len(announceEvents)) {
+		return nil, errMalformedEvent
+	}
+
+	ipv4, ipv6, err := requestedIP(cfg, packet[84:88], remote)
+	if err != nil {
+		return nil, err
+	}
+
+	// A negative numwant, typically -1, requests the default.
+	numWant := int(int32(byteOrder.Uint32(packet[92:96])))
+
+	var key string
+	if k := byteOrder.Uint32(packet[88:92]); k != 0 {
+		key = strconv.FormatUint(uint64(k), 16)
+	}
+
+	return &models.Announce{
+		Config:     cfg,
+		Compact:    true,
+		Downloaded: byteOrder.Uint64(packet[56:64]),
+		Event:      announceEvents[eventID],
+		IPv4:       ipv4,
+		IPv6:       ipv6,
+		Infohash:   string(packet[16:36]),
+		Key:        key,
+		Left:       byteOrder.Uint64(packet[64:72]),
+		NumWant:    numWant,
+		PeerID:     string(packet[36:56]),
+		Port:       uint64(byteOrder.Uint16(packet[96:98])),
+		Uploaded:   byteOrder.Uint64(packet[72:80]),
+
+		NumWantProvided: numWant >= 0,
+	}, nil
+}
+
+// requestedIP returns the IP addresses for an announce. The IPv4 address in
+// the packet is only used if spoofing is allowed and it is non-zero.
+func requestedIP(cfg *config.Config, requested []byte, remote net.IP) (v4, v6 net.IP, err error) {
+	if ip := remote.To4(); ip != nil {
+		v4 = ip
+	} else if ip := remote.To16(); ip != nil {
+		v6 = ip
+	} else {
+		return nil, nil, errMalformedIP
+	}
+
+	if cfg.AllowIPSpoofing && byteOrder.Uint32(requested) != 0 {
+		v4 = net.IP(append([]byte{}, requested...))
+		if !cfg.DualStackedPeers {
+			v6 = nil
+		}
+	}
+
+	return
+}
+
+// newScrape parses a UDP scrape packet and generates a models.Scrape.
+func newScrape(cfg *config.Config, packet []byte) (*models.Scrape, error) {
+	data := packet[16:]
+	if len(data) == 0 || len(data)%20 != 0 || len(data)/20 > maxScrapeInfohashes {
+		return nil, errMalformedPacket
+	}
+
+	var infohashes []string
+	for len(data) >= 20 {
+		infohashes = append(infohashes, string(data[:20]))
+		data = data[20:]
+	}
+
+	return &models.Scrape{
+		Config:     cfg,
+		Infohashes: infohashes,
+	}, nil
+}
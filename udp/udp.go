@@ -0,0 +1,201 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+// Package udp implements a UDP-serving BitTorrent tracker as described by
+// BEP 15.
+package udp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/stats"
+	"github.com/chihaya/chihaya/tracker"
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// maxPacketSize is large enough for any request defined by BEP 15, including
+// a scrape of the maximum 74 infohashes.
+const maxPacketSize = 2048
+
+// Server represents a UDP serving torrent tracker.
+type Server struct {
+	config  *config.Config
+	tracker *tracker.Tracker
+
+	connIDs *connectionIDs
+
+	conn    *net.UDPConn
+	stopped bool
+	connM   sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// NewServer returns a new UDP Server for a Tracker.
+func NewServer(cfg *config.Config, tkr *tracker.Tracker) *Server {
+	return &Server{
+		config:  cfg,
+		tracker: tkr,
+		connIDs: newConnectionIDs(),
+	}
+}
+
+// ListenAndServe listens on the configured UDP address and blocks while
+// handling requests until Stop is called.
+func (s *Server) ListenAndServe() error {
+	addr, err := net.ResolveUDPAddr("udp", s.config.UDPListenAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	glog.V(0).Info("Starting UDP on ", s.config.UDPListenAddr)
+	return s.Serve(conn)
+}
+
+// Serve blocks while handling requests on the provided connection until Stop
+// is called.
+func (s *Server) Serve(conn *net.UDPConn) error {
+	s.connM.Lock()
+	if s.stopped {
+		s.connM.Unlock()
+		return conn.Close()
+	}
+	s.conn = conn
+	s.connM.Unlock()
+
+	for {
+		buf := make([]byte, maxPacketSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			s.connM.Lock()
+			stopped := s.stopped
+			s.connM.Unlock()
+
+			if stopped {
+				return nil
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handlePacket(conn, buf[:n], addr)
+		}()
+	}
+}
+
+// Stop closes the listening connection and waits for in-flight requests to
+// finish.
+func (s *Server) Stop() {
+	s.connM.Lock()
+	s.stopped = true
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.connM.Unlock()
+
+	s.wg.Wait()
+}
+
+// handlePacket handles a single request while timing it, collecting stats,
+// logging, and writing the response.
+func (s *Server) handlePacket(conn *net.UDPConn, packet []byte, addr *net.UDPAddr) {
+	w := &Writer{
+		buf:  new(bytes.Buffer),
+		ipv6: addr.IP.To4() == nil,
+	}
+
+	start := time.Now()
+	err := s.handleRequest(packet, addr, w)
+	duration := time.Since(start)
+
+	if err != nil {
+		if _, ok := err.(models.ClientError); ok {
+			stats.RecordEvent(stats.ClientError)
+		} else {
+			glog.Errorf("[UDP - %9s] %s (%s)", duration, addr, err)
+			stats.RecordEvent(stats.ErroredRequest)
+			err = errInternal
+		}
+
+		w.buf.Reset()
+		w.WriteError(err)
+	} else if glog.V(2) {
+		glog.Infof("[UDP - %9s] %s", duration, addr)
+	}
+
+	if w.buf.Len() > 0 {
+		if _, err := conn.WriteToUDP(w.buf.Bytes(), addr); err != nil {
+			glog.Errorf("Failed to write UDP response to %s: %s", addr, err)
+		}
+	}
+
+	stats.RecordEvent(stats.HandledRequest)
+	stats.RecordTiming(stats.ResponseTime, duration)
+}
+
+// handleRequest parses a request and dispatches it to the tracker.
+func (s *Server) handleRequest(packet []byte, addr *net.UDPAddr, w *Writer) error {
+	if len(packet) < 16 {
+		// Without a transaction ID, there is no way to respond.
+		return nil
+	}
+
+	connID := packet[0:8]
+	action := byteOrder.Uint32(packet[8:12])
+	w.txID = packet[12:16]
+
+	if action == connectActionID {
+		if !bytes.Equal(connID, initialConnectionID) {
+			return errMalformedPacket
+		}
+		w.writeConnect(s.connIDs.New(addr.IP, time.Now()))
+		return nil
+	}
+
+	// The source address of a packet without a valid connection ID may have
+	// been spoofed, so it is dropped rather than answered with an error that
+	// could be reflected at someone else.
+	if !s.connIDs.Valid(connID, addr.IP, time.Now()) {
+		stats.RecordEvent(stats.ClientError)
+		return nil
+	}
+
+	switch action {
+	case announceActionID:
+		stats.RecordEvent(stats.Announce)
+
+		ann, err := newAnnounce(s.config, packet, addr.IP)
+		if err != nil {
+			return err
+		}
+		return s.tracker.HandleAnnounce(ann, w)
+
+	case scrapeActionID:
+		stats.RecordEvent(stats.Scrape)
+
+		scrape, err := newScrape(s.config, packet)
+		if err != nil {
+			return err
+		}
+		w.infohashes = scrape.Infohashes
+		return s.tracker.HandleScrape(scrape, w)
+	}
+
+	return errUnknownAction
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/config"
+	"github.com/chihaya/chihaya/stats"
+	"github.com/chihaya/chihaya/tracker"
+
+	_ "github.com/chihaya/chihaya/backend/noop"
+)
+
+var infohash = []byte{0x89, 0xd4, 0xbc, 0x52, 0x11, 0x16, 0xca, 0x1d, 0x42, 0xa2, 0xf3, 0x0d, 0x1f, 0x27, 0x4d, 0x94, 0xe4, 0x68, 0x1d, 0xaf}
+
+func init() {
+	stats.DefaultStats = stats.New(config.StatsConfig{})
+}
+
+func setupTracker(cfg *config.Config) (*Server, *net.UDPConn, error) {
+	tkr, err := tracker.New(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srvConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srv := NewServer(cfg, tkr)
+	go srv.Serve(srvConn)
+
+	conn, err := net.DialUDP("udp", nil, srvConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		srv.Stop()
+		return nil, nil, err
+	}
+
+	return srv, conn, nil
+}
+
+func request(conn *net.UDPConn, packet []byte) ([]byte, error) {
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxPacketSize)
+	n, err := conn.Read(buf)
+	return buf[:n], err
+}
+
+func header(connID []byte, action uint32, txID []byte) []byte {
+	packet := append([]byte{}, connID...)
+	packet = append(packet, 0, 0, 0, byte(action))
+	return append(packet, txID...)
+}
+
+func connect(conn *net.UDPConn, t *testing.T) []byte {
+	txID := []byte{1, 2, 3, 4}
+	res, err := request(conn, header(initialConnectionID, connectActionID, txID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 16 || byteOrder.Uint32(res[0:4]) != connectActionID || !bytes.Equal(res[4:8], txID) {
+		t.Fatalf("unexpected connect response: %x", res)
+	}
+	return res[8:16]
+}
+
+func announcePacket(connID []byte, peerID string, left uint64, port uint16) []byte {
+	packet := header(connID, announceActionID, []byte{5, 6, 7, 8})
+	packet = append(packet, infohash...)
+	packet = append(packet, []byte(peerID)...)
+
+	var b [8]byte
+	packet = append(packet, b[:]...) // downloaded
+	byteOrder.PutUint64(b[:], left)
+	packet = append(packet, b[:]...)
+	packet = append(packet, make([]byte, 8)...)     // uploaded
+	packet = append(packet, 0, 0, 0, 2)             // event: started
+	packet = append(packet, 10, 0, 0, 1)            // IP: loopback is unreachable
+	packet = append(packet, 0, 0, 0, 0)             // key
+	packet = append(packet, 0xff, 0xff, 0xff, 0xff) // numwant: default
+	return append(packet, byte(port>>8), byte(port&0xff))
+}
+
+func TestUDPAnnounceAndScrape(t *testing.T) {
+	srv, conn, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	defer conn.Close()
+
+	connID := connect(conn, t)
+
+	res, err := request(conn, announcePacket(connID, "-TR2820-peer1-udp-01", 0, 1234))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0, 0, 0, 1, 5, 6, 7, 8, 0, 0, 0x07, 0x08, 0, 0, 0, 0, 0, 0, 0, 1}
+	if !bytes.Equal(res, expected) {
+		t.Fatalf("\ngot:    %x\nwanted: %x", res, expected)
+	}
+
+	res, err = request(conn, announcePacket(connID, "-TR2820-peer2-udp-02", 1, 4321))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []byte{0, 0, 0, 1, 5, 6, 7, 8, 0, 0, 0x07, 0x08, 0, 0, 0, 1, 0, 0, 0, 1, 10, 0, 0, 1, 0x04, 0xd2}
+	if !bytes.Equal(res, expected) {
+		t.Fatalf("\ngot:    %x\nwanted: %x", res, expected)
+	}
+
+	unknown := bytes.Repeat([]byte{0xaa}, 20)
+	scrape := append(header(connID, scrapeActionID, []byte{9, 9, 9, 9}), infohash...)
+	scrape = append(scrape, unknown...)
+	res, err = request(conn, scrape)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []byte{0, 0, 0, 2, 9, 9, 9, 9, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(res, expected) {
+		t.Fatalf("\ngot:    %x\nwanted: %x", res, expected)
+	}
+}
+
+func TestUDPBadConnectionID(t *testing.T) {
+	srv, conn, err := setupTracker(&config.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	defer conn.Close()
+
+	// Nothing is sent back to a source address that has not been verified.
+	res, err := request(conn, announcePacket([]byte{1, 2, 3, 4, 5, 6, 7, 8}, "-TR2820-peer1-udp-01", 0, 1234))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected no response, got %x (%v)", res, err)
+	}
+}
+
+func TestConnectionIDs(t *testing.T) {
+	ids := newConnectionIDs()
+	ip := net.ParseIP("10.0.0.1")
+	now := time.Unix(0, 0).Add(connectionIDRotation / 2)
+
+	id := ids.New(ip, now)
+	if !ids.Valid(id, ip, now) {
+		t.Error("expected a new connection ID to be valid")
+	}
+	if ids.Valid(id, net.ParseIP("10.0.0.2"), now) {
+		t.Error("expected a connection ID to be invalid for another IP")
+	}
+	if !ids.Valid(id, ip, now.Add(connectionIDRotation)) {
+		t.Error("expected a connection ID to be valid during the next rotation")
+	}
+	if ids.Valid(id, ip, now.Add(2*connectionIDRotation)) {
+		t.Error("expected a connection ID to expire after two rotations")
+	}
+	if newConnectionIDs().Valid(id, ip, now) {
+		t.Error("expected a connection ID to be invalid with another secret")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 The Chihaya Authors. All rights reserved.
+// Use of this source code is governed by the BSD 2-Clause license,
+// which can be found in the LICENSE file.
+
+package udp
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/chihaya/chihaya/tracker/models"
+)
+
+// Writer implements the tracker.Writer interface for the UDP protocol.
+type Writer struct {
+	buf  *bytes.Buffer
+	txID []byte
+
+	// ipv6 is true if the request was received over IPv6, in which case only
+	// IPv6 peers are written.
+	ipv6 bool
+
+	// infohashes are the infohashes of a scrape in the order they were
+	// requested, since responses are matched to them by position.
+	infohashes []string
+}
+
+// WriteError writes the failure reason as a null-terminated string.
+func (w *Writer) WriteError(err error) error {
+	w.writeHeader(errorActionID)
+	w.buf.WriteString(err.Error())
+	w.buf.WriteRune('\000')
+	return nil
+}
+
+// WriteAnnounce encodes an announce response according to BEP 15.
+func (w *Writer) WriteAnnounce(res *models.AnnounceResponse) error {
+	w.writeHeader(announceActionID)
+	w.writeUint32(uint32(res.Interval / time.Second))
+	w.writeUint32(uint32(res.Incomplete))
+	w.writeUint32(uint32(res.Complete))
+
+	peers := res.IPv4Peers
+	if w.ipv6 {
+		peers = res.IPv6Peers
+	}
+
+	for _, peer := range peers {
+		w.buf.Write(peer.IP)
+		w.buf.Write([]byte{byte(peer.Port >> 8), byte(peer.Port & 0xff)})
+	}
+
+	return nil
+}
+
+// WriteScrape encodes a scrape response according to BEP 15. Torrents that
+// are not tracked are reported with zero counts.
+func (w *Writer) WriteScrape(res *models.ScrapeResponse) error {
+	w.writeHeader(scrapeActionID)
+
+	torrents := make(map[string]*models.Torrent, len(res.Files))
+	for _, torrent := range res.Files {
+		torrents[torrent.Infohash] = torrent
+	}
+
+	for _, infohash := range w.infohashes {
+		torrent, exists := torrents[infohash]
+		if !exists {
+			w.buf.Write(make([]byte, 12))
+			continue
+		}
+
+		w.writeUint32(uint32(res.Complete(torrent)))
+		w.writeUint32(uint32(res.Downloaded(torrent)))
+		w.writeUint32(uint32(res.Incomplete(torrent)))
+	}
+
+	return nil
+}
+
+// writeConnect encodes a connect response containing a connection ID.
+func (w *Writer) writeConnect(connID []byte) {
+	w.writeHeader(connectActionID)
+	w.buf.Write(connID)
+}
+
+// writeHeader writes the action and transaction ID that begin every response.
+func (w *Writer) writeHeader(action uint32) {
+	w.writeUint32(action)
+	w.buf.Write(w.txID)
+}
+
+func (w *Writer) writeUint32(v uint32) {
+	var b [4]byte
+	byteOrder.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}